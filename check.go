@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/server"
+)
+
+// runCheck implements the check subcommand: it validates a config file and
+// prints the effective config, defaults included and secrets redacted. It
+// returns the process exit code.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configFile := fs.String("config", "config.json", "Path to configuration file")
+	var overrides []string
+	fs.Func("set", "Override a setting, as path=value; may be repeated", func(v string) error {
+		overrides = append(overrides, v)
+		return nil
+	})
+	fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configFile, overrides...)
+	if err == nil {
+		err = server.ValidateConfig(cfg)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,212 @@
+package admission
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when a call arrives while the queue is full.
+	ErrQueueFull = errors.New("admission queue full")
+	// ErrQueueTimeout is returned when a call waited in the queue for
+	// longer than the maximum queue wait.
+	ErrQueueTimeout = errors.New("admission queue wait exceeded")
+)
+
+// Settings configures a Limiter.
+type Settings struct {
+	// InitialLimit, MinLimit and MaxLimit bound the number of calls in
+	// flight. Setting MinLimit equal to MaxLimit fixes the limit.
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// LatencyThreshold is the latency above which a call counts as a sign
+	// of overload.
+	LatencyThreshold time.Duration
+	// BackoffRatio (0-1) multiplies the limit on overload.
+	BackoffRatio float64
+	// MaxQueue is the number of calls that may wait for a slot; zero
+	// rejects calls as soon as the limit is reached.
+	MaxQueue int
+	// MaxQueueWait bounds how long a call waits for a slot.
+	MaxQueueWait time.Duration
+}
+
+// StateFunc is called with the limit, calls in flight and calls queued
+// whenever they change.
+type StateFunc func(name string, limit float64, inFlight, queued int)
+
+// Limiter bounds the calls in flight to a backend with an adaptive limit.
+// The limit grows by one for every limit's worth of calls that complete
+// faster than the latency threshold while the limiter is busy, and is
+// multiplied by the backoff ratio when calls are slow or the backend
+// signals overload (AIMD). Calls beyond the limit wait in a FIFO queue.
+type Limiter struct {
+	name     string
+	settings Settings
+	onState  StateFunc
+
+	mu           sync.Mutex
+	limit        float64
+	inFlight     int
+	queue        *list.List // of *waiter
+	lastDecrease time.Time
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// New returns a Limiter at the initial limit. onState, which may be nil, is
+// called with name.
+func New(name string, settings Settings, onState StateFunc) *Limiter {
+	l := &Limiter{
+		name:     name,
+		settings: settings,
+		onState:  onState,
+		limit:    float64(settings.InitialLimit),
+		queue:    list.New(),
+	}
+	l.limit = math.Max(float64(settings.MinLimit), math.Min(float64(settings.MaxLimit), l.limit))
+	l.notify()
+	return l
+}
+
+// Acquire waits for a slot, in arrival order, until ctx ends or the
+// maximum queue wait passes. Every successful Acquire must be followed by
+// a Release.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.queue.Len() == 0 && l.inFlight < int(l.limit) {
+		l.inFlight++
+		l.notify()
+		l.mu.Unlock()
+		return nil
+	}
+	if l.queue.Len() >= l.settings.MaxQueue {
+		l.mu.Unlock()
+		return ErrQueueFull
+	}
+	w := &waiter{ready: make(chan struct{})}
+	elem := l.queue.PushBack(w)
+	l.notify()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.settings.MaxQueueWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.granted {
+		// Granted while giving up; the slot is ours after all
+		return nil
+	}
+	l.queue.Remove(elem)
+	l.notify()
+	return err
+}
+
+// Release frees the slot taken by Acquire.
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.grant()
+	l.notify()
+}
+
+// Sample records the latency of a call that completed normally. Calls
+// whose duration depends on their size, such as uploads, should not be
+// sampled.
+func (l *Limiter) Sample(latency time.Duration) {
+	if latency > l.settings.LatencyThreshold {
+		l.Drop()
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Only grow while the limit is what holds calls back, so that a
+	// lightly loaded limiter does not drift to the maximum
+	if float64(l.inFlight)*2 < l.limit {
+		return
+	}
+	l.limit = math.Min(float64(l.settings.MaxLimit), l.limit+1/l.limit)
+	l.grant()
+	l.notify()
+}
+
+// Drop records a call that was slow or that the backend rejected as
+// overloaded. The limit is decreased at most once per latency threshold,
+// so that one burst of slow calls counts as a single signal.
+func (l *Limiter) Drop() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastDecrease) < l.settings.LatencyThreshold {
+		return
+	}
+	l.lastDecrease = now
+	l.limit = math.Max(float64(l.settings.MinLimit), l.limit*l.settings.BackoffRatio)
+	l.notify()
+}
+
+// grant hands free slots to queued calls. l.mu must be held.
+func (l *Limiter) grant() {
+	for l.queue.Len() > 0 && l.inFlight < int(l.limit) {
+		w := l.queue.Remove(l.queue.Front()).(*waiter)
+		w.granted = true
+		l.inFlight++
+		close(w.ready)
+	}
+}
+
+// notify reports the current state. l.mu must be held.
+func (l *Limiter) notify() {
+	if l.onState != nil {
+		l.onState(l.name, l.limit, l.inFlight, l.queue.Len())
+	}
+}
+
+// Set holds a Limiter per name, created on first use.
+type Set struct {
+	settings Settings
+	onState  StateFunc
+
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+}
+
+// NewSet returns a Set whose limiters share settings and onState.
+func NewSet(settings Settings, onState StateFunc) *Set {
+	return &Set{
+		settings: settings,
+		onState:  onState,
+		limiters: make(map[string]*Limiter),
+	}
+}
+
+// Get returns the limiter for name, creating it if needed.
+func (s *Set) Get(name string) *Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.limiters[name]
+	if !ok {
+		l = New(name, s.settings, s.onState)
+		s.limiters[name] = l
+	}
+	return l
+}
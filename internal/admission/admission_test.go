@@ -0,0 +1,156 @@
+package admission
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testSettings() Settings {
+	return Settings{
+		InitialLimit:     2,
+		MinLimit:         1,
+		MaxLimit:         4,
+		LatencyThreshold: 50 * time.Millisecond,
+		BackoffRatio:     0.5,
+		MaxQueue:         1,
+		MaxQueueWait:     20 * time.Millisecond,
+	}
+}
+
+func (l *Limiter) currentLimit() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func TestAdditiveIncrease(t *testing.T) {
+	l := New("test", testSettings(), nil)
+	ctx := context.Background()
+	for range 2 {
+		if err := l.Acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each fast call while busy raises the limit by 1/limit, so about a
+	// limit's worth of them raises it by one
+	l.Sample(time.Millisecond)
+	l.Sample(time.Millisecond)
+	if limit := l.currentLimit(); limit != 2.9 {
+		t.Fatalf("limit is %v after two fast calls at limit 2, want 2.9", limit)
+	}
+	if err := l.Acquire(ctx); err != ErrQueueTimeout {
+		t.Fatalf("call beyond the whole limit got %v, want ErrQueueTimeout", err)
+	}
+	l.Sample(time.Millisecond)
+	if err := l.Acquire(ctx); err != nil {
+		t.Fatalf("call within the raised limit: %v", err)
+	}
+
+	for range 100 {
+		l.Sample(time.Millisecond)
+	}
+	if limit := l.currentLimit(); limit != 4 {
+		t.Fatalf("limit is %v, want the maximum 4", limit)
+	}
+}
+
+func TestNoIncreaseWhenIdle(t *testing.T) {
+	l := New("test", testSettings(), nil)
+	for range 100 {
+		l.Sample(time.Millisecond)
+	}
+	if limit := l.currentLimit(); limit != 2 {
+		t.Fatalf("limit grew to %v with no calls in flight", limit)
+	}
+}
+
+func TestMultiplicativeDecrease(t *testing.T) {
+	settings := testSettings()
+	settings.InitialLimit = 4
+	l := New("test", settings, nil)
+
+	l.Sample(time.Second)
+	if limit := l.currentLimit(); limit != 2 {
+		t.Fatalf("limit is %v after a slow call, want 2", limit)
+	}
+	// A burst of slow calls counts once per latency threshold
+	l.Drop()
+	if limit := l.currentLimit(); limit != 2 {
+		t.Fatalf("limit is %v after a second drop within the threshold, want 2", limit)
+	}
+	time.Sleep(settings.LatencyThreshold)
+	l.Drop()
+	l.Drop()
+	if limit := l.currentLimit(); limit != 1 {
+		t.Fatalf("limit is %v, want the minimum 1", limit)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	settings := testSettings()
+	settings.InitialLimit = 1
+	l := New("test", settings, nil)
+	ctx := context.Background()
+	if err := l.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan error)
+	go func() {
+		waited <- l.Acquire(ctx)
+	}()
+	// Wait for the call above to be queued
+	for {
+		l.mu.Lock()
+		queued := l.queue.Len()
+		l.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := l.Acquire(ctx); err != ErrQueueFull {
+		t.Fatalf("call beyond the queue got %v, want ErrQueueFull", err)
+	}
+
+	start := time.Now()
+	if err := <-waited; err != ErrQueueTimeout {
+		t.Fatalf("queued call got %v, want ErrQueueTimeout", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("queued call waited far longer than max_queue_wait")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.queue.Len() != 0 || l.inFlight != 1 {
+		t.Fatalf("%d queued and %d in flight after the timeout, want 0 and 1", l.queue.Len(), l.inFlight)
+	}
+}
+
+func TestQueueGrantedOnRelease(t *testing.T) {
+	settings := testSettings()
+	settings.InitialLimit = 1
+	settings.MaxQueueWait = time.Minute
+	l := New("test", settings, nil)
+	ctx := context.Background()
+	if err := l.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan error)
+	go func() {
+		waited <- l.Acquire(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.Release()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued call not granted the released slot")
+	}
+}
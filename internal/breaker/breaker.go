@@ -0,0 +1,209 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	Closed State = iota
+	HalfOpen
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half_open"
+	case Open:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+type Settings struct {
+	Window           time.Duration
+	MinRequests      int
+	ErrorThreshold   float64
+	LatencyThreshold time.Duration
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+}
+
+// StateChangeFunc is called whenever a breaker moves between states.
+type StateChangeFunc func(name string, from, to State)
+
+// Breaker trips open when the failure ratio over a fixed window exceeds the
+// configured threshold, rejects calls while open, and half-opens after
+// OpenDuration to let a limited number of probe calls through.
+type Breaker struct {
+	name          string
+	settings      Settings
+	onStateChange StateChangeFunc
+
+	mu                sync.Mutex
+	state             State
+	windowStart       time.Time
+	requests          int
+	failures          int
+	openedAt          time.Time
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+	// generation counts state changes. Calls carry the generation they
+	// were admitted in, so that results of calls admitted before a change
+	// are not counted against the new state.
+	generation uint64
+	// now is the clock, replaced in tests.
+	now func() time.Time
+}
+
+func New(name string, settings Settings, onStateChange StateChangeFunc) *Breaker {
+	return &Breaker{
+		name:          name,
+		settings:      settings,
+		onStateChange: onStateChange,
+		windowStart:   time.Now(),
+		now:           time.Now,
+	}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(b.now())
+	return b.state
+}
+
+// Allow reports whether a call may proceed, and the generation it was
+// admitted in. Every allowed call must be followed by exactly one Record
+// with that generation.
+func (b *Breaker) Allow() (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(b.now())
+	switch b.state {
+	case Open:
+		return 0, false
+	case HalfOpen:
+		if b.halfOpenInFlight >= b.settings.HalfOpenRequests {
+			return 0, false
+		}
+		b.halfOpenInFlight++
+		return b.generation, true
+	default:
+		return b.generation, true
+	}
+}
+
+// Record reports the outcome of a call previously admitted by Allow in
+// generation. Results of calls admitted before the breaker last changed
+// state are ignored: a slow call admitted while closed must not count as a
+// half-open probe.
+func (b *Breaker) Record(generation uint64, success bool, latency time.Duration) {
+	if b.settings.LatencyThreshold > 0 && latency > b.settings.LatencyThreshold {
+		success = false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.advance(now)
+	if generation != b.generation {
+		return
+	}
+	switch b.state {
+	case HalfOpen:
+		if b.halfOpenInFlight > 0 {
+			b.halfOpenInFlight--
+		}
+		if !success {
+			b.setState(Open, now)
+			return
+		}
+		b.halfOpenSuccesses++
+		if b.halfOpenSuccesses >= b.settings.HalfOpenRequests {
+			b.setState(Closed, now)
+		}
+	case Closed:
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if b.failures > 0 && b.requests >= b.settings.MinRequests &&
+			float64(b.failures)/float64(b.requests) >= b.settings.ErrorThreshold {
+			b.setState(Open, now)
+		}
+	}
+}
+
+// advance rolls the measurement window and moves an open breaker to
+// half-open once its open duration has elapsed. Callers must hold b.mu.
+func (b *Breaker) advance(now time.Time) {
+	switch b.state {
+	case Closed:
+		if now.Sub(b.windowStart) >= b.settings.Window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+	case Open:
+		if now.Sub(b.openedAt) >= b.settings.OpenDuration {
+			b.setState(HalfOpen, now)
+		}
+	}
+}
+
+// setState switches to a new state and resets its counters. Callers must
+// hold b.mu.
+func (b *Breaker) setState(to State, now time.Time) {
+	from := b.state
+	b.state = to
+	b.generation++
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+	b.halfOpenInFlight = 0
+	b.halfOpenSuccesses = 0
+	if to == Open {
+		b.openedAt = now
+	}
+	if b.onStateChange != nil && from != to {
+		b.onStateChange(b.name, from, to)
+	}
+}
+
+// Set holds one breaker per shard, created lazily on first use.
+type Set struct {
+	settings      Settings
+	onStateChange StateChangeFunc
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+func NewSet(settings Settings, onStateChange StateChangeFunc) *Set {
+	return &Set{
+		settings:      settings,
+		onStateChange: onStateChange,
+		breakers:      make(map[string]*Breaker),
+	}
+}
+
+func (s *Set) Get(name string) *Breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.breakers[name]
+	if !ok {
+		b = New(name, s.settings, s.onStateChange)
+		s.breakers[name] = b
+	}
+	return b
+}
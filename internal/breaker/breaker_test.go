@@ -0,0 +1,203 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+var testSettings = Settings{
+	Window:           10 * time.Second,
+	MinRequests:      4,
+	ErrorThreshold:   0.5,
+	LatencyThreshold: time.Second,
+	OpenDuration:     30 * time.Second,
+	HalfOpenRequests: 2,
+}
+
+type transition struct {
+	from, to State
+}
+
+func newTestBreaker() (*Breaker, *fakeClock, *[]transition) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	var transitions []transition
+	b := New("shard1", testSettings, func(_ string, from, to State) {
+		transitions = append(transitions, transition{from, to})
+	})
+	b.now = clock.now
+	b.windowStart = clock.now()
+	return b, clock, &transitions
+}
+
+// call runs one call through b with the given outcome, and reports whether
+// it was allowed.
+func call(b *Breaker, success bool, latency time.Duration) bool {
+	generation, ok := b.Allow()
+	if ok {
+		b.Record(generation, success, latency)
+	}
+	return ok
+}
+
+// trip opens b with failures.
+func trip(t *testing.T, b *Breaker) {
+	t.Helper()
+	for range testSettings.MinRequests {
+		call(b, false, 0)
+	}
+	if b.State() != Open {
+		t.Fatalf("breaker is %s after %d failures, want open", b.State(), testSettings.MinRequests)
+	}
+}
+
+func TestTrip(t *testing.T) {
+	b, _, transitions := newTestBreaker()
+
+	// Below MinRequests, even all failures do not trip
+	for range testSettings.MinRequests - 1 {
+		call(b, false, 0)
+	}
+	if b.State() != Closed {
+		t.Fatalf("breaker is %s below min_requests, want closed", b.State())
+	}
+	call(b, true, 0)
+	if b.State() != Open {
+		t.Fatalf("breaker is %s at a 75%% error ratio, want open", b.State())
+	}
+	if call(b, true, 0) {
+		t.Fatal("open breaker allowed a call")
+	}
+	if want := []transition{{Closed, Open}}; len(*transitions) != 1 || (*transitions)[0] != want[0] {
+		t.Fatalf("transitions %v, want %v", *transitions, want)
+	}
+}
+
+func TestSlowCallsFail(t *testing.T) {
+	b, _, _ := newTestBreaker()
+	for range testSettings.MinRequests {
+		call(b, true, 2*testSettings.LatencyThreshold)
+	}
+	if b.State() != Open {
+		t.Fatalf("breaker is %s after slow calls, want open", b.State())
+	}
+}
+
+func TestWindowResets(t *testing.T) {
+	b, clock, _ := newTestBreaker()
+	call(b, false, 0)
+	call(b, false, 0)
+	call(b, false, 0)
+	clock.advance(testSettings.Window)
+	// The failures of the last window no longer count
+	call(b, false, 0)
+	call(b, true, 0)
+	call(b, true, 0)
+	call(b, true, 0)
+	if b.State() != Closed {
+		t.Fatalf("breaker is %s at a 25%% error ratio in the new window, want closed", b.State())
+	}
+}
+
+func TestHalfOpenCloses(t *testing.T) {
+	b, clock, transitions := newTestBreaker()
+	trip(t, b)
+
+	clock.advance(testSettings.OpenDuration - time.Millisecond)
+	if call(b, true, 0) {
+		t.Fatal("call allowed before the open duration passed")
+	}
+	clock.advance(time.Millisecond)
+	if b.State() != HalfOpen {
+		t.Fatalf("breaker is %s after the open duration, want half-open", b.State())
+	}
+
+	// Only HalfOpenRequests probes are let through at a time
+	g1, ok1 := b.Allow()
+	g2, ok2 := b.Allow()
+	if _, ok := b.Allow(); !ok1 || !ok2 || ok {
+		t.Fatalf("probes allowed %v, %v, then %v; want two", ok1, ok2, ok)
+	}
+	b.Record(g1, true, 0)
+	if b.State() != HalfOpen {
+		t.Fatalf("breaker is %s after one of two probes succeeded, want half-open", b.State())
+	}
+	b.Record(g2, true, 0)
+	if b.State() != Closed {
+		t.Fatalf("breaker is %s after both probes succeeded, want closed", b.State())
+	}
+
+	want := []transition{{Closed, Open}, {Open, HalfOpen}, {HalfOpen, Closed}}
+	if len(*transitions) != len(want) {
+		t.Fatalf("transitions %v, want %v", *transitions, want)
+	}
+	for i := range want {
+		if (*transitions)[i] != want[i] {
+			t.Fatalf("transitions %v, want %v", *transitions, want)
+		}
+	}
+}
+
+func TestHalfOpenFailureReopens(t *testing.T) {
+	b, clock, _ := newTestBreaker()
+	trip(t, b)
+	clock.advance(testSettings.OpenDuration)
+
+	if !call(b, false, 0) {
+		t.Fatal("probe not allowed after the open duration")
+	}
+	if b.State() != Open {
+		t.Fatalf("breaker is %s after a failed probe, want open", b.State())
+	}
+	// The open duration starts again from the failed probe
+	clock.advance(testSettings.OpenDuration - time.Millisecond)
+	if call(b, true, 0) {
+		t.Fatal("call allowed before the renewed open duration passed")
+	}
+}
+
+// TestStaleGeneration checks that results of calls admitted before a state
+// change do not count against the new state.
+func TestStaleGeneration(t *testing.T) {
+	b, clock, _ := newTestBreaker()
+
+	// A slow call admitted while closed completes after the breaker has
+	// tripped and half-opened; it must not count as a failed probe
+	slow, _ := b.Allow()
+	trip(t, b)
+	clock.advance(testSettings.OpenDuration)
+	probe, ok := b.Allow()
+	if !ok {
+		t.Fatal("probe not allowed")
+	}
+	b.Record(slow, false, 0)
+	if b.State() != HalfOpen {
+		t.Fatalf("breaker is %s after a stale failure, want half-open", b.State())
+	}
+
+	// Nor, once closed again, may it count as a success of the new state
+	b.Record(probe, true, 0)
+	next, _ := b.Allow()
+	b.Record(next, true, 0)
+	if b.State() != Closed {
+		t.Fatalf("breaker is %s after two successful probes, want closed", b.State())
+	}
+	stale, _ := b.Allow()
+	trip(t, b)
+	b.Record(stale, true, 0)
+	if b.State() != Open {
+		t.Fatalf("breaker is %s after a stale success, want open", b.State())
+	}
+}
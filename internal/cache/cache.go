@@ -0,0 +1,257 @@
+// Package cache implements the proxy's read caches: Cache, a size-bounded
+// LRU of whole objects with a memory tier and an optional local-disk tier,
+// and TTL, an expiring LRU for object metadata. Entries evicted from
+// Cache's memory tier are demoted to disk; disk hits are promoted back to
+// memory.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Tier names reported by Get and passed to the eviction callback.
+const (
+	TierMemory = "memory"
+	TierDisk   = "disk"
+)
+
+// Entry is a cached object. Entries are immutable once stored.
+type Entry struct {
+	Data         []byte
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+	// Validated is when the entry was last known to match the backend.
+	Validated time.Time
+	// MemoryOnly keeps the entry out of the disk tier, for objects that
+	// must not be written to local disk in the clear.
+	MemoryOnly bool
+}
+
+// Options configures a Cache.
+type Options struct {
+	MaxMemoryBytes int64
+	// Dir enables the disk tier when set. The tier keeps its files in a
+	// subdirectory of Dir; entries left there by a previous process are
+	// discarded.
+	Dir          string
+	MaxDiskBytes int64
+	// OnEvict, if set, is called whenever an entry is dropped from a tier
+	// to make room.
+	OnEvict func(tier string)
+}
+
+// Cache is safe for concurrent use.
+type Cache struct {
+	mu sync.Mutex
+	// removed records recent invalidations. Put discards entries read
+	// before their key was last invalidated, so a slow fill cannot
+	// resurrect a stale object.
+	removed *tombstones
+	mem     *lru
+	disk    *diskTier
+	onEvict func(tier string)
+}
+
+// New creates a cache with the given options.
+func New(opts Options) (*Cache, error) {
+	c := &Cache{
+		removed: newTombstones(),
+		mem:     newLRU(opts.MaxMemoryBytes),
+		onEvict: opts.OnEvict,
+	}
+	if opts.Dir != "" {
+		disk, err := newDiskTier(opts.Dir, opts.MaxDiskBytes)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = disk
+	}
+	return c, nil
+}
+
+// Generation returns the current invalidation generation, to be passed to
+// Put by callers about to read an object to fill the cache with.
+func (c *Cache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removed.generation()
+}
+
+// Get returns the entry for key and the tier it was found in.
+func (c *Cache) Get(key string) (*Entry, string, bool) {
+	c.mu.Lock()
+	if it, ok := c.mem.get(key); ok {
+		c.mu.Unlock()
+		return it.entry, TierMemory, true
+	}
+	if c.disk == nil {
+		c.mu.Unlock()
+		return nil, "", false
+	}
+	_, ok := c.disk.index.get(key)
+	gen := c.removed.generation()
+	c.mu.Unlock()
+	if !ok {
+		return nil, "", false
+	}
+
+	entry, err := c.disk.read(key)
+	if err != nil {
+		c.mu.Lock()
+		c.disk.index.remove(key)
+		c.mu.Unlock()
+		c.disk.delete(key)
+		return nil, "", false
+	}
+	c.Put(key, entry, gen)
+	return entry, TierDisk, true
+}
+
+// Put stores entry under key unless key was invalidated since gen was
+// obtained from Generation, or the entry is too large to cache.
+func (c *Cache) Put(key string, entry *Entry, gen uint64) {
+	size := entrySize(key, entry)
+
+	c.mu.Lock()
+	if c.removed.stale(key, gen) || size > c.mem.maxBytes {
+		c.mu.Unlock()
+		return
+	}
+	onDisk := c.disk != nil && c.disk.index.remove(key) != nil
+	evicted := c.mem.add(&item{key: key, entry: entry, size: size})
+	evictedGen := c.removed.generation()
+	c.mu.Unlock()
+
+	if onDisk {
+		c.disk.delete(key)
+	}
+	c.demote(evicted, evictedGen)
+}
+
+// Touch records that the entry for key was just validated against the
+// backend.
+func (c *Cache) Touch(key string, validated time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if it, ok := c.mem.items[key]; ok {
+		item := it.Value.(*item)
+		entry := *item.entry
+		entry.Validated = validated
+		item.entry = &entry
+	}
+}
+
+// Remove invalidates key in every tier.
+func (c *Cache) Remove(key string) {
+	c.mu.Lock()
+	c.removed.remove(key)
+	c.mem.remove(key)
+	onDisk := c.disk != nil && c.disk.index.remove(key) != nil
+	c.mu.Unlock()
+
+	if onDisk {
+		c.disk.delete(key)
+	}
+}
+
+// demote moves entries evicted from memory at generation gen to the disk
+// tier, if enabled.
+func (c *Cache) demote(items []*item, gen uint64) {
+	for _, it := range items {
+		c.evicted(TierMemory)
+		if c.disk == nil || it.entry.MemoryOnly || it.size > c.disk.index.maxBytes {
+			continue
+		}
+		if err := c.disk.write(it.key, it.entry); err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		if c.removed.stale(it.key, gen) {
+			// The key was invalidated while it was written
+			c.mu.Unlock()
+			c.disk.delete(it.key)
+			continue
+		}
+		dropped := c.disk.index.add(&item{key: it.key, size: it.size})
+		c.mu.Unlock()
+
+		for _, d := range dropped {
+			c.disk.delete(d.key)
+			c.evicted(TierDisk)
+		}
+	}
+}
+
+func (c *Cache) evicted(tier string) {
+	if c.onEvict != nil {
+		c.onEvict(tier)
+	}
+}
+
+// entrySize approximates the memory used by an entry.
+func entrySize(key string, entry *Entry) int64 {
+	return int64(len(key) + len(entry.Data) + len(entry.ETag) + len(entry.ContentType))
+}
+
+type item struct {
+	key string
+	// entry is nil in the disk tier's index.
+	entry *Entry
+	size  int64
+}
+
+// lru is a size-bounded least recently used index. It is not safe for
+// concurrent use.
+type lru struct {
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{maxBytes: maxBytes, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) get(key string) (*item, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*item), true
+}
+
+// add inserts it, replacing any item with the same key, and returns the
+// items evicted to make room.
+func (l *lru) add(it *item) []*item {
+	l.remove(it.key)
+	l.items[it.key] = l.ll.PushFront(it)
+	l.size += it.size
+
+	var evicted []*item
+	for l.size > l.maxBytes {
+		oldest := l.ll.Back()
+		if oldest == nil || oldest.Value.(*item) == it {
+			break
+		}
+		evicted = append(evicted, l.remove(oldest.Value.(*item).key))
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) *item {
+	el, ok := l.items[key]
+	if !ok {
+		return nil
+	}
+	it := el.Value.(*item)
+	l.ll.Remove(el)
+	delete(l.items, key)
+	l.size -= it.size
+	return it
+}
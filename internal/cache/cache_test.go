@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, dir string, maxMemoryBytes int64) *Cache {
+	t.Helper()
+	c, err := New(Options{MaxMemoryBytes: maxMemoryBytes, Dir: dir, MaxDiskBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPutAfterRemove(t *testing.T) {
+	c := newTestCache(t, "", 1<<20)
+
+	gen := c.Generation()
+	c.Remove("other")
+	c.Put("a", &Entry{Data: []byte("a")}, gen)
+	if _, _, ok := c.Get("a"); !ok {
+		t.Fatal("fill discarded by the removal of another key")
+	}
+
+	gen = c.Generation()
+	c.Remove("b")
+	c.Put("b", &Entry{Data: []byte("b")}, gen)
+	if _, _, ok := c.Get("b"); ok {
+		t.Fatal("fill that read b before it was removed was stored")
+	}
+}
+
+func TestDemote(t *testing.T) {
+	c := newTestCache(t, t.TempDir(), 8)
+
+	c.Put("a", &Entry{Data: []byte("aaaa")}, c.Generation())
+	c.Put("b", &Entry{Data: []byte("bbbb"), MemoryOnly: true}, c.Generation())
+	c.Put("c", &Entry{Data: []byte("cccc")}, c.Generation())
+	if _, tier, ok := c.Get("a"); !ok || tier != TierDisk {
+		t.Fatalf("evicted entry found %v in tier %q, want the disk tier", ok, tier)
+	}
+	if _, _, ok := c.Get("b"); ok {
+		t.Fatal("memory-only entry was demoted to disk")
+	}
+}
+
+func TestTombstonesExpire(t *testing.T) {
+	ts := newTombstones()
+	gen := ts.generation()
+	for i := 0; i < maxTombstones+1; i++ {
+		ts.remove("k")
+	}
+	if len(ts.queue) > maxTombstones {
+		t.Fatalf("%d tombstones kept, want at most %d", len(ts.queue), maxTombstones)
+	}
+	if !ts.stale("other", gen) {
+		t.Fatal("fill older than a dropped tombstone was not discarded")
+	}
+	if ts.stale("other", ts.generation()) {
+		t.Fatal("fill started after every removal was discarded")
+	}
+}
+
+func TestTTLPutAfterRemove(t *testing.T) {
+	c := NewTTL[string](10, time.Minute, time.Minute)
+
+	gen := c.Generation()
+	c.Remove("other")
+	c.Put("a", "a", gen)
+	if _, _, ok := c.Get("a"); !ok {
+		t.Fatal("fill discarded by the removal of another key")
+	}
+
+	gen = c.Generation()
+	c.Remove("b")
+	c.PutMissing("b", gen)
+	if _, _, ok := c.Get("b"); ok {
+		t.Fatal("fill that looked up b before it was removed was stored")
+	}
+
+	gen = c.Generation()
+	c.Clear()
+	c.Put("c", "c", gen)
+	if _, _, ok := c.Get("c"); ok {
+		t.Fatal("fill started before Clear was stored")
+	}
+}
+
+func TestDiskTierKeepsForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	foreign := []string{"notes.entry", "upload.tmp", "data.bin"}
+	for _, name := range foreign {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("keep"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newTestCache(t, dir, 8)
+	c.Put("a", &Entry{Data: []byte("aaaa")}, c.Generation())
+	c.Put("b", &Entry{Data: []byte("bbbb")}, c.Generation())
+	c.Put("c", &Entry{Data: []byte("cccc")}, c.Generation())
+	if _, tier, ok := c.Get("a"); !ok || tier != TierDisk {
+		t.Fatalf("evicted entry found %v in tier %q, want the disk tier", ok, tier)
+	}
+
+	// A restart clears the tier's own files only
+	newTestCache(t, dir, 8)
+	for _, name := range foreign {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("file in the cache directory not owned by the tier: %v", err)
+		}
+	}
+	entries, err := filepath.Glob(filepath.Join(dir, tierDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("%d stale entries left after a restart", len(entries))
+	}
+}
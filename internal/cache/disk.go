@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// tierDir is the subdirectory of the configured directory that the
+	// disk tier owns. Only files in it are ever removed, so pointing the
+	// cache at a shared directory cannot delete other files.
+	tierDir     = "tempo-s3-shard-cache"
+	entrySuffix = ".entry"
+	tempPattern = "*.tmp"
+)
+
+// diskTier stores one file per entry, named by the hash of its key. The
+// index lives in memory, so files from an earlier process are removed on
+// startup rather than trusted.
+type diskTier struct {
+	dir   string
+	index *lru
+}
+
+// diskRecord is the on-disk form of an entry. The key is kept to detect
+// hash collisions.
+type diskRecord struct {
+	Key   string
+	Entry *Entry
+}
+
+func newDiskTier(dir string, maxBytes int64) (*diskTier, error) {
+	dir = filepath.Join(dir, tierDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+	for _, pattern := range []string{"*" + entrySuffix, tempPattern} {
+		stale, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range stale {
+			os.Remove(path)
+		}
+	}
+	return &diskTier{dir: dir, index: newLRU(maxBytes)}, nil
+}
+
+func (d *diskTier) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+entrySuffix)
+}
+
+// write stores entry atomically so a concurrent read never sees a partial
+// file.
+func (d *diskTier) write(key string, entry *Entry) error {
+	f, err := os.CreateTemp(d.dir, tempPattern)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(diskRecord{Key: key, Entry: entry}); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), d.path(key)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (d *diskTier) read(key string) (*Entry, error) {
+	f, err := os.Open(d.path(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var record diskRecord
+	if err := gob.NewDecoder(f).Decode(&record); err != nil {
+		return nil, err
+	}
+	if record.Key != key || record.Entry == nil {
+		return nil, fmt.Errorf("cache file for %q holds %q", key, record.Key)
+	}
+	return record.Entry, nil
+}
+
+func (d *diskTier) delete(key string) {
+	os.Remove(d.path(key))
+}
@@ -0,0 +1,72 @@
+package cache
+
+import "time"
+
+// Tombstones are kept for tombstoneTTL, and at most maxTombstones of them.
+// A fill that started before a dropped tombstone is discarded whatever its
+// key, so these only need to outlast most fills.
+const (
+	tombstoneTTL  = time.Minute
+	maxTombstones = 1 << 16
+)
+
+// tombstones records the keys invalidated recently, so that a fill that
+// read a key before it was invalidated can be discarded without also
+// discarding fills of other keys. It is not safe for concurrent use.
+type tombstones struct {
+	// seq is bumped by every removal. Fills take it as their generation.
+	seq uint64
+	// floor is the newest seq whose tombstone has been dropped; fills with
+	// an older generation can no longer be checked and are discarded.
+	floor uint64
+	keys  map[string]uint64
+	queue []tombstone
+}
+
+type tombstone struct {
+	key string
+	seq uint64
+	at  time.Time
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{keys: make(map[string]uint64)}
+}
+
+// generation returns the generation to record at the start of a fill.
+func (t *tombstones) generation() uint64 {
+	return t.seq
+}
+
+// remove records that key was invalidated.
+func (t *tombstones) remove(key string) {
+	now := time.Now()
+	t.seq++
+	t.keys[key] = t.seq
+	t.queue = append(t.queue, tombstone{key: key, seq: t.seq, at: now})
+
+	n := 0
+	for n < len(t.queue) && (now.Sub(t.queue[n].at) > tombstoneTTL || len(t.queue)-n > maxTombstones) {
+		old := t.queue[n]
+		if t.keys[old.key] == old.seq {
+			delete(t.keys, old.key)
+		}
+		t.floor = old.seq
+		n++
+	}
+	t.queue = t.queue[n:]
+}
+
+// clear records that every key was invalidated.
+func (t *tombstones) clear() {
+	t.seq++
+	t.floor = t.seq
+	clear(t.keys)
+	t.queue = nil
+}
+
+// stale reports whether key was invalidated after a fill that started at
+// gen.
+func (t *tombstones) stale(key string, gen uint64) bool {
+	return gen < t.floor || t.keys[key] > gen
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// TTL is an LRU cache bounded by entry count whose entries expire after a
+// fixed time. It can also remember, for a shorter time, that a key does
+// not exist. It is safe for concurrent use.
+type TTL[V any] struct {
+	mu sync.Mutex
+	// removed records recent invalidations; see Cache.
+	removed     *tombstones
+	maxEntries  int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	ll          *list.List
+	items       map[string]*list.Element
+}
+
+type ttlItem[V any] struct {
+	key     string
+	value   V
+	missing bool
+	expires time.Time
+}
+
+// NewTTL creates a cache holding up to maxEntries entries. Values expire
+// after ttl and missing keys after negativeTTL; a negativeTTL of zero
+// disables negative caching.
+func NewTTL[V any](maxEntries int, ttl, negativeTTL time.Duration) *TTL[V] {
+	return &TTL[V]{
+		removed:     newTombstones(),
+		maxEntries:  maxEntries,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached value for key. If ok is true and missing is true,
+// the key is known not to exist.
+func (c *TTL[V]) Get(key string) (value V, missing, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.items[key]
+	if !found {
+		return value, false, false
+	}
+	it := el.Value.(*ttlItem[V])
+	if time.Now().After(it.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return value, false, false
+	}
+	c.ll.MoveToFront(el)
+	return it.value, it.missing, true
+}
+
+// Generation returns the current invalidation generation, to be passed to
+// Put and PutMissing by callers about to look up a value to fill the cache
+// with.
+func (c *TTL[V]) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removed.generation()
+}
+
+// Put caches value for key unless key was invalidated since gen was
+// obtained.
+func (c *TTL[V]) Put(key string, value V, gen uint64) {
+	c.add(&ttlItem[V]{key: key, value: value, expires: time.Now().Add(c.ttl)}, gen)
+}
+
+// PutMissing records that key does not exist.
+func (c *TTL[V]) PutMissing(key string, gen uint64) {
+	if c.negativeTTL <= 0 {
+		return
+	}
+	c.add(&ttlItem[V]{key: key, missing: true, expires: time.Now().Add(c.negativeTTL)}, gen)
+}
+
+func (c *TTL[V]) add(it *ttlItem[V], gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.removed.stale(it.key, gen) {
+		return
+	}
+	if el, found := c.items[it.key]; found {
+		c.ll.Remove(el)
+	}
+	c.items[it.key] = c.ll.PushFront(it)
+	for c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*ttlItem[V]).key)
+	}
+}
+
+// Remove invalidates key.
+func (c *TTL[V]) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removed.remove(key)
+	if el, found := c.items[key]; found {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// Clear invalidates every key.
+func (c *TTL[V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removed.clear()
+	c.ll.Init()
+	clear(c.items)
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// newCredentials returns the backend credentials selected by
+// cfg.Credentials. Config validation guarantees the provider is known. STS
+// requests use transport, or the default transport if it is nil.
+func newCredentials(cfg *config.Config, transport http.RoundTripper) *credentials.Credentials {
+	cc := cfg.Credentials
+	var stsClient *http.Client
+	if transport != nil {
+		stsClient = &http.Client{Transport: transport}
+	}
+	var provider credentials.Provider
+	refresh := time.Duration(0)
+
+	switch cc.Provider {
+	case config.CredentialsStatic:
+		return credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+	case config.CredentialsEnv:
+		provider = &credentials.Chain{Providers: []credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+		}}
+		refresh = cc.RefreshInterval.Std()
+	case config.CredentialsAWSFile:
+		provider = &credentials.FileAWSCredentials{Filename: cc.File, Profile: cc.Profile}
+		refresh = cc.RefreshInterval.Std()
+	case config.CredentialsMinioFile:
+		provider = &credentials.FileMinioClient{Filename: cc.File, Alias: cc.Profile}
+		refresh = cc.RefreshInterval.Std()
+	case config.CredentialsIAM:
+		// Covers EC2 instance profiles, ECS task roles and, through
+		// AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN, EKS IRSA
+		provider = &credentials.IAM{}
+	case config.CredentialsWebIdentity:
+		provider = &credentials.STSWebIdentity{
+			Client:      stsClient,
+			STSEndpoint: cc.STSEndpoint,
+			RoleARN:     cc.RoleARN,
+			GetWebIDTokenExpiry: func() (*credentials.WebIdentityToken, error) {
+				token, err := os.ReadFile(cc.WebIdentityTokenFile)
+				if err != nil {
+					return nil, err
+				}
+				return &credentials.WebIdentityToken{
+					Token:  strings.TrimSpace(string(token)),
+					Expiry: int(cc.Duration.Std().Seconds()),
+				}, nil
+			},
+		}
+	case config.CredentialsAssumeRole:
+		provider = &credentials.STSAssumeRole{
+			Client:      stsClient,
+			STSEndpoint: cc.STSEndpoint,
+			Options: credentials.STSAssumeRoleOptions{
+				AccessKey:       cfg.AccessKeyID,
+				SecretKey:       cfg.SecretAccessKey,
+				Location:        cfg.Region,
+				DurationSeconds: int(cc.Duration.Std().Seconds()),
+				RoleARN:         cc.RoleARN,
+				RoleSessionName: cc.RoleSessionName,
+				ExternalID:      cc.ExternalID,
+			},
+		}
+	}
+	return credentials.New(&observedProvider{Provider: provider, name: cc.Provider, refresh: refresh})
+}
+
+// observedProvider counts the credential retrievals of a provider and,
+// if refresh is set, retrieves again at least that often so that rotated
+// credentials are picked up by providers that never expire.
+// credentials.Credentials serializes calls to it.
+type observedProvider struct {
+	credentials.Provider
+	name    string
+	refresh time.Duration
+	expires time.Time
+}
+
+func (p *observedProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithCredContext(nil)
+}
+
+func (p *observedProvider) RetrieveWithCredContext(cc *credentials.CredContext) (credentials.Value, error) {
+	value, err := p.Provider.RetrieveWithCredContext(cc)
+	if err != nil {
+		metrics.CredentialRetrievalsTotal.WithLabelValues(p.name, "failure").Inc()
+		return value, err
+	}
+	metrics.CredentialRetrievalsTotal.WithLabelValues(p.name, "success").Inc()
+	if !value.Expiration.IsZero() {
+		metrics.CredentialExpiry.WithLabelValues(p.name).Set(float64(value.Expiration.Unix()))
+	}
+	p.expires = time.Now().Add(p.refresh)
+	return value, nil
+}
+
+func (p *observedProvider) IsExpired() bool {
+	return p.Provider.IsExpired() || (p.refresh > 0 && time.Now().After(p.expires))
+}
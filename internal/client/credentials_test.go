@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"tempo-s3-shard/internal/config"
+)
+
+// stsLifetime is the lifetime of the credentials the fake STS issues. The
+// client renews them once 80% of it has passed.
+const stsLifetime = 500 * time.Millisecond
+
+// fakeSTS issues credentials with a new access key on every call, for
+// both AssumeRole and AssumeRoleWithWebIdentity.
+type fakeSTS struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.Form.Get("Action")
+	if action != "AssumeRole" && action != "AssumeRoleWithWebIdentity" {
+		http.Error(w, "unexpected action "+action, http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.calls++
+	key := fmt.Sprintf("AKIA%d", f.calls)
+	f.mu.Unlock()
+
+	expiration := time.Now().Add(stsLifetime).UTC().Format(time.RFC3339Nano)
+	fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><%[1]sResult><Credentials>`+
+		`<AccessKeyId>%[2]s</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken>`+
+		`<Expiration>%[3]s</Expiration></Credentials></%[1]sResult></%[1]sResponse>`, action, key, expiration)
+}
+
+// signingKeys records the access key each backend request was signed with.
+type signingKeys struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+var credentialPattern = regexp.MustCompile(`Credential=([^/]+)/`)
+
+func (s *signingKeys) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := credentialPattern.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+		s.keys = append(s.keys, m[1])
+	}
+}
+
+func TestTemporaryCredentialsRotate(t *testing.T) {
+	for _, provider := range []string{config.CredentialsAssumeRole, config.CredentialsWebIdentity} {
+		t.Run(provider, func(t *testing.T) {
+			sts := &fakeSTS{}
+			stsServer := httptest.NewServer(sts)
+			defer stsServer.Close()
+			backend := &signingKeys{}
+			backendServer := httptest.NewServer(backend)
+			defer backendServer.Close()
+
+			cfg := config.DefaultConfig()
+			cfg.Endpoint = backendServer.URL
+			cfg.Credentials.Provider = provider
+			cfg.Credentials.STSEndpoint = stsServer.URL
+			cfg.Credentials.RoleARN = "arn:aws:iam::123456789012:role/tempo"
+			cfg.Credentials.WebIdentityTokenFile = filepath.Join(t.TempDir(), "token")
+			if err := os.WriteFile(cfg.Credentials.WebIdentityTokenFile, []byte("jwt\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := NewS3ClientManager(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The same client is used throughout; only its credentials
+			// are renewed
+			client := m.GetClient()
+			for range 3 {
+				if _, err := client.BucketExists(context.Background(), "shard1"); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(stsLifetime)
+			}
+
+			want := []string{"AKIA1", "AKIA2", "AKIA3"}
+			if fmt.Sprint(backend.keys) != fmt.Sprint(want) {
+				t.Fatalf("requests signed with %v, want %v", backend.keys, want)
+			}
+			if sts.calls != len(want) {
+				t.Fatalf("%d STS calls, want %d", sts.calls, len(want))
+			}
+		})
+	}
+}
@@ -3,17 +3,24 @@ package client
 import (
 	"context"
 	"fmt"
+	"net/http"
 
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"tempo-s3-shard/internal/config"
 	"tempo-s3-shard/internal/hash"
 )
 
+// S3ClientManager routes keys to buckets and holds the clients for the
+// backend. It is immutable: a reload builds a new one, which the server
+// publishes together with the rest of its reloadable state.
 type S3ClientManager struct {
-	client *minio.Client
-	hasher *hash.ConsistentHash
-	config *config.Config
+	client           *minio.Client
+	idempotentClient *minio.Client
+	hasher           *hash.ConsistentHash
+	config           *config.Config
+	// transport is shared by both clients, so that a reload can close the
+	// connections of the clients it replaces.
+	transport http.RoundTripper
 }
 
 func NewS3ClientManager(cfg *config.Config) (*S3ClientManager, error) {
@@ -21,29 +28,79 @@ func NewS3ClientManager(cfg *config.Config) (*S3ClientManager, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse endpoint: %w", err)
 	}
-	
+
+	tlsTransport, err := NewTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport := tlsTransport
+	if transport == nil {
+		if transport, err = minio.DefaultTransport(useSSL); err != nil {
+			return nil, err
+		}
+	}
+
+	// Both clients share the credentials, so temporary credentials are
+	// fetched once for both
+	creds := newCredentials(cfg, tlsTransport)
 	client, err := minio.New(host, &minio.Options{
-		Creds:  credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
-		Secure: useSSL,
-		Region: cfg.Region,
+		Creds:     creds,
+		Secure:    useSSL,
+		Region:    cfg.Region,
+		Transport: transport,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create minio client: %w", err)
 	}
 
+	// Idempotent reads are retried by the server's own retry policy, so the
+	// client used for them must not retry internally as well
+	idempotentClient, err := minio.New(host, &minio.Options{
+		Creds:      creds,
+		Secure:     useSSL,
+		Region:     cfg.Region,
+		Transport:  transport,
+		MaxRetries: 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create minio idempotent client: %w", err)
+	}
+
 	hasher := hash.NewConsistentHash(100, cfg.Buckets)
 
 	return &S3ClientManager{
-		client: client,
-		hasher: hasher,
-		config: cfg,
+		client:           client,
+		idempotentClient: idempotentClient,
+		hasher:           hasher,
+		config:           cfg,
+		transport:        transport,
 	}, nil
 }
 
+// CloseIdleConnections closes the clients' idle connections to the backend.
+// Requests in progress are not affected.
+func (s *S3ClientManager) CloseIdleConnections() {
+	if tr, ok := s.transport.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
 func (s *S3ClientManager) GetBucketForKey(key string) string {
 	return s.hasher.GetBucket(key)
 }
 
+// GetReplicaBucketsForKey returns the buckets holding key's replicas, the
+// primary first, according to the configured replication factor.
+func (s *S3ClientManager) GetReplicaBucketsForKey(key string) []string {
+	return s.hasher.GetBuckets(key, s.config.Replication.Factor)
+}
+
+// GetBucketsForKey returns up to n distinct buckets for key, walking
+// clockwise around the ring from its owner.
+func (s *S3ClientManager) GetBucketsForKey(key string, n int) []string {
+	return s.hasher.GetBuckets(key, n)
+}
+
 func (s *S3ClientManager) GetAllBuckets() []string {
 	return s.hasher.GetAllBuckets()
 }
@@ -52,6 +109,12 @@ func (s *S3ClientManager) GetClient() *minio.Client {
 	return s.client
 }
 
+// GetIdempotentClient returns a client with minio's internal retries disabled,
+// for operations retried by the caller.
+func (s *S3ClientManager) GetIdempotentClient() *minio.Client {
+	return s.idempotentClient
+}
+
 func (s *S3ClientManager) EnsureBucketsExist(ctx context.Context) error {
 	for _, bucketName := range s.config.Buckets {
 		exists, err := s.client.BucketExists(ctx, bucketName)
@@ -68,4 +131,4 @@ func (s *S3ClientManager) EnsureBucketsExist(ctx context.Context) error {
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
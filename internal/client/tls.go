@@ -0,0 +1,61 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/config"
+)
+
+// NewTransport returns the HTTP transport for the backend and its STS
+// endpoint, or nil for minio's default when backend_tls is not configured.
+func NewTransport(cfg *config.Config) (http.RoundTripper, error) {
+	b := cfg.BackendTLS
+	if b == (config.BackendTLSConfig{}) {
+		return nil, nil
+	}
+	tr, err := minio.DefaultTransport(true)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := tr.TLSClientConfig
+	tlsConfig.ServerName = b.ServerName
+	tlsConfig.InsecureSkipVerify = b.InsecureSkipVerify
+
+	if b.CAFile != "" {
+		pool := tlsConfig.RootCAs
+		if pool == nil {
+			if pool, err = x509.SystemCertPool(); err != nil {
+				pool = x509.NewCertPool()
+			}
+		}
+		if err := appendCAFile(pool, b.CAFile); err != nil {
+			return nil, fmt.Errorf("backend_tls.ca_file: %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if b.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(b.CertFile, b.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("backend_tls: loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tr, nil
+}
+
+func appendCAFile(pool *x509.CertPool, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return errors.New("no PEM certificates found")
+	}
+	return nil
+}
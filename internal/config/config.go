@@ -1,41 +1,958 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/url"
-	"os"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	ListenAddr      string   `json:"listen_addr"`
-	Endpoint        string   `json:"endpoint"`
-	AccessKeyID     string   `json:"access_key_id"`
-	SecretAccessKey string   `json:"secret_access_key"`
-	UseSSL          bool     `json:"use_ssl"`
-	Region          string   `json:"region"`
-	Buckets         []string `json:"buckets"`
-	LogLevel        string   `json:"log_level,omitempty"`
-}
-
-func LoadConfig(filename string) (*Config, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
+	ListenAddr      string               `json:"listen_addr"`
+	Endpoint        string               `json:"endpoint"`
+	AccessKeyID     string               `json:"access_key_id"`
+	SecretAccessKey string               `json:"secret_access_key"`
+	UseSSL          bool                 `json:"use_ssl"`
+	Region          string               `json:"region"`
+	Buckets         []string             `json:"buckets"`
+	LogLevel        string               `json:"log_level,omitempty"`
+	CircuitBreaker  CircuitBreakerConfig `json:"circuit_breaker"`
+	List            ListConfig           `json:"list"`
+	Timeouts        TimeoutConfig        `json:"timeouts"`
+	Retry           RetryConfig          `json:"retry"`
+	Hedge           HedgeConfig          `json:"hedge"`
+	Replication     ReplicationConfig    `json:"replication"`
+	Erasure         ErasureConfig        `json:"erasure"`
+	Cache           CacheConfig          `json:"cache"`
+	StatCache       StatCacheConfig      `json:"stat_cache"`
+	ListCache       ListCacheConfig      `json:"list_cache"`
+	SingleFlight    SingleFlightConfig   `json:"single_flight"`
+	Compression     CompressionConfig    `json:"compression"`
+	Encryption      EncryptionConfig     `json:"encryption"`
+	Reload          ReloadConfig         `json:"reload"`
+	// AccessKeyIDFile and SecretAccessKeyFile name files, such as mounted
+	// Kubernetes Secrets, to read the backend credentials from instead.
+	AccessKeyIDFile     string `json:"access_key_id_file,omitempty"`
+	SecretAccessKeyFile string `json:"secret_access_key_file,omitempty"`
+	// Credentials selects where the backend credentials come from. The
+	// static provider uses AccessKeyID and SecretAccessKey.
+	Credentials CredentialsConfig `json:"credentials"`
+	// Server controls the HTTP server and its graceful shutdown.
+	Server ServerConfig `json:"server"`
+	// TLS enables HTTPS, and optionally mutual TLS, on ListenAddr.
+	TLS TLSConfig `json:"tls"`
+	// BackendTLS configures the TLS connections to the backend endpoint.
+	BackendTLS BackendTLSConfig `json:"backend_tls"`
+	// Authorization restricts what each client may do.
+	Authorization AuthorizationConfig `json:"authorization"`
+	// RateLimit throttles requests per tenant and operation.
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	// Admission bounds the calls in flight to the backend, globally and per
+	// shard, queueing calls beyond the limits.
+	Admission AdmissionConfig `json:"admission"`
+	// Usage accounts the storage used per tenant and shard, and enforces
+	// quotas.
+	Usage UsageConfig `json:"usage"`
+	// Lifecycle expires objects and incomplete uploads by tenant and key
+	// prefix.
+	Lifecycle LifecycleConfig `json:"lifecycle"`
+}
+
+// CircuitBreakerConfig controls the per-shard circuit breakers that fail
+// requests fast while a backend bucket is erroring or responding slowly.
+type CircuitBreakerConfig struct {
+	Enabled bool `json:"enabled"`
+	// Window is the interval over which error rates are measured.
+	Window Duration `json:"window,omitempty"`
+	// MinRequests is the number of calls required in a window before the
+	// breaker may trip.
+	MinRequests int `json:"min_requests,omitempty"`
+	// ErrorThreshold is the failure ratio (0-1) that trips the breaker.
+	// Zero trips it on any failure once MinRequests calls were made.
+	ErrorThreshold *float64 `json:"error_threshold,omitempty"`
+	// LatencyThreshold counts calls slower than this as failures. Zero
+	// disables latency-based tripping.
+	LatencyThreshold Duration `json:"latency_threshold,omitempty"`
+	// OpenDuration is how long the breaker stays open before half-opening.
+	OpenDuration Duration `json:"open_duration,omitempty"`
+	// HalfOpenRequests is the number of probe calls allowed while half-open;
+	// that many consecutive successes close the breaker again.
+	HalfOpenRequests int `json:"half_open_requests,omitempty"`
+}
+
+// ListConfig controls how ListObjects fans out across the shard buckets.
+type ListConfig struct {
+	// Concurrency is the maximum number of shards listed in parallel. Zero
+	// lists every shard at once.
+	Concurrency int `json:"concurrency,omitempty"`
+	// ShardTimeout bounds each page request made to a single shard. Zero
+	// disables the per-shard timeout.
+	ShardTimeout Duration `json:"shard_timeout,omitempty"`
+	// FailurePolicy decides what happens when a shard fails or times out:
+	// "fail" rejects the whole listing, "partial" returns the results of
+	// the shards that succeeded.
+	FailurePolicy string `json:"failure_policy,omitempty"`
+}
+
+const (
+	ListFailurePolicyFail    = "fail"
+	ListFailurePolicyPartial = "partial"
+)
+
+// TimeoutConfig bounds how long each kind of backend operation may take,
+// including streaming the object body, except for GET, where it bounds the
+// time to the first byte. Unset fields use the defaults; a negative value
+// disables the timeout.
+type TimeoutConfig struct {
+	Get     Duration `json:"get,omitempty"`
+	Put     Duration `json:"put,omitempty"`
+	List    Duration `json:"list,omitempty"`
+	Head    Duration `json:"head,omitempty"`
+	Delete  Duration `json:"delete,omitempty"`
+	Tagging Duration `json:"tagging,omitempty"`
+}
+
+// RetryConfig controls retries of idempotent backend operations (GET, HEAD,
+// LIST, DELETE and tag reads) that fail with a transient error.
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// InitialBackoff is the upper bound of the first jittered backoff; it
+	// doubles on each retry up to MaxBackoff.
+	InitialBackoff Duration `json:"initial_backoff,omitempty"`
+	MaxBackoff     Duration `json:"max_backoff,omitempty"`
+}
+
+// HedgeConfig controls hedged GETs for small, latency-sensitive objects. A
+// second request is sent if the first has not responded within the
+// configured latency percentile of recent hedged GETs.
+type HedgeConfig struct {
+	Enabled bool `json:"enabled"`
+	// KeyPatterns are regular expressions; only matching keys are hedged.
+	KeyPatterns []string `json:"key_patterns,omitempty"`
+	// Percentile (0-1) of observed latencies after which the hedge fires.
+	Percentile float64 `json:"percentile,omitempty"`
+	// MinDelay is the lower bound on the hedge delay.
+	MinDelay Duration `json:"min_delay,omitempty"`
+}
+
+// ReplicationConfig controls how many shards hold a copy of each object.
+// Replicas are placed on the first Factor distinct buckets found walking
+// clockwise around the hash ring from the key's owner.
+type ReplicationConfig struct {
+	Factor int `json:"factor,omitempty"`
+	// WriteQuorum is the number of replicas that must acknowledge a PUT or
+	// DELETE for it to succeed. Defaults to a majority of Factor.
+	WriteQuorum int `json:"write_quorum,omitempty"`
+	// ReadRepair copies an object to replicas found missing it on read.
+	ReadRepair bool `json:"read_repair"`
+}
+
+// ErasureConfig controls Reed-Solomon striping of large objects. Objects
+// of at least MinSize bytes are split into DataShards data pieces and
+// ParityShards parity pieces, each stored in a different bucket, and can be
+// read back from any DataShards of them.
+type ErasureConfig struct {
+	Enabled      bool `json:"enabled"`
+	DataShards   int  `json:"data_shards,omitempty"`
+	ParityShards int  `json:"parity_shards,omitempty"`
+	// MinSize is the smallest object, in bytes, that is erasure coded.
+	// Smaller objects are stored whole according to Replication.
+	MinSize int64 `json:"min_size,omitempty"`
+	// BlockSize is the number of bytes each piece contributes to a stripe.
+	BlockSize int64 `json:"block_size,omitempty"`
+}
+
+// CacheConfig controls the read-through cache of small, frequently read
+// objects.
+type CacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// KeyPatterns are regular expressions; only matching keys are cached.
+	KeyPatterns []string `json:"key_patterns,omitempty"`
+	// MaxObjectSize is the largest object, in bytes, that is cached.
+	MaxObjectSize int64 `json:"max_object_size,omitempty"`
+	// MaxMemoryBytes bounds the memory tier.
+	MaxMemoryBytes int64 `json:"max_memory_bytes,omitempty"`
+	// MaxAge is how long an entry is served without checking its ETag
+	// against the backend. A negative value revalidates every hit.
+	MaxAge Duration `json:"max_age,omitempty"`
+	// Dir enables the disk tier, holding up to MaxDiskBytes of entries
+	// evicted from memory.
+	Dir          string `json:"dir,omitempty"`
+	MaxDiskBytes int64  `json:"max_disk_bytes,omitempty"`
+}
+
+// StatCacheConfig controls the cache of object metadata used by HEAD
+// requests and cache revalidation.
+type StatCacheConfig struct {
+	Enabled    bool `json:"enabled"`
+	MaxEntries int  `json:"max_entries,omitempty"`
+	// TTL is how long metadata is served from the cache.
+	TTL Duration `json:"ttl,omitempty"`
+	// NegativeTTL is how long a missing key is remembered. Negative values
+	// disable negative caching.
+	NegativeTTL Duration `json:"negative_ttl,omitempty"`
+}
+
+// ListCacheConfig controls the cache of ListObjects results. Cached
+// listings are patched with writes made through the proxy and fully
+// refreshed in the background.
+type ListCacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// RefreshInterval is how often listings still in use are re-fetched.
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+	// MaxStaleness is the age after which a listing that could not be
+	// refreshed is no longer served.
+	MaxStaleness Duration `json:"max_staleness,omitempty"`
+	// MaxEntries is the largest listing, in keys and common prefixes,
+	// that is cached.
+	MaxEntries int `json:"max_entries,omitempty"`
+}
+
+// SingleFlightConfig controls coalescing of concurrent identical GET, HEAD
+// and LIST requests into a single backend call.
+type SingleFlightConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxObjectSize is the largest object, in bytes, whose body is shared
+	// between concurrent GETs. Larger objects are streamed to each client
+	// separately.
+	MaxObjectSize int64 `json:"max_object_size,omitempty"`
+	// MaxListEntries is the largest listing that is shared between
+	// concurrent LISTs.
+	MaxListEntries int `json:"max_list_entries,omitempty"`
+}
+
+// CompressionConfig controls transparent compression of objects at rest.
+// Objects whose key matches one of KeyPatterns, or whose content type is
+// one of ContentTypes, are compressed with Codec before being stored.
+type CompressionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Codec is "zstd" or "gzip".
+	Codec string `json:"codec,omitempty"`
+	// KeyPatterns are regular expressions selecting keys to compress.
+	KeyPatterns []string `json:"key_patterns,omitempty"`
+	// ContentTypes are media types to compress, such as "application/json"
+	// or "text/*".
+	ContentTypes []string `json:"content_types,omitempty"`
+	// MinSize and MaxSize bound the size, in bytes, of objects that are
+	// compressed.
+	MinSize int64 `json:"min_size,omitempty"`
+	MaxSize int64 `json:"max_size,omitempty"`
+	// FrameSize is the number of uncompressed bytes per independently
+	// decodable zstd frame. Ranged reads decompress whole frames.
+	FrameSize int64 `json:"frame_size,omitempty"`
+}
+
+// EncryptionConfig controls envelope encryption of objects before they are
+// stored. Each object is encrypted with its own data key, which is kept in
+// the object's metadata wrapped by one of the master keys.
+type EncryptionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Keys are the master keys. ActiveKey names the one that wraps the data
+	// keys of new objects; the others are kept so that objects written
+	// before a rotation stay readable. Defaults to the first key.
+	Keys      []MasterKeyConfig `json:"keys,omitempty"`
+	ActiveKey string            `json:"active_key,omitempty"`
+	// ChunkSize is the number of plaintext bytes per encrypted chunk.
+	// Ranged reads decrypt whole chunks.
+	ChunkSize int64 `json:"chunk_size,omitempty"`
+	// SSECPassthrough forwards SSE-C headers from clients to the backends.
+	// It works independently of Enabled.
+	SSECPassthrough bool `json:"sse_c_passthrough"`
+}
+
+// MasterKeyConfig identifies a 256-bit master key, written as 64 hex digits
+// or base64, that is read from File or from the environment variable Env.
+type MasterKeyConfig struct {
+	ID   string `json:"id"`
+	File string `json:"file,omitempty"`
+	Env  string `json:"env,omitempty"`
+}
+
+// Credential providers.
+const (
+	CredentialsStatic      = "static"
+	CredentialsEnv         = "env"
+	CredentialsAWSFile     = "aws_file"
+	CredentialsMinioFile   = "minio_file"
+	CredentialsIAM         = "iam"
+	CredentialsWebIdentity = "web_identity"
+	CredentialsAssumeRole  = "assume_role"
+)
+
+// CredentialsConfig selects the provider of the backend credentials.
+// Providers that issue temporary credentials renew them before they
+// expire; the others are re-read every RefreshInterval.
+type CredentialsConfig struct {
+	// Provider is "static", "env", "aws_file", "minio_file", "iam",
+	// "web_identity" or "assume_role".
+	Provider string `json:"provider,omitempty"`
+	// File is the AWS shared credentials file or MinIO client config file.
+	// Empty uses the provider's usual location.
+	File string `json:"file,omitempty"`
+	// Profile is the profile in the AWS shared credentials file, or the
+	// alias in the MinIO client config file.
+	Profile string `json:"profile,omitempty"`
+	// STSEndpoint is the STS service of web_identity and assume_role.
+	STSEndpoint string `json:"sts_endpoint,omitempty"`
+	// RoleARN is the role assumed by web_identity and assume_role.
+	RoleARN         string `json:"role_arn,omitempty"`
+	RoleSessionName string `json:"role_session_name,omitempty"`
+	ExternalID      string `json:"external_id,omitempty"`
+	// WebIdentityTokenFile is read for every web_identity request, so a
+	// projected service account token may be rotated in place.
+	WebIdentityTokenFile string `json:"web_identity_token_file,omitempty"`
+	// Duration is the requested lifetime of temporary credentials.
+	Duration Duration `json:"duration,omitempty"`
+	// RefreshInterval is how often env, aws_file and minio_file
+	// credentials are re-read.
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+}
+
+// ReloadConfig controls reloading of the config file while the server is
+// running. SIGHUP always triggers a reload.
+type ReloadConfig struct {
+	// WatchInterval is how often the config file is checked for changes.
+	// A negative value disables watching.
+	WatchInterval Duration `json:"watch_interval,omitempty"`
+}
+
+// ServerConfig controls the HTTP server. Unset timeouts use the defaults; a
+// negative value disables the timeout.
+type ServerConfig struct {
+	// ReadHeaderTimeout bounds reading the request headers.
+	ReadHeaderTimeout Duration `json:"read_header_timeout,omitempty"`
+	// ReadTimeout bounds reading the whole request, body included, so it
+	// must allow for the largest upload.
+	ReadTimeout Duration `json:"read_timeout,omitempty"`
+	// WriteTimeout bounds writing the response, so it must allow for the
+	// largest download.
+	WriteTimeout Duration `json:"write_timeout,omitempty"`
+	// IdleTimeout is how long an idle keep-alive connection is kept open.
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+	// ShutdownDelay is how long the server keeps accepting requests after
+	// it starts reporting not ready, so that load balancers stop sending
+	// new requests before the listener closes.
+	ShutdownDelay Duration `json:"shutdown_delay,omitempty"`
+	// ShutdownTimeout bounds the draining of in-flight requests. Requests
+	// still running then are cancelled.
+	ShutdownTimeout Duration `json:"shutdown_timeout,omitempty"`
+}
+
+// TLS client authentication modes.
+const (
+	ClientAuthRequire  = "require"
+	ClientAuthOptional = "optional"
+)
+
+// TLSConfig enables HTTPS on the listener when CertFile is set. The
+// certificate, key and client CA files are read again whenever they change.
+type TLSConfig struct {
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// MinVersion is the lowest TLS version accepted: "1.2" or "1.3".
+	MinVersion string `json:"min_version,omitempty"`
+	// CipherSuites restricts the TLS 1.2 cipher suites, by their Go names
+	// such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites are not
+	// configurable.
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+	// ClientCAFile is a PEM bundle of the CAs that client certificates are
+	// verified against. Setting it enables mutual TLS.
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+	// ClientAuth is "require", to reject clients without a valid
+	// certificate, or "optional", to verify certificates only when sent.
+	ClientAuth string `json:"client_auth,omitempty"`
+}
+
+// Enabled reports whether the listener serves HTTPS.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// tlsVersions maps the accepted values of min_version to their versions.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Version returns the minimum TLS version.
+func (t TLSConfig) Version() uint16 {
+	return tlsVersions[t.MinVersion]
+}
+
+// CipherSuiteIDs returns the configured cipher suites, or nil for Go's
+// defaults. Unknown names are skipped; Validate reports them.
+func (t TLSConfig) CipherSuiteIDs() []uint16 {
+	var ids []uint16
+	for _, name := range t.CipherSuites {
+		if id, ok := cipherSuite(name); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// cipherSuite looks up a secure cipher suite by name.
+func cipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// BackendTLSConfig configures TLS to the backend, for endpoints with a
+// private CA or that require client certificates.
+type BackendTLSConfig struct {
+	// CAFile is a PEM bundle of CAs trusted in addition to the system's.
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile and KeyFile are a client certificate presented to the
+	// backend.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// ServerName overrides the name the backend certificate is verified
+	// against.
+	ServerName string `json:"server_name,omitempty"`
+	// InsecureSkipVerify disables verification of the backend certificate.
+	// Only for testing.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+// The S3 actions that policies grant or deny. HEAD requests need
+// s3:GetObject, or s3:ListBucket on the bucket, as in AWS.
+const (
+	ActionListAllMyBuckets  = "s3:ListAllMyBuckets"
+	ActionGetBucketLocation = "s3:GetBucketLocation"
+	ActionListBucket        = "s3:ListBucket"
+	ActionGetObject         = "s3:GetObject"
+	ActionPutObject         = "s3:PutObject"
+	ActionDeleteObject      = "s3:DeleteObject"
+	ActionGetObjectTagging  = "s3:GetObjectTagging"
+	ActionPutObjectTagging  = "s3:PutObjectTagging"
+)
+
+// The actions of bucket configuration reads. The virtual bucket has no
+// configuration, so these return empty documents or not-found errors.
+const (
+	ActionGetBucketVersioning              = "s3:GetBucketVersioning"
+	ActionGetBucketLogging                 = "s3:GetBucketLogging"
+	ActionGetBucketNotification            = "s3:GetBucketNotification"
+	ActionGetAccelerateConfiguration       = "s3:GetAccelerateConfiguration"
+	ActionGetBucketRequestPayment          = "s3:GetBucketRequestPayment"
+	ActionGetBucketAcl                     = "s3:GetBucketAcl"
+	ActionGetLifecycleConfiguration        = "s3:GetLifecycleConfiguration"
+	ActionGetBucketPolicy                  = "s3:GetBucketPolicy"
+	ActionGetBucketPolicyStatus            = "s3:GetBucketPolicyStatus"
+	ActionGetBucketTagging                 = "s3:GetBucketTagging"
+	ActionGetBucketCORS                    = "s3:GetBucketCORS"
+	ActionGetEncryptionConfiguration       = "s3:GetEncryptionConfiguration"
+	ActionGetBucketWebsite                 = "s3:GetBucketWebsite"
+	ActionGetReplicationConfiguration      = "s3:GetReplicationConfiguration"
+	ActionGetBucketObjectLockConfiguration = "s3:GetBucketObjectLockConfiguration"
+	ActionGetBucketOwnershipControls       = "s3:GetBucketOwnershipControls"
+	ActionGetBucketPublicAccessBlock       = "s3:GetBucketPublicAccessBlock"
+)
+
+// ActionGetUsage reads the usage report at /admin/usage. It is outside the
+// s3: namespace, so that policies granting "s3:*" do not grant it.
+const ActionGetUsage = "admin:GetUsage"
+
+// Actions lists every action a policy may name.
+var Actions = []string{
+	ActionListAllMyBuckets, ActionGetBucketLocation, ActionListBucket,
+	ActionGetObject, ActionPutObject, ActionDeleteObject,
+	ActionGetObjectTagging, ActionPutObjectTagging,
+	ActionGetBucketVersioning, ActionGetBucketLogging, ActionGetBucketNotification,
+	ActionGetAccelerateConfiguration, ActionGetBucketRequestPayment, ActionGetBucketAcl,
+	ActionGetLifecycleConfiguration, ActionGetBucketPolicy, ActionGetBucketPolicyStatus,
+	ActionGetBucketTagging, ActionGetBucketCORS, ActionGetEncryptionConfiguration,
+	ActionGetBucketWebsite, ActionGetReplicationConfiguration,
+	ActionGetBucketObjectLockConfiguration, ActionGetBucketOwnershipControls,
+	ActionGetBucketPublicAccessBlock,
+	ActionGetUsage,
+}
+
+// Policy effects.
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// AnonymousPrincipal is the principal of clients without a verified
+// client certificate.
+const AnonymousPrincipal = "anonymous"
+
+// AuthorizationConfig controls which clients may perform which actions on
+// which keys. When enabled, a request is allowed only if some policy
+// allows it and no policy denies it.
+type AuthorizationConfig struct {
+	Enabled  bool           `json:"enabled"`
+	Policies []PolicyConfig `json:"policies,omitempty"`
+}
+
+// PolicyConfig allows or denies actions on keys to principals. Principals,
+// actions and keys are patterns in which "*" matches any sequence of
+// characters, "/" included.
+type PolicyConfig struct {
+	// Effect is "allow", the default, or "deny".
+	Effect string `json:"effect,omitempty"`
+	// Principals are client identities, as taken from verified client
+	// certificates, or "anonymous".
+	Principals []string `json:"principals"`
+	// Actions are S3 action names such as "s3:GetObject" or "s3:Get*".
+	Actions []string `json:"actions"`
+	// Keys are object keys, or list prefixes for s3:ListBucket. Empty
+	// matches every key.
+	Keys []string `json:"keys,omitempty"`
+}
+
+// RateLimitOperations are the operations that rate limits apply to. Tag
+// reads count as head and tag writes as put.
+var RateLimitOperations = []string{"get", "head", "put", "delete", "list"}
+
+// RateLimitConfig throttles requests per tenant, the first segment of the
+// object key or list prefix, and per operation. Each tenant and operation
+// has its own limits and state. The most specific limit applies: the
+// tenant's limit for the operation, the tenant's default, the limit for the
+// operation, then Default.
+type RateLimitConfig struct {
+	Enabled bool      `json:"enabled"`
+	Default RateLimit `json:"default"`
+	// Operations overrides Default per operation.
+	Operations map[string]RateLimit `json:"operations,omitempty"`
+	// Tenants overrides the limits of individual tenants.
+	Tenants map[string]TenantRateLimit `json:"tenants,omitempty"`
+}
+
+// TenantRateLimit overrides the limits of one tenant.
+type TenantRateLimit struct {
+	Default    *RateLimit           `json:"default,omitempty"`
+	Operations map[string]RateLimit `json:"operations,omitempty"`
+}
+
+// RateLimit bounds the requests of one tenant for one operation. Zero
+// fields are unlimited.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	// Burst is the number of requests allowed at once after an idle
+	// period. Defaults to RequestsPerSecond.
+	Burst int `json:"burst,omitempty"`
+	// BytesPerSecond bounds request and response bodies together.
+	BytesPerSecond int64 `json:"bytes_per_second,omitempty"`
+	// BurstBytes defaults to BytesPerSecond.
+	BurstBytes    int64 `json:"burst_bytes,omitempty"`
+	MaxConcurrent int   `json:"max_concurrent,omitempty"`
+}
+
+// Limit returns the limit that applies to tenant for operation.
+func (c RateLimitConfig) Limit(tenant, operation string) RateLimit {
+	if t, ok := c.Tenants[tenant]; ok {
+		if limit, ok := t.Operations[operation]; ok {
+			return limit
+		}
+		if t.Default != nil {
+			return *t.Default
+		}
+	}
+	if limit, ok := c.Operations[operation]; ok {
+		return limit
+	}
+	return c.Default
+}
+
+// AdmissionConfig controls admission control of backend calls. Each limit
+// adapts to backend latency: it grows while calls complete faster than
+// LatencyThreshold and is multiplied by BackoffRatio when they are slower or
+// the backend signals overload. Calls beyond the limit wait in a queue, and
+// are rejected with SlowDown when the queue is full or they wait longer
+// than MaxQueueWait.
+type AdmissionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Global bounds the calls in flight across all shards.
+	Global ConcurrencyLimit `json:"global"`
+	// PerShard bounds the calls in flight to each shard bucket.
+	PerShard ConcurrencyLimit `json:"per_shard"`
+	// LatencyThreshold is the latency above which a call counts as a sign
+	// of overload. Uploads are not measured, as their latency depends on
+	// their size.
+	LatencyThreshold Duration `json:"latency_threshold,omitempty"`
+	// BackoffRatio (0-1) multiplies a limit on overload.
+	BackoffRatio float64 `json:"backoff_ratio,omitempty"`
+	// MaxQueue is the number of calls that may wait for each limit.
+	MaxQueue int `json:"max_queue,omitempty"`
+	// MaxQueueWait bounds how long a call waits for a slot.
+	MaxQueueWait Duration `json:"max_queue_wait,omitempty"`
+}
+
+// ConcurrencyLimit is the range of an adaptive concurrency limit. Setting
+// MinLimit equal to MaxLimit fixes the limit.
+type ConcurrencyLimit struct {
+	InitialLimit int `json:"initial_limit,omitempty"`
+	MinLimit     int `json:"min_limit,omitempty"`
+	MaxLimit     int `json:"max_limit,omitempty"`
+}
+
+// UsageConfig controls storage usage accounting. The usage of each tenant,
+// the first segment of the object key, is seeded by scanning every shard
+// bucket and then kept up to date from the writes made through the proxy.
+type UsageConfig struct {
+	Enabled bool `json:"enabled"`
+	// RescanInterval is how often the buckets are scanned again, to pick up
+	// changes made other than through this proxy, such as by its other
+	// replicas.
+	RescanInterval Duration `json:"rescan_interval,omitempty"`
+	// DefaultQuota applies to tenants without an entry in Quotas.
+	DefaultQuota Quota `json:"default_quota"`
+	// Quotas overrides DefaultQuota per tenant.
+	Quotas map[string]Quota `json:"quotas,omitempty"`
+}
+
+// Quota bounds the storage of a tenant. Zero is unlimited.
+type Quota struct {
+	// MaxBytes bounds the bytes stored on all shards together, including
+	// replicas and erasure pieces.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// Quota returns the quota of tenant.
+func (c UsageConfig) Quota(tenant string) Quota {
+	if quota, ok := c.Quotas[tenant]; ok {
+		return quota
+	}
+	return c.DefaultQuota
+}
+
+// LifecycleConfig controls the lifecycle worker, which applies Rules across
+// all shard buckets every Interval.
+type LifecycleConfig struct {
+	Enabled bool `json:"enabled"`
+	// DryRun logs and counts what the rules would delete without deleting
+	// anything.
+	DryRun   bool     `json:"dry_run"`
+	Interval Duration `json:"interval,omitempty"`
+	// LeaseDuration is how long the lease that lets one proxy replica run
+	// the worker lasts without being renewed. Another replica takes over
+	// once it expires.
+	LeaseDuration Duration        `json:"lease_duration,omitempty"`
+	Rules         []LifecycleRule `json:"rules,omitempty"`
+}
+
+// LifecycleRule expires the objects of a tenant under a key prefix. Objects
+// under a block directory, the first two segments of the key such as
+// tenant/blockID/, expire together once the newest of them is older than
+// ExpireAfter.
+type LifecycleRule struct {
+	// ID names the rule in logs and metrics.
+	ID string `json:"id"`
+	// Tenant is the first segment of the key; empty matches every tenant.
+	Tenant string `json:"tenant,omitempty"`
+	// Prefix restricts the rule to keys that start with it after the
+	// tenant segment.
+	Prefix string `json:"prefix,omitempty"`
+	// ExpireAfter is the age at which objects are deleted. Zero never
+	// expires objects.
+	ExpireAfter Duration `json:"expire_after,omitempty"`
+	// AbortIncompleteUploadsAfter is the age at which incomplete multipart
+	// uploads are aborted. Zero leaves them alone.
+	AbortIncompleteUploadsAfter Duration `json:"abort_incomplete_uploads_after,omitempty"`
+}
+
+// ListPrefix returns the key prefix to list to find the rule's objects.
+func (r LifecycleRule) ListPrefix() string {
+	if r.Tenant == "" {
+		return ""
 	}
+	return r.Tenant + "/" + r.Prefix
+}
 
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, err
+// Matches reports whether key is subject to the rule.
+func (r LifecycleRule) Matches(key string) bool {
+	tenant, rest, ok := strings.Cut(key, "/")
+	if !ok {
+		tenant, rest = "", key
+	}
+	if r.Tenant != "" && tenant != r.Tenant {
+		return false
 	}
+	return strings.HasPrefix(rest, r.Prefix)
+}
+
+// Duration is a time.Duration that is written in config files as a Go
+// duration string such as "500ms" or "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		// Bare numbers are interpreted as seconds
+		*d = Duration(value * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", value, err)
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+	return nil
+}
+
+// Std returns d as a time.Duration.
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
 
+// setDefaults fills in optional settings that were left empty in the file.
+func (c *Config) setDefaults() {
 	// Set default log level if not specified
-	if config.LogLevel == "" {
-		config.LogLevel = "info"
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+
+	cb := &c.CircuitBreaker
+	if cb.Window == 0 {
+		cb.Window = Duration(30 * time.Second)
+	}
+	if cb.MinRequests == 0 {
+		cb.MinRequests = 20
+	}
+	if cb.ErrorThreshold == nil {
+		threshold := 0.5
+		cb.ErrorThreshold = &threshold
+	}
+	if cb.OpenDuration == 0 {
+		cb.OpenDuration = Duration(15 * time.Second)
+	}
+	if cb.HalfOpenRequests == 0 {
+		cb.HalfOpenRequests = 3
+	}
+
+	if c.List.FailurePolicy == "" {
+		c.List.FailurePolicy = ListFailurePolicyFail
+	}
+
+	t := &c.Timeouts
+	if t.Get == 0 {
+		t.Get = Duration(5 * time.Minute)
+	}
+	if t.Put == 0 {
+		t.Put = Duration(30 * time.Minute)
+	}
+	if t.List == 0 {
+		t.List = Duration(2 * time.Minute)
+	}
+	if t.Head == 0 {
+		t.Head = Duration(30 * time.Second)
+	}
+	if t.Delete == 0 {
+		t.Delete = Duration(30 * time.Second)
+	}
+	if t.Tagging == 0 {
+		t.Tagging = Duration(30 * time.Second)
+	}
+
+	if c.Retry.MaxAttempts == 0 {
+		c.Retry.MaxAttempts = 3
+	}
+	if c.Retry.InitialBackoff == 0 {
+		c.Retry.InitialBackoff = Duration(100 * time.Millisecond)
+	}
+	if c.Retry.MaxBackoff == 0 {
+		c.Retry.MaxBackoff = Duration(2 * time.Second)
+	}
+
+	if c.Replication.Factor == 0 {
+		c.Replication.Factor = 1
+	}
+	if c.Replication.WriteQuorum == 0 {
+		c.Replication.WriteQuorum = c.Replication.Factor/2 + 1
+	}
+
+	e := &c.Erasure
+	if e.DataShards == 0 {
+		e.DataShards = 4
+	}
+	if e.ParityShards == 0 {
+		e.ParityShards = 2
+	}
+	if e.MinSize == 0 {
+		e.MinSize = 64 << 20
+	}
+	if e.BlockSize == 0 {
+		e.BlockSize = 1 << 20
+	}
+
+	cache := &c.Cache
+	if len(cache.KeyPatterns) == 0 {
+		cache.KeyPatterns = []string{`/meta(\.compacted)?\.json$`, `/bloom-\d+$`, `/index$`}
+	}
+	if cache.MaxObjectSize == 0 {
+		cache.MaxObjectSize = 8 << 20
+	}
+	if cache.MaxMemoryBytes == 0 {
+		cache.MaxMemoryBytes = 256 << 20
+	}
+	if cache.MaxAge == 0 {
+		cache.MaxAge = Duration(30 * time.Second)
+	}
+	if cache.MaxDiskBytes == 0 {
+		cache.MaxDiskBytes = 1 << 30
+	}
+
+	if c.StatCache.MaxEntries == 0 {
+		c.StatCache.MaxEntries = 100000
+	}
+	if c.StatCache.TTL == 0 {
+		c.StatCache.TTL = Duration(30 * time.Second)
+	}
+	if c.StatCache.NegativeTTL == 0 {
+		c.StatCache.NegativeTTL = Duration(5 * time.Second)
 	}
 
-	return &config, nil
+	if c.ListCache.RefreshInterval == 0 {
+		c.ListCache.RefreshInterval = Duration(time.Minute)
+	}
+	if c.ListCache.MaxStaleness == 0 {
+		c.ListCache.MaxStaleness = Duration(5 * time.Minute)
+	}
+	if c.ListCache.MaxEntries == 0 {
+		c.ListCache.MaxEntries = 100000
+	}
+
+	if c.SingleFlight.MaxObjectSize == 0 {
+		c.SingleFlight.MaxObjectSize = 8 << 20
+	}
+	if c.SingleFlight.MaxListEntries == 0 {
+		c.SingleFlight.MaxListEntries = 100000
+	}
+
+	comp := &c.Compression
+	if comp.Codec == "" {
+		comp.Codec = "zstd"
+	}
+	if comp.MinSize == 0 {
+		comp.MinSize = 1 << 10
+	}
+	if comp.MaxSize == 0 {
+		comp.MaxSize = 64 << 20
+	}
+	if comp.FrameSize == 0 {
+		comp.FrameSize = 1 << 20
+	}
+
+	if c.Encryption.ActiveKey == "" && len(c.Encryption.Keys) > 0 {
+		c.Encryption.ActiveKey = c.Encryption.Keys[0].ID
+	}
+	if c.Encryption.ChunkSize == 0 {
+		c.Encryption.ChunkSize = 64 << 10
+	}
+	if c.Credentials.Provider == "" {
+		c.Credentials.Provider = CredentialsStatic
+	}
+	if c.Credentials.STSEndpoint == "" {
+		c.Credentials.STSEndpoint = "https://sts.amazonaws.com"
+	}
+	if c.Credentials.Duration == 0 {
+		c.Credentials.Duration = Duration(time.Hour)
+	}
+	if c.Credentials.RefreshInterval == 0 {
+		c.Credentials.RefreshInterval = Duration(5 * time.Minute)
+	}
+	if c.Reload.WatchInterval == 0 {
+		c.Reload.WatchInterval = Duration(10 * time.Second)
+	}
+
+	if c.TLS.MinVersion == "" {
+		c.TLS.MinVersion = "1.2"
+	}
+	if c.TLS.ClientAuth == "" && c.TLS.ClientCAFile != "" {
+		c.TLS.ClientAuth = ClientAuthRequire
+	}
+
+	for i := range c.Authorization.Policies {
+		if c.Authorization.Policies[i].Effect == "" {
+			c.Authorization.Policies[i].Effect = EffectAllow
+		}
+	}
+
+	sv := &c.Server
+	if sv.ReadHeaderTimeout == 0 {
+		sv.ReadHeaderTimeout = Duration(10 * time.Second)
+	}
+	if sv.ReadTimeout == 0 {
+		sv.ReadTimeout = Duration(30 * time.Minute)
+	}
+	if sv.WriteTimeout == 0 {
+		sv.WriteTimeout = Duration(30 * time.Minute)
+	}
+	if sv.IdleTimeout == 0 {
+		sv.IdleTimeout = Duration(2 * time.Minute)
+	}
+	if sv.ShutdownTimeout == 0 {
+		sv.ShutdownTimeout = Duration(25 * time.Second)
+	}
+
+	ad := &c.Admission
+	ad.Global.setDefaults(256, 16, 1024)
+	ad.PerShard.setDefaults(64, 4, 256)
+	if ad.LatencyThreshold == 0 {
+		ad.LatencyThreshold = Duration(time.Second)
+	}
+	if ad.BackoffRatio == 0 {
+		ad.BackoffRatio = 0.9
+	}
+	if ad.MaxQueue == 0 {
+		ad.MaxQueue = 1000
+	}
+	if ad.MaxQueueWait == 0 {
+		ad.MaxQueueWait = Duration(5 * time.Second)
+	}
+
+	if c.Usage.RescanInterval == 0 {
+		c.Usage.RescanInterval = Duration(15 * time.Minute)
+	}
+
+	if c.Lifecycle.Interval == 0 {
+		c.Lifecycle.Interval = Duration(time.Hour)
+	}
+	if c.Lifecycle.LeaseDuration == 0 {
+		c.Lifecycle.LeaseDuration = Duration(time.Minute)
+	}
+
+	if len(c.Hedge.KeyPatterns) == 0 {
+		c.Hedge.KeyPatterns = []string{`/meta(\.compacted)?\.json$`, `/bloom-\d+$`, `/index$`}
+	}
+	if c.Hedge.Percentile == 0 {
+		c.Hedge.Percentile = 0.95
+	}
+	if c.Hedge.MinDelay == 0 {
+		c.Hedge.MinDelay = Duration(10 * time.Millisecond)
+	}
+}
+
+func (l *ConcurrencyLimit) setDefaults(initial, min, max int) {
+	if l.MinLimit == 0 {
+		l.MinLimit = min
+	}
+	if l.MaxLimit == 0 {
+		l.MaxLimit = max
+	}
+	if l.InitialLimit == 0 {
+		l.InitialLimit = initial
+	}
 }
 
 // ParsedEndpoint returns the host and SSL setting from the endpoint
@@ -76,7 +993,7 @@ func (c *Config) GetLogLevel() slog.Level {
 }
 
 func DefaultConfig() *Config {
-	return &Config{
+	cfg := &Config{
 		ListenAddr:      ":8080",
 		Endpoint:        "localhost:9000",
 		AccessKeyID:     "minioadmin",
@@ -86,4 +1003,6 @@ func DefaultConfig() *Config {
 		Buckets:         []string{"bucket1", "bucket2", "bucket3"},
 		LogLevel:        "info",
 	}
+	cfg.setDefaults()
+	return cfg
 }
\ No newline at end of file
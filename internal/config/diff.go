@@ -0,0 +1,92 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"slices"
+)
+
+// secretSettings are the settings whose values are never logged.
+var secretSettings = map[string]bool{
+	"secret_access_key": true,
+}
+
+// Redacted returns a copy of c with secret values replaced, for printing.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.SecretAccessKey != "" {
+		redacted.SecretAccessKey = "<redacted>"
+	}
+	return &redacted
+}
+
+// Change is a setting that differs between two configs. Path is the
+// setting's dotted JSON name, such as "timeouts.get".
+type Change struct {
+	Path string
+	Old  string
+	New  string
+}
+
+// Hash returns a short fingerprint of the effective config, defaults
+// included. Secret values are redacted first, since the hash is exported
+// as a metric label.
+func (c *Config) Hash() string {
+	data, _ := json.Marshal(c.Redacted())
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Diff returns the settings that differ between old and new, sorted by
+// path. Secret values are redacted.
+func Diff(old, new *Config) []Change {
+	before, after := flatten(old), flatten(new)
+	paths := slices.Sorted(maps.Keys(before))
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+
+	var changes []Change
+	for _, path := range paths {
+		if before[path] == after[path] {
+			continue
+		}
+		change := Change{Path: path, Old: before[path], New: after[path]}
+		if secretSettings[path] {
+			change.Old, change.New = "<redacted>", "<redacted>"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// flatten returns the JSON encoding of every leaf setting of c by path.
+// Lists are treated as a single setting.
+func flatten(c *Config) map[string]string {
+	data, _ := json.Marshal(c)
+	var tree map[string]any
+	json.Unmarshal(data, &tree)
+	out := make(map[string]string)
+	flattenInto(out, "", tree)
+	return out
+}
+
+func flattenInto(out map[string]string, prefix string, tree map[string]any) {
+	for name, value := range tree {
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		if sub, ok := value.(map[string]any); ok {
+			flattenInto(out, path, sub)
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+		out[path] = string(encoded)
+	}
+}
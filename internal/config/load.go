@@ -0,0 +1,285 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the names of environment variables that override
+// settings. The rest of the name is the setting's path in upper case with
+// dots replaced by underscores, as in TEMPO_S3_SHARD_TIMEOUTS_GET.
+const EnvPrefix = "TEMPO_S3_SHARD_"
+
+// secretFiles maps the settings that can be read from a file to the
+// setting naming the file.
+var secretFiles = map[string]string{
+	"access_key_id":     "access_key_id_file",
+	"secret_access_key": "secret_access_key_file",
+}
+
+// envReference matches ${NAME} in a config file.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// LoadConfig reads and validates a config file, which is YAML if its name
+// ends in .yaml or .yml and JSON otherwise. Settings are taken, from
+// highest precedence to lowest, from overrides, each written as
+// "path=value", then TEMPO_S3_SHARD_* environment variables, then the file,
+// then the defaults. Unknown fields in the file are errors, so that a
+// misspelled setting is not silently ignored.
+func LoadConfig(filename string, overrides ...string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	data, err = expandEnv(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	if ext := strings.ToLower(filepath.Ext(filename)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", filename, err)
+		}
+	}
+
+	var config Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("parsing %s: unexpected data after the config object", filename)
+	}
+
+	if err := config.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		path, value, ok := strings.Cut(override, "=")
+		if !ok {
+			return nil, fmt.Errorf("override %q: want path=value", override)
+		}
+		if err := config.Set(path, value); err != nil {
+			return nil, fmt.Errorf("override %q: %w", override, err)
+		}
+	}
+	if err := config.readSecretFiles(); err != nil {
+		return nil, err
+	}
+
+	config.setDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", filename, err)
+	}
+
+	return &config, nil
+}
+
+// expandEnv replaces every ${NAME} in data with the value of the
+// environment variable NAME, which must be set. Values are inserted as
+// they are, without quoting.
+func expandEnv(data []byte) ([]byte, error) {
+	var missing []string
+	data = envReference.ReplaceAllFunc(data, func(ref []byte) []byte {
+		name := string(envReference.FindSubmatch(ref)[1])
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return []byte(value)
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return data, nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so that both formats are
+// decoded by the same rules.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+	return json.Marshal(doc)
+}
+
+// applyEnv applies the TEMPO_S3_SHARD_* variables in environ that name a
+// setting. Others with the prefix are ignored, since Kubernetes sets
+// variables such as TEMPO_S3_SHARD_SERVICE_HOST for a service of the same
+// name.
+func (c *Config) applyEnv(environ []string) error {
+	paths := make(map[string]string)
+	for _, path := range settingPaths(reflect.TypeFor[Config](), "") {
+		paths[EnvPrefix+strings.ToUpper(strings.ReplaceAll(path, ".", "_"))] = path
+	}
+	// Sorted so that a secret and its file variant resolve the same way
+	// on every run
+	slices.Sort(environ)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		path, ok := paths[name]
+		if !ok {
+			continue
+		}
+		if err := c.Set(path, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// settingPaths lists the dotted paths of every setting of t that is not a
+// section.
+func settingPaths(t reflect.Type, prefix string) []string {
+	var paths []string
+	for field := range fieldsOf(t) {
+		name := jsonName(field)
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if isSection(field.Type) {
+			paths = append(paths, settingPaths(field.Type, name)...)
+		} else {
+			paths = append(paths, name)
+		}
+	}
+	return paths
+}
+
+// Set sets the setting at path, such as "timeouts.get", from its string
+// form. Lists of strings may be written comma separated; other lists and
+// sections are written as JSON. Setting a credential clears its file
+// variant and the other way around.
+func (c *Config) Set(path, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(path, ".") {
+		if v.Kind() != reflect.Struct {
+			return fmt.Errorf("unknown setting %q", path)
+		}
+		field, ok := fieldByName(v.Type(), name)
+		if !ok {
+			return fmt.Errorf("unknown setting %q", path)
+		}
+		v = v.FieldByIndex(field.Index)
+	}
+	if err := setValue(v, value); err != nil {
+		return fmt.Errorf("setting %s: %w", path, err)
+	}
+
+	for secret, file := range secretFiles {
+		switch path {
+		case secret:
+			c.clear(file)
+		case file:
+			c.clear(secret)
+		}
+	}
+	return nil
+}
+
+// clear resets the top-level setting name.
+func (c *Config) clear(name string) {
+	v := reflect.ValueOf(c).Elem()
+	if field, ok := fieldByName(v.Type(), name); ok {
+		v.FieldByIndex(field.Index).SetZero()
+	}
+}
+
+func setValue(v reflect.Value, value string) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+		return nil
+	case v.Type() == reflect.TypeFor[Duration]():
+		// Accept both 30s and "30s"
+		if json.Unmarshal([]byte(value), v.Addr().Interface()) == nil {
+			return nil
+		}
+		quoted, _ := json.Marshal(value)
+		return json.Unmarshal(quoted, v.Addr().Interface())
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "["):
+		var items []string
+		for item := range strings.SplitSeq(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v.Addr().Interface())
+}
+
+// readSecretFiles reads the credentials whose file variant is set.
+func (c *Config) readSecretFiles() error {
+	for _, secret := range []struct {
+		name, file string
+		value      *string
+	}{
+		{"access_key_id", c.AccessKeyIDFile, &c.AccessKeyID},
+		{"secret_access_key", c.SecretAccessKeyFile, &c.SecretAccessKey},
+	} {
+		if secret.file == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return fmt.Errorf("set only one of %s and %s", secret.name, secretFiles[secret.name])
+		}
+		data, err := os.ReadFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", secretFiles[secret.name], err)
+		}
+		*secret.value = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
+
+func fieldsOf(t reflect.Type) func(yield func(reflect.StructField) bool) {
+	return func(yield func(reflect.StructField) bool) {
+		for i := range t.NumField() {
+			if field := t.Field(i); field.IsExported() && jsonName(field) != "-" {
+				if !yield(field) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func fieldByName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for field := range fieldsOf(t) {
+		if jsonName(field) == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// isSection reports whether settings of type t are groups of settings
+// rather than values.
+func isSection(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct
+}
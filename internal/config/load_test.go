@@ -0,0 +1,152 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadPrecedence sets the secret access key from each pair of sources,
+// which from lowest precedence to highest are the config file, the
+// environment, a *_file setting and -set, and checks that the higher one
+// wins.
+func TestLoadPrecedence(t *testing.T) {
+	type source struct {
+		name  string
+		apply func(t *testing.T, file *[]string, overrides *[]string)
+	}
+	sources := []source{
+		{"file", func(t *testing.T, file *[]string, _ *[]string) {
+			*file = append(*file, "secret_access_key: file")
+		}},
+		{"env", func(t *testing.T, _ *[]string, _ *[]string) {
+			t.Setenv(EnvPrefix+"SECRET_ACCESS_KEY", "env")
+		}},
+		{"secret_file", func(t *testing.T, _ *[]string, _ *[]string) {
+			t.Setenv(EnvPrefix+"SECRET_ACCESS_KEY_FILE", writeFile(t, "secret", "secret_file\n"))
+		}},
+		{"set", func(t *testing.T, _ *[]string, overrides *[]string) {
+			*overrides = append(*overrides, "secret_access_key=set")
+		}},
+	}
+
+	for i, low := range sources {
+		for _, high := range sources[i+1:] {
+			t.Run(low.name+"<"+high.name, func(t *testing.T) {
+				file := []string{"endpoint: localhost:9000", "buckets: [shard1]"}
+				var overrides []string
+				high.apply(t, &file, &overrides)
+				low.apply(t, &file, &overrides)
+
+				cfg, err := LoadConfig(writeFile(t, "config.yaml", strings.Join(file, "\n")), overrides...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cfg.SecretAccessKey != high.name {
+					t.Fatalf("secret_access_key is %q, want %q", cfg.SecretAccessKey, high.name)
+				}
+			})
+		}
+	}
+}
+
+func TestLoadSettingPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		env      string
+		override string
+		want     string
+	}{
+		{name: "file", want: "1m0s"},
+		{name: "env", env: "2m", want: "2m0s"},
+		{name: "set", override: "timeouts.get=3m", want: "3m0s"},
+		{name: "env and set", env: "2m", override: "timeouts.get=3m", want: "3m0s"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.env != "" {
+				t.Setenv(EnvPrefix+"TIMEOUTS_GET", tc.env)
+			}
+			var overrides []string
+			if tc.override != "" {
+				overrides = append(overrides, tc.override)
+			}
+			cfg, err := LoadConfig(writeFile(t, "config.json", `{"endpoint": "localhost:9000", "buckets": ["shard1"], "timeouts": {"get": "1m"}}`), overrides...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg.Timeouts.Get.Std().String(); got != tc.want {
+				t.Fatalf("timeouts.get is %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadYAMLJSONParity(t *testing.T) {
+	jsonPath := writeFile(t, "config.json", `{
+  "endpoint": "https://s3.example.com",
+  "buckets": ["shard1", "shard2", "shard3"],
+  "timeouts": {"get": "2m", "put": 30},
+  "replication": {"factor": 2},
+  "cache": {"enabled": true, "key_patterns": [".*/meta\\.json$"], "max_age": "1m"},
+  "rate_limit": {"enabled": true, "operations": {"get": {"requests_per_second": 100, "burst": 200}}}
+}`)
+	yamlPath := writeFile(t, "config.yaml", `
+endpoint: https://s3.example.com
+buckets: [shard1, shard2, shard3]
+timeouts:
+  get: 2m
+  put: 30
+replication:
+  factor: 2
+cache:
+  enabled: true
+  key_patterns: ['.*/meta\.json$']
+  max_age: 1m
+rate_limit:
+  enabled: true
+  operations:
+    get: {requests_per_second: 100, burst: 200}
+`)
+	fromJSON, err := LoadConfig(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromYAML, err := LoadConfig(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		for _, change := range Diff(fromJSON, fromYAML) {
+			t.Errorf("%s is %s from JSON and %s from YAML", change.Path, change.Old, change.New)
+		}
+		t.Fatal("JSON and YAML configs differ")
+	}
+}
+
+func TestLoadUnknownFields(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+	}{
+		{"config.json", `{"buckets": ["shard1"], "bucket": ["shard2"]}`},
+		{"config.json", `{"buckets": ["shard1"], "timeouts": {"gets": "1m"}}`},
+		{"config.yaml", "buckets: [shard1]\nbucket: [shard2]\n"},
+		{"config.yaml", "buckets: [shard1]\ntimeouts:\n  gets: 1m\n"},
+	} {
+		_, err := LoadConfig(writeFile(t, tc.name, tc.content))
+		if err == nil || !strings.Contains(err.Error(), "unknown field") {
+			t.Errorf("%s %q: got %v, want an unknown field error", tc.name, tc.content, err)
+		}
+	}
+}
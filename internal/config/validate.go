@@ -0,0 +1,285 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// logLevels are the accepted values of log_level.
+var logLevels = []string{"debug", "info", "warn", "warning", "error"}
+
+// Validate checks the settings that have no safe default. It reports every
+// problem found, not just the first.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if len(c.Buckets) == 0 {
+		errs = append(errs, errors.New("buckets: at least one bucket is required"))
+	}
+	seen := make(map[string]bool, len(c.Buckets))
+	for _, bucket := range c.Buckets {
+		switch {
+		case bucket == "":
+			errs = append(errs, errors.New("buckets: bucket names must not be empty"))
+		case seen[bucket]:
+			errs = append(errs, fmt.Errorf("buckets: duplicate bucket %q", bucket))
+		}
+		seen[bucket] = true
+	}
+
+	if err := validateEndpoint(c.Endpoint); err != nil {
+		errs = append(errs, fmt.Errorf("endpoint: %w", err))
+	}
+
+	if !containsFold(logLevels, c.LogLevel) {
+		errs = append(errs, fmt.Errorf("log_level: unknown level %q, want one of %s", c.LogLevel, strings.Join(logLevels, ", ")))
+	}
+
+	if p := c.List.FailurePolicy; p != ListFailurePolicyFail && p != ListFailurePolicyPartial {
+		errs = append(errs, fmt.Errorf("list.failure_policy: unknown policy %q, want %q or %q", p, ListFailurePolicyFail, ListFailurePolicyPartial))
+	}
+
+	if t := c.CircuitBreaker.ErrorThreshold; t != nil && (*t < 0 || *t > 1) {
+		errs = append(errs, fmt.Errorf("circuit_breaker.error_threshold: must be between 0 and 1, got %g", *t))
+	}
+
+	if err := c.Credentials.validate(c); err != nil {
+		errs = append(errs, fmt.Errorf("credentials: %w", err))
+	}
+
+	errs = append(errs, c.TLS.validate()...)
+	for i, policy := range c.Authorization.Policies {
+		if err := policy.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("authorization.policies[%d]: %w", i, err))
+		}
+	}
+	if err := c.BackendTLS.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("backend_tls: %w", err))
+	}
+
+	errs = append(errs, c.RateLimit.validate()...)
+	errs = append(errs, c.Admission.validate()...)
+	errs = append(errs, c.Usage.validate()...)
+	errs = append(errs, c.Lifecycle.validate()...)
+
+	r := c.Replication
+	if r.Factor < 1 || r.Factor > len(c.Buckets) {
+		errs = append(errs, fmt.Errorf("replication.factor: must be between 1 and the number of buckets (%d), got %d", len(c.Buckets), r.Factor))
+	}
+	if r.WriteQuorum < 1 || r.WriteQuorum > r.Factor {
+		errs = append(errs, fmt.Errorf("replication.write_quorum: must be between 1 and replication.factor (%d), got %d", r.Factor, r.WriteQuorum))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateEndpoint checks that endpoint is a bare host[:port] or an http or
+// https URL without a path.
+func validateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return errors.New("must not be empty")
+	}
+	raw := endpoint
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q, want http or https", u.Scheme)
+	}
+	if u.Host == "" || u.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("%q must be a host or URL without a path, query or credentials", endpoint)
+	}
+	return nil
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc CredentialsConfig) validate(c *Config) error {
+	switch cc.Provider {
+	case CredentialsStatic, CredentialsEnv, CredentialsAWSFile, CredentialsMinioFile, CredentialsIAM:
+	case CredentialsWebIdentity:
+		if cc.WebIdentityTokenFile == "" {
+			return errors.New("web_identity needs web_identity_token_file")
+		}
+	case CredentialsAssumeRole:
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return errors.New("assume_role needs access_key_id and secret_access_key to call STS with")
+		}
+	default:
+		return fmt.Errorf("unknown provider %q", cc.Provider)
+	}
+	if cc.Provider == CredentialsWebIdentity || cc.Provider == CredentialsAssumeRole {
+		if err := validateEndpoint(cc.STSEndpoint); err != nil {
+			return fmt.Errorf("sts_endpoint: %w", err)
+		}
+		if d := cc.Duration.Std(); d < 15*time.Minute || d > 12*time.Hour {
+			return fmt.Errorf("duration must be between 15m and 12h, got %s", d)
+		}
+	}
+	return nil
+}
+
+func (t TLSConfig) validate() []error {
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, errors.New("tls: cert_file and key_file must be set together"))
+	}
+	if _, ok := tlsVersions[t.MinVersion]; !ok {
+		errs = append(errs, fmt.Errorf("tls.min_version: unknown version %q, want \"1.2\" or \"1.3\"", t.MinVersion))
+	}
+	for _, name := range t.CipherSuites {
+		if _, ok := cipherSuite(name); !ok {
+			errs = append(errs, fmt.Errorf("tls.cipher_suites: unknown or insecure cipher suite %q", name))
+		}
+	}
+	if t.ClientCAFile != "" && !t.Enabled() {
+		errs = append(errs, errors.New("tls.client_ca_file: needs cert_file and key_file"))
+	}
+	switch t.ClientAuth {
+	case "":
+	case ClientAuthRequire, ClientAuthOptional:
+		if t.ClientCAFile == "" {
+			errs = append(errs, errors.New("tls.client_auth: needs client_ca_file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tls.client_auth: unknown mode %q, want %q or %q", t.ClientAuth, ClientAuthRequire, ClientAuthOptional))
+	}
+	return errs
+}
+
+func (b BackendTLSConfig) validate() error {
+	if (b.CertFile == "") != (b.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+func (p PolicyConfig) validate() error {
+	if p.Effect != EffectAllow && p.Effect != EffectDeny {
+		return fmt.Errorf("unknown effect %q, want %q or %q", p.Effect, EffectAllow, EffectDeny)
+	}
+	if len(p.Principals) == 0 {
+		return errors.New("principals must not be empty")
+	}
+	if len(p.Actions) == 0 {
+		return errors.New("actions must not be empty")
+	}
+	for _, action := range p.Actions {
+		if !strings.Contains(action, "*") && !containsFold(Actions, action) {
+			return fmt.Errorf("unknown action %q", action)
+		}
+	}
+	return nil
+}
+
+func (c RateLimitConfig) validate() []error {
+	var errs []error
+	check := func(path string, limit RateLimit) {
+		if limit.RequestsPerSecond < 0 || limit.Burst < 0 || limit.BytesPerSecond < 0 || limit.BurstBytes < 0 || limit.MaxConcurrent < 0 {
+			errs = append(errs, fmt.Errorf("%s: limits must not be negative", path))
+		}
+	}
+	checkOperations := func(path string, limits map[string]RateLimit) {
+		for _, op := range slices.Sorted(maps.Keys(limits)) {
+			if !slices.Contains(RateLimitOperations, op) {
+				errs = append(errs, fmt.Errorf("%s: unknown operation %q, want one of %s", path, op, strings.Join(RateLimitOperations, ", ")))
+			}
+			check(path+"."+op, limits[op])
+		}
+	}
+
+	check("rate_limit.default", c.Default)
+	checkOperations("rate_limit.operations", c.Operations)
+	for _, tenant := range slices.Sorted(maps.Keys(c.Tenants)) {
+		t := c.Tenants[tenant]
+		if t.Default != nil {
+			check("rate_limit.tenants."+tenant+".default", *t.Default)
+		}
+		checkOperations("rate_limit.tenants."+tenant+".operations", t.Operations)
+	}
+	return errs
+}
+
+func (a AdmissionConfig) validate() []error {
+	var errs []error
+	check := func(path string, l ConcurrencyLimit) {
+		if l.MinLimit < 1 || l.MaxLimit < l.MinLimit {
+			errs = append(errs, fmt.Errorf("%s: need 1 <= min_limit <= max_limit, got %d and %d", path, l.MinLimit, l.MaxLimit))
+		}
+	}
+	check("admission.global", a.Global)
+	check("admission.per_shard", a.PerShard)
+	if a.BackoffRatio <= 0 || a.BackoffRatio >= 1 {
+		errs = append(errs, fmt.Errorf("admission.backoff_ratio: must be between 0 and 1, got %g", a.BackoffRatio))
+	}
+	if a.MaxQueue < 0 {
+		errs = append(errs, fmt.Errorf("admission.max_queue: must not be negative, got %d", a.MaxQueue))
+	}
+	return errs
+}
+
+func (u UsageConfig) validate() []error {
+	var errs []error
+	if u.RescanInterval < 0 {
+		errs = append(errs, errors.New("usage.rescan_interval: must not be negative"))
+	}
+	if u.DefaultQuota.MaxBytes < 0 {
+		errs = append(errs, errors.New("usage.default_quota.max_bytes: must not be negative"))
+	}
+	for _, tenant := range slices.Sorted(maps.Keys(u.Quotas)) {
+		if u.Quotas[tenant].MaxBytes < 0 {
+			errs = append(errs, fmt.Errorf("usage.quotas.%s.max_bytes: must not be negative", tenant))
+		}
+	}
+	return errs
+}
+
+func (l LifecycleConfig) validate() []error {
+	var errs []error
+	if l.Interval < 0 {
+		errs = append(errs, errors.New("lifecycle.interval: must not be negative"))
+	}
+	if l.LeaseDuration < 0 {
+		errs = append(errs, errors.New("lifecycle.lease_duration: must not be negative"))
+	}
+	seen := make(map[string]bool, len(l.Rules))
+	for i, rule := range l.Rules {
+		path := fmt.Sprintf("lifecycle.rules[%d]", i)
+		switch {
+		case rule.ID == "":
+			errs = append(errs, fmt.Errorf("%s: id is required", path))
+		case seen[rule.ID]:
+			errs = append(errs, fmt.Errorf("%s: duplicate id %q", path, rule.ID))
+		}
+		seen[rule.ID] = true
+		if strings.Contains(rule.Tenant, "/") {
+			errs = append(errs, fmt.Errorf("%s: tenant must not contain /", path))
+		}
+		if rule.ExpireAfter < 0 || rule.AbortIncompleteUploadsAfter < 0 {
+			errs = append(errs, fmt.Errorf("%s: ages must not be negative", path))
+		}
+		if rule.ExpireAfter == 0 && rule.AbortIncompleteUploadsAfter == 0 {
+			errs = append(errs, fmt.Errorf("%s: needs expire_after or abort_incomplete_uploads_after", path))
+		}
+	}
+	return errs
+}
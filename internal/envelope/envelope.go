@@ -0,0 +1,315 @@
+// Package envelope implements envelope encryption of objects. Each object
+// is encrypted with its own random data key using AES-256-GCM in
+// fixed-size chunks, so any range can be decrypted without reading the
+// whole object. The data key is stored with the object, wrapped by a
+// master key from a Keyring.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// KeySize is the size of master and data keys in bytes.
+	KeySize = 32
+	// Overhead is the number of bytes encryption adds to every chunk.
+	Overhead = 16
+)
+
+var (
+	// ErrUnknownKey is returned when unwrapping a data key with a master
+	// key the keyring does not hold.
+	ErrUnknownKey = errors.New("unknown master key")
+	// ErrDecrypt is returned when a wrapped key or a chunk fails
+	// authentication.
+	ErrDecrypt = errors.New("decryption failed")
+)
+
+// ParseKey decodes a master key written as 64 hex digits or as base64.
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("master key must be %d bytes, hex or base64 encoded", KeySize)
+}
+
+// Keyring holds master keys by ID. It is safe for concurrent use.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring from master keys by ID. active names the key
+// that wraps new data keys; the others only unwrap existing ones.
+func NewKeyring(keys map[string][]byte, active string) (*Keyring, error) {
+	k := &Keyring{active: active, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("master key %q: %w", id, err)
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[active]; !ok {
+		return nil, fmt.Errorf("active master key %q is not configured", active)
+	}
+	return k, nil
+}
+
+// ActiveKey returns the ID of the master key that wraps new data keys.
+func (k *Keyring) ActiveKey() string {
+	return k.active
+}
+
+// NewDataKey generates a data key and returns it along with its wrapped
+// form, which is bound to the ID of the active master key and to aad. The
+// same aad must be passed to Unwrap.
+func (k *Keyring) NewDataKey(aad []byte) (dataKey, wrapped []byte, err error) {
+	dataKey = make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return dataKey, aead.Seal(nonce, nonce, dataKey, wrapAAD(k.active, aad)), nil
+}
+
+// Unwrap recovers a data key wrapped by the master key keyID with aad.
+func (k *Keyring) Unwrap(keyID string, wrapped, aad []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, wrapAAD(keyID, aad))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return dataKey, nil
+}
+
+// EncryptedSize returns the stored size of size bytes of plaintext, or -1
+// if size is -1.
+func EncryptedSize(size, chunkSize int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	return size + max(chunks(size, chunkSize), 1)*Overhead
+}
+
+// PlaintextSize returns the plaintext size of size bytes of ciphertext.
+func PlaintextSize(size, chunkSize int64) int64 {
+	return size - chunks(size, chunkSize+Overhead)*Overhead
+}
+
+// wrapAAD binds a wrapped data key to its master key's ID and to the
+// caller's aad, length prefixed so that the two cannot be confused.
+func wrapAAD(keyID string, aad []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(keyID)))
+	out = append(out, keyID...)
+	return append(out, aad...)
+}
+
+func chunks(size, chunkSize int64) int64 {
+	return (size + chunkSize - 1) / chunkSize
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce derives chunk i's nonce. Data keys are never reused across
+// objects, so the chunk index alone keeps nonces unique.
+func chunkNonce(i int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(i))
+	return nonce
+}
+
+// chunkAAD binds a chunk to its position and marks the final chunk, so
+// chunks cannot be reordered and truncation at a chunk boundary is caught.
+func chunkAAD(i int64, last bool) []byte {
+	aad := binary.BigEndian.AppendUint64(nil, uint64(i))
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// Encrypter reads plaintext from an underlying reader and yields
+// ciphertext. The final chunk is always written, even if empty, so an
+// empty object is authenticated like any other.
+type Encrypter struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	chunkSize int64
+	size      int64
+	read      int64
+	next      int64
+	done      bool
+	// plain holds one byte beyond the chunk being sealed, so the last
+	// chunk is known before it is sealed; carry is 1 if it was read.
+	plain  []byte
+	carry  int
+	sealed []byte
+	buf    []byte
+}
+
+// NewEncrypter returns a reader of the plaintext read from r encrypted with
+// dataKey. size is the plaintext size, or -1 to encrypt r up to EOF.
+func NewEncrypter(r io.Reader, dataKey []byte, chunkSize, size int64) (*Encrypter, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	return &Encrypter{
+		r:         r,
+		aead:      aead,
+		chunkSize: chunkSize,
+		size:      size,
+		plain:     make([]byte, chunkSize+1),
+	}, nil
+}
+
+func (e *Encrypter) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+// seal reads and encrypts the next chunk.
+func (e *Encrypter) seal() error {
+	n, err := io.ReadFull(e.r, e.plain[e.carry:])
+	n += e.carry
+	switch {
+	case err == nil:
+		n = int(e.chunkSize)
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		e.done = true
+	default:
+		return err
+	}
+	e.read += int64(n)
+	if e.done && e.size >= 0 && e.read != e.size {
+		return io.ErrUnexpectedEOF
+	}
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.next), e.plain[:n], chunkAAD(e.next, e.done))
+	e.buf = e.sealed
+	e.next++
+	if !e.done {
+		e.plain[0] = e.plain[e.chunkSize]
+		e.carry = 1
+	}
+	return nil
+}
+
+// Decrypter reads ciphertext from an underlying reader and yields
+// plaintext.
+type Decrypter struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	chunkSize int64
+	count     int64
+	next      int64
+	sealed    []byte
+	plain     []byte
+	buf       []byte
+}
+
+// NewDecrypter returns a reader of the plaintext of the chunks read from
+// r, which must start at the beginning of chunk first. size is the
+// plaintext size of the whole object. The first chunk is decrypted before
+// NewDecrypter returns, so a wrong key or corrupt data is reported early.
+func NewDecrypter(r io.Reader, dataKey []byte, chunkSize, size, first int64) (*Decrypter, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	d := &Decrypter{
+		r:         r,
+		aead:      aead,
+		chunkSize: chunkSize,
+		count:     max(chunks(size, chunkSize), 1),
+		next:      first,
+		sealed:    make([]byte, chunkSize+Overhead),
+	}
+	if d.next < d.count {
+		if err := d.fill(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *Decrypter) Read(p []byte) (int, error) {
+	if len(d.buf) == 0 {
+		if d.next >= d.count {
+			return 0, io.EOF
+		}
+		if err := d.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *Decrypter) fill() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := d.next == d.count-1
+	if err == io.ErrUnexpectedEOF && last {
+		err = nil
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(d.next), d.sealed[:n], chunkAAD(d.next, last))
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.plain = plain
+	d.buf = plain
+	d.next++
+	return nil
+}
@@ -0,0 +1,199 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+const testChunkSize = 64
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// encrypt returns data encrypted with dataKey. A size of -1 encrypts data
+// as a stream of unknown length.
+func encrypt(t *testing.T, dataKey, data []byte, size int64) []byte {
+	t.Helper()
+	e, err := NewEncrypter(bytes.NewReader(data), dataKey, testChunkSize, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+// decrypt decrypts sealed from chunk first on, taking the plaintext size
+// from the ciphertext's size as the proxy does.
+func decrypt(dataKey, sealed []byte, first int64) ([]byte, error) {
+	size := PlaintextSize(int64(len(sealed)), testChunkSize)
+	offset := min(first*(testChunkSize+Overhead), int64(len(sealed)))
+	d, err := NewDecrypter(bytes.NewReader(sealed[offset:]), dataKey, testChunkSize, size, first)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(d)
+}
+
+func TestRoundTrip(t *testing.T) {
+	dataKey := newKey(t)
+	for _, size := range []int{0, 1, testChunkSize - 1, testChunkSize, 3 * testChunkSize, 3*testChunkSize + 1} {
+		for _, streamed := range []bool{false, true} {
+			data := make([]byte, size)
+			rand.Read(data)
+			encryptSize := int64(size)
+			if streamed {
+				encryptSize = -1
+			}
+			sealed := encrypt(t, dataKey, data, encryptSize)
+			if want := EncryptedSize(int64(size), testChunkSize); int64(len(sealed)) != want {
+				t.Fatalf("size %d, streamed %v: %d bytes of ciphertext, want %d", size, streamed, len(sealed), want)
+			}
+			if got := PlaintextSize(int64(len(sealed)), testChunkSize); got != int64(size) {
+				t.Fatalf("size %d: plaintext size of the ciphertext is %d", size, got)
+			}
+			got, err := decrypt(dataKey, sealed, 0)
+			if err != nil {
+				t.Fatalf("size %d, streamed %v: %v", size, streamed, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("size %d, streamed %v: decrypted different bytes", size, streamed)
+			}
+		}
+	}
+}
+
+func TestEncryptShortInput(t *testing.T) {
+	e, err := NewEncrypter(bytes.NewReader(make([]byte, 10)), newKey(t), testChunkSize, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(e); err != io.ErrUnexpectedEOF {
+		t.Fatalf("input shorter than its size got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDecryptFromChunk(t *testing.T) {
+	dataKey := newKey(t)
+	data := make([]byte, 3*testChunkSize+10)
+	rand.Read(data)
+	sealed := encrypt(t, dataKey, data, int64(len(data)))
+
+	for first := int64(1); first <= 3; first++ {
+		got, err := decrypt(dataKey, sealed, first)
+		if err != nil {
+			t.Fatalf("from chunk %d: %v", first, err)
+		}
+		if !bytes.Equal(got, data[first*testChunkSize:]) {
+			t.Fatalf("from chunk %d: decrypted different bytes", first)
+		}
+	}
+	// A range past the last chunk reads nothing
+	if got, err := decrypt(dataKey, sealed, 4); err != nil || len(got) != 0 {
+		t.Fatalf("past the end got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	dataKey := newKey(t)
+	data := make([]byte, 3*testChunkSize)
+	rand.Read(data)
+	sealed := encrypt(t, dataKey, data, int64(len(data)))
+	stored := testChunkSize + Overhead
+
+	swapped := bytes.Clone(sealed)
+	copy(swapped[:stored], sealed[stored:2*stored])
+	copy(swapped[stored:2*stored], sealed[:stored])
+
+	flipped := bytes.Clone(sealed)
+	flipped[stored+3] ^= 1
+
+	for _, tc := range []struct {
+		name   string
+		sealed []byte
+	}{
+		// The new last chunk was not sealed as the last
+		{"truncated at a chunk boundary", sealed[:2*stored]},
+		{"chunks swapped", swapped},
+		{"bit flipped", flipped},
+		{"short last chunk", sealed[:len(sealed)-1]},
+	} {
+		if _, err := decrypt(dataKey, tc.sealed, 0); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: got %v, want ErrDecrypt", tc.name, err)
+		}
+	}
+
+	if _, err := decrypt(newKey(t), sealed, 0); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("wrong data key got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	oldKey, newMaster := newKey(t), newKey(t)
+	before, err := NewKeyring(map[string][]byte{"old": oldKey}, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aad := []byte("bucket/tenant/block")
+	dataKey, wrapped, err := before.NewDataKey(aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After rotation, keys wrapped by the old master key still unwrap
+	rotated, err := NewKeyring(map[string][]byte{"old": oldKey, "new": newMaster}, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ActiveKey() != "new" {
+		t.Fatalf("active key %q after rotation", rotated.ActiveKey())
+	}
+	got, err := rotated.Unwrap("old", wrapped, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Fatal("unwrapped a different data key")
+	}
+
+	retired, err := NewKeyring(map[string][]byte{"new": newMaster}, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := retired.Unwrap("old", wrapped, aad); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("unwrap with a retired master key got %v, want ErrUnknownKey", err)
+	}
+
+	// The same master key under another ID does not unwrap it
+	renamed, err := NewKeyring(map[string][]byte{"other": oldKey}, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		keyring *Keyring
+		keyID   string
+		aad     []byte
+	}{
+		{"aad mismatch", rotated, "old", []byte("bucket/tenant/other")},
+		{"key ID mismatch", renamed, "other", aad},
+	} {
+		if _, err := tc.keyring.Unwrap(tc.keyID, wrapped, tc.aad); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: got %v, want ErrDecrypt", tc.name, err)
+		}
+	}
+	if _, err := rotated.Unwrap("old", wrapped[:4], aad); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("short wrapped key got %v, want ErrDecrypt", err)
+	}
+}
@@ -73,6 +73,33 @@ func (ch *ConsistentHash) GetBucket(key string) string {
 	return ch.hashMap[ch.keys[idx]]
 }
 
+// GetBuckets returns up to n distinct buckets for key, starting at the
+// bucket owning key and walking clockwise around the ring.
+func (ch *ConsistentHash) GetBuckets(key string, n int) []string {
+	if len(ch.keys) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(ch.buckets) {
+		n = len(ch.buckets)
+	}
+
+	hash := ch.hash(ch.extractHashKey(key))
+	idx := sort.Search(len(ch.keys), func(i int) bool {
+		return ch.keys[i] >= hash
+	})
+
+	result := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(ch.keys) && len(result) < n; i++ {
+		bucket := ch.hashMap[ch.keys[(idx+i)%len(ch.keys)]]
+		if !seen[bucket] {
+			seen[bucket] = true
+			result = append(result, bucket)
+		}
+	}
+	return result
+}
+
 func (ch *ConsistentHash) GetAllBuckets() []string {
 	return ch.buckets
 }
\ No newline at end of file
@@ -95,4 +95,360 @@ var (
 		},
 		[]string{"bucket"},
 	)
+
+	// Circuit breaker metrics
+	CircuitBreakerState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_circuit_breaker_state",
+			Help: "Current circuit breaker state per bucket (0=closed, 1=half-open, 2=open)",
+		},
+		[]string{"bucket"},
+	)
+
+	CircuitBreakerTransitionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_circuit_breaker_transitions_total",
+			Help: "Total number of circuit breaker state changes per bucket",
+		},
+		[]string{"bucket", "from", "to"},
+	)
+
+	CircuitBreakerRejectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_circuit_breaker_rejections_total",
+			Help: "Total number of backend calls rejected by an open circuit breaker",
+		},
+		[]string{"operation", "bucket"},
+	)
+
+	// Aborted requests, split by whether the client went away or the
+	// backend exceeded its operation timeout
+	RequestAbortsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_request_aborts_total",
+			Help: "Total number of requests aborted by client cancellation or backend timeout",
+		},
+		[]string{"operation", "bucket", "reason"},
+	)
+
+	// Retry and hedging metrics
+	BackendRetriesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_backend_retries_total",
+			Help: "Total number of retried backend operations",
+		},
+		[]string{"operation", "bucket"},
+	)
+
+	HedgedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_hedged_requests_total",
+			Help: "Total number of hedged GETs by which attempt answered first",
+		},
+		[]string{"bucket", "winner"},
+	)
+
+	// Replication metrics
+	ReplicaWriteFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_replica_write_failures_total",
+			Help: "Total number of replica writes that failed",
+		},
+		[]string{"operation", "bucket"},
+	)
+
+	ReplicaReadFailoversTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_replica_read_failovers_total",
+			Help: "Total number of reads served by a replica other than the primary",
+		},
+		[]string{"operation", "bucket"},
+	)
+
+	ReadRepairsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_read_repairs_total",
+			Help: "Total number of replicas restored by read repair",
+		},
+		[]string{"bucket", "status"},
+	)
+
+	// Erasure coding metrics
+	ErasurePieceFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_erasure_piece_failures_total",
+			Help: "Total number of erasure-coded piece reads, writes and deletes that failed",
+		},
+		[]string{"operation", "bucket"},
+	)
+
+	ErasureReconstructionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_erasure_reconstructions_total",
+			Help: "Total number of stripes decoded using parity because data pieces were unavailable",
+		},
+		[]string{"bucket"},
+	)
+
+	// Object cache metrics
+	CacheHitsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_cache_hits_total",
+			Help: "Total number of GETs served from the object cache by tier",
+		},
+		[]string{"tier"},
+	)
+
+	CacheMissesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_cache_misses_total",
+			Help: "Total number of cacheable GETs not served from the object cache by reason",
+		},
+		[]string{"reason"},
+	)
+
+	CacheEvictionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_cache_evictions_total",
+			Help: "Total number of entries evicted from the object cache by tier",
+		},
+		[]string{"tier"},
+	)
+
+	StatCacheRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_stat_cache_requests_total",
+			Help: "Total number of metadata lookups by stat cache result",
+		},
+		[]string{"result"},
+	)
+
+	ListCacheRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_list_cache_requests_total",
+			Help: "Total number of LIST requests by list cache result",
+		},
+		[]string{"result"},
+	)
+
+	ListCacheRefreshesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_list_cache_refreshes_total",
+			Help: "Total number of background list cache refreshes by status",
+		},
+		[]string{"status"},
+	)
+
+	CoalescedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_coalesced_requests_total",
+			Help: "Total number of requests answered from another in-flight identical request",
+		},
+		[]string{"operation"},
+	)
+
+	CompressionLogicalBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_compression_logical_bytes_total",
+			Help: "Total uncompressed bytes of objects stored compressed, per bucket",
+		},
+		[]string{"bucket", "codec"},
+	)
+
+	CompressionStoredBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_compression_stored_bytes_total",
+			Help: "Total bytes stored for compressed objects, per bucket",
+		},
+		[]string{"bucket", "codec"},
+	)
+
+	CompressionRatio = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tempo_s3_shard_compression_ratio",
+			Help:    "Ratio of uncompressed to stored size of compressed objects",
+			Buckets: []float64{1, 1.25, 1.5, 2, 3, 4, 6, 8, 12, 16},
+		},
+		[]string{"bucket", "codec"},
+	)
+
+	CompressionSkippedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_compression_skipped_total",
+			Help: "Total number of objects selected for compression that were stored uncompressed because compression did not reduce their size",
+		},
+		[]string{"codec"},
+	)
+
+	EncryptionOperationsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_encryption_operations_total",
+			Help: "Total number of objects encrypted or decrypted, by master key",
+		},
+		[]string{"operation", "key_id"},
+	)
+
+	DecryptionFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_decryption_failures_total",
+			Help: "Total number of data keys or chunks that failed to decrypt, by master key",
+		},
+		[]string{"key_id"},
+	)
+
+	ConfigInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_config_info",
+			Help: "Always 1, labelled with the hash of the currently loaded config",
+		},
+		[]string{"hash"},
+	)
+
+	ConfigReloadsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_config_reloads_total",
+			Help: "Total number of config reloads, by result (success, failure)",
+		},
+		[]string{"result"},
+	)
+
+	ConfigLastReloadSuccessful = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_config_last_reload_successful",
+			Help: "Whether the last config reload succeeded (1) or failed (0)",
+		},
+	)
+
+	CredentialRetrievalsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_credential_retrievals_total",
+			Help: "Total number of backend credential retrievals, by provider and result (success, failure)",
+		},
+		[]string{"provider", "result"},
+	)
+
+	CredentialExpiry = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_credential_expiry_timestamp_seconds",
+			Help: "Expiry time of the current temporary backend credentials, as a Unix timestamp",
+		},
+		[]string{"provider"},
+	)
+
+	AccessDeniedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_access_denied_total",
+			Help: "Total number of requests denied by the authorization policies",
+		},
+		[]string{"action"},
+	)
+
+	ThrottledRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_throttled_requests_total",
+			Help: "Total number of requests rejected by the rate limits, by tenant, operation and limit (requests, bytes, concurrency)",
+		},
+		[]string{"tenant", "operation", "reason"},
+	)
+
+	InFlightRequests = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_in_flight_requests",
+			Help: "Number of client requests being served",
+		},
+	)
+
+	AdmissionLimit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_admission_limit",
+			Help: "Current adaptive concurrency limit of backend calls, by scope (global or shard bucket)",
+		},
+		[]string{"scope"},
+	)
+
+	AdmissionInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_admission_in_flight",
+			Help: "Number of backend calls holding an admission slot, by scope",
+		},
+		[]string{"scope"},
+	)
+
+	AdmissionQueued = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_admission_queued",
+			Help: "Number of backend calls waiting for an admission slot, by scope",
+		},
+		[]string{"scope"},
+	)
+
+	AdmissionRejectedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_admission_rejected_total",
+			Help: "Total number of backend calls rejected by admission control, by scope and reason (queue_full, timeout)",
+		},
+		[]string{"scope", "reason"},
+	)
+
+	UsageBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_usage_bytes",
+			Help: "Bytes stored per tenant and shard bucket, including replicas and erasure pieces. Tenants without a quota are summed as other",
+		},
+		[]string{"tenant", "bucket"},
+	)
+
+	UsageObjects = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_usage_objects",
+			Help: "Backend objects stored per tenant and shard bucket. Tenants without a quota are summed as other",
+		},
+		[]string{"tenant", "bucket"},
+	)
+
+	UsageLastScan = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_usage_last_scan_timestamp_seconds",
+			Help: "Time the last usage scan of a shard bucket completed, as a Unix timestamp",
+		},
+		[]string{"bucket"},
+	)
+
+	QuotaExceededTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_quota_exceeded_total",
+			Help: "Total number of PUTs rejected because the tenant's quota was exceeded",
+		},
+		[]string{"tenant"},
+	)
+
+	LifecycleExpiredObjectsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_lifecycle_expired_objects_total",
+			Help: "Total number of objects expired by lifecycle rules, by rule and result (success, error, dry_run)",
+		},
+		[]string{"rule", "result"},
+	)
+
+	LifecycleAbortedUploadsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tempo_s3_shard_lifecycle_aborted_uploads_total",
+			Help: "Total number of incomplete multipart uploads aborted by lifecycle rules, by rule and result (success, error, dry_run)",
+		},
+		[]string{"rule", "result"},
+	)
+
+	LifecycleLastRun = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_lifecycle_last_run_timestamp_seconds",
+			Help: "Time the last lifecycle run completed, as a Unix timestamp",
+		},
+	)
+
+	LifecycleLeader = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tempo_s3_shard_lifecycle_leader",
+			Help: "Whether this replica holds the lifecycle lease and runs the lifecycle worker (0 or 1)",
+		},
+	)
 )
\ No newline at end of file
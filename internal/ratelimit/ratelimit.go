@@ -0,0 +1,186 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limits bounds the requests admitted by a Limiter. Zero fields are
+// unlimited.
+type Limits struct {
+	// RequestsPerSecond refills a bucket of Burst requests.
+	RequestsPerSecond float64
+	Burst             int
+	// BytesPerSecond refills a bucket of BurstBytes bytes. A request is
+	// admitted while the bucket is not empty and its bytes are taken even
+	// if that leaves the bucket in debt, so objects larger than the burst
+	// still get through, followed by a pause proportional to their size.
+	BytesPerSecond float64
+	BurstBytes     int64
+	MaxConcurrent  int
+}
+
+// withDefaults fills in unset bursts from the rates.
+func (l Limits) withDefaults() Limits {
+	if l.Burst <= 0 {
+		l.Burst = int(math.Max(1, math.Ceil(l.RequestsPerSecond)))
+	}
+	if l.BurstBytes <= 0 {
+		l.BurstBytes = int64(l.BytesPerSecond)
+	}
+	return l
+}
+
+// Reason says which limit throttled a request.
+type Reason string
+
+const (
+	ReasonRequests    Reason = "requests"
+	ReasonBytes       Reason = "bytes"
+	ReasonConcurrency Reason = "concurrency"
+)
+
+// Limiter applies Limits to one stream of requests, such as those of one
+// tenant for one operation. The limits are passed on every call, so that
+// they can change without losing the limiter's state.
+type Limiter struct {
+	mu       sync.Mutex
+	limits   Limits
+	requests bucket
+	bytes    bucket
+	inFlight int
+	lastUsed time.Time
+}
+
+// bucket is a token bucket that may go into debt.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *bucket) refill(now time.Time, rate, burst float64) {
+	if b.updated.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+rate*now.Sub(b.updated).Seconds())
+	}
+	b.updated = now
+}
+
+// wait returns how long until the bucket holds need tokens.
+func (b *bucket) wait(rate, need float64) time.Duration {
+	return time.Duration((need - b.tokens) / rate * float64(time.Second))
+}
+
+// Acquire admits a request that will transfer bytes, which may be zero if
+// not known in advance. If the request is throttled it returns the limit
+// that was hit and how long to wait before retrying; otherwise the request
+// must call Release when done.
+func (l *Limiter) Acquire(limits Limits, bytes int64) (ok bool, reason Reason, retryAfter time.Duration) {
+	limits = limits.withDefaults()
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	l.lastUsed = now
+
+	if limits.MaxConcurrent > 0 && l.inFlight >= limits.MaxConcurrent {
+		return false, ReasonConcurrency, time.Second
+	}
+	if limits.RequestsPerSecond > 0 {
+		l.requests.refill(now, limits.RequestsPerSecond, float64(limits.Burst))
+		if l.requests.tokens < 1 {
+			return false, ReasonRequests, l.requests.wait(limits.RequestsPerSecond, 1)
+		}
+	}
+	if limits.BytesPerSecond > 0 {
+		l.bytes.refill(now, limits.BytesPerSecond, float64(limits.BurstBytes))
+		if l.bytes.tokens <= 0 {
+			// Wait until the debt is paid and a little more is available
+			return false, ReasonBytes, l.bytes.wait(limits.BytesPerSecond, 1)
+		}
+	}
+
+	if limits.RequestsPerSecond > 0 {
+		l.requests.tokens--
+	}
+	if limits.BytesPerSecond > 0 {
+		l.bytes.tokens -= float64(bytes)
+	}
+	l.inFlight++
+	return true, "", 0
+}
+
+// Release ends a request admitted by Acquire, taking extra bytes that it
+// transferred beyond those passed to Acquire, such as a response body.
+func (l *Limiter) Release(extraBytes int64) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.lastUsed = now
+	if l.limits.BytesPerSecond > 0 && extraBytes > 0 {
+		l.bytes.refill(now, l.limits.BytesPerSecond, float64(l.limits.BurstBytes))
+		l.bytes.tokens -= float64(extraBytes)
+	}
+}
+
+// idle reports whether the limiter holds no state that a new limiter would
+// not: no requests in flight and full buckets.
+func (l *Limiter) idle(now time.Time, after time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight > 0 || now.Sub(l.lastUsed) < after {
+		return false
+	}
+	full := func(b bucket, rate, burst float64) bool {
+		return rate <= 0 || b.updated.IsZero() || b.tokens+rate*now.Sub(b.updated).Seconds() >= burst
+	}
+	return full(l.requests, l.limits.RequestsPerSecond, float64(l.limits.Burst)) &&
+		full(l.bytes, l.limits.BytesPerSecond, float64(l.limits.BurstBytes))
+}
+
+// Set holds a Limiter per key. Limiters idle for longer than the idle
+// timeout are dropped, so keys taken from requests do not accumulate.
+type Set struct {
+	idleTimeout time.Duration
+
+	mu        sync.Mutex
+	limiters  map[string]*Limiter
+	lastSweep time.Time
+}
+
+func NewSet(idleTimeout time.Duration) *Set {
+	return &Set{
+		idleTimeout: idleTimeout,
+		limiters:    make(map[string]*Limiter),
+		lastSweep:   time.Now(),
+	}
+}
+
+// Get returns the limiter for key, creating it if needed.
+func (s *Set) Get(key string) *Limiter {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) >= s.idleTimeout {
+		for k, l := range s.limiters {
+			if l.idle(now, s.idleTimeout) {
+				delete(s.limiters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	l, ok := s.limiters[key]
+	if !ok {
+		l = &Limiter{}
+		s.limiters[key] = l
+	}
+	// Marked used while s.mu is held, so that a sweep cannot drop the
+	// limiter before the caller acquires it
+	l.mu.Lock()
+	l.lastUsed = now
+	l.mu.Unlock()
+	return l
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefill(t *testing.T) {
+	var l Limiter
+	limits := Limits{RequestsPerSecond: 20, Burst: 2}
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := l.Acquire(limits, 0); !ok {
+			t.Fatalf("request %d within the burst throttled", i)
+		}
+		l.Release(0)
+	}
+	ok, reason, retryAfter := l.Acquire(limits, 0)
+	if ok || reason != ReasonRequests {
+		t.Fatalf("request beyond the burst got %v, %q", ok, reason)
+	}
+	if retryAfter <= 0 || retryAfter > 50*time.Millisecond {
+		t.Fatalf("retry after %v, want at most one token's refill time", retryAfter)
+	}
+
+	time.Sleep(retryAfter + 10*time.Millisecond)
+	if ok, _, _ := l.Acquire(limits, 0); !ok {
+		t.Fatal("request throttled after the bucket refilled")
+	}
+}
+
+func TestByteDebt(t *testing.T) {
+	var l Limiter
+	limits := Limits{BytesPerSecond: 1000}
+	if ok, _, _ := l.Acquire(limits, 5000); !ok {
+		t.Fatal("request larger than the burst refused while the bucket was full")
+	}
+	l.Release(0)
+
+	ok, reason, retryAfter := l.Acquire(limits, 0)
+	if ok || reason != ReasonBytes {
+		t.Fatalf("request while in debt got %v, %q", ok, reason)
+	}
+	// 4000 bytes of debt take four seconds to pay back at 1000 per second
+	if retryAfter < 3900*time.Millisecond || retryAfter > 4100*time.Millisecond {
+		t.Fatalf("retry after %v, want about 4s", retryAfter)
+	}
+
+	// Bytes transferred beyond those known up front add to the debt
+	var m Limiter
+	if ok, _, _ := m.Acquire(limits, 0); !ok {
+		t.Fatal("first request throttled")
+	}
+	m.Release(3000)
+	if _, _, retryAfter := m.Acquire(limits, 0); retryAfter < 1900*time.Millisecond {
+		t.Fatalf("retry after %v for 2000 bytes of debt, want about 2s", retryAfter)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var l Limiter
+	limits := Limits{MaxConcurrent: 1}
+	if ok, _, _ := l.Acquire(limits, 0); !ok {
+		t.Fatal("first request throttled")
+	}
+	if ok, reason, _ := l.Acquire(limits, 0); ok || reason != ReasonConcurrency {
+		t.Fatalf("second concurrent request got %v, %q", ok, reason)
+	}
+	l.Release(0)
+	if ok, _, _ := l.Acquire(limits, 0); !ok {
+		t.Fatal("request throttled after the first was released")
+	}
+}
+
+func TestIdleSweep(t *testing.T) {
+	const idleTimeout = 50 * time.Millisecond
+	s := NewSet(idleTimeout)
+	limits := Limits{RequestsPerSecond: 1000, Burst: 1}
+
+	idle := s.Get("idle")
+	idle.Acquire(limits, 0)
+	idle.Release(0)
+	busy := s.Get("busy")
+	busy.Acquire(limits, 0)
+
+	time.Sleep(2 * idleTimeout)
+	s.Get("new")
+	if _, ok := s.limiters["idle"]; ok {
+		t.Fatal("idle limiter was kept")
+	}
+	if s.limiters["busy"] != busy {
+		t.Fatal("limiter with a request in flight was dropped")
+	}
+
+	// A limiter still in debt holds state a new one would not
+	indebted := s.Get("indebted")
+	indebted.Acquire(Limits{BytesPerSecond: 1}, 1000)
+	indebted.Release(0)
+	time.Sleep(2 * idleTimeout)
+	s.Get("new")
+	if s.limiters["indebted"] != indebted {
+		t.Fatal("limiter in debt was dropped")
+	}
+}
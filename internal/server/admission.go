@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/admission"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// errOverloaded is returned by callBackend when admission control found no
+// free slot for the call in time.
+var errOverloaded = errors.New("backend overloaded: admission queue full or wait exceeded")
+
+// admissionScopeGlobal labels the metrics of the global limit; the per-shard
+// limits are labeled with their bucket.
+const admissionScopeGlobal = "global"
+
+// admissionControl holds the global and per-shard concurrency limits.
+type admissionControl struct {
+	global  *admission.Limiter
+	shards  *admission.Set
+	maxWait time.Duration
+}
+
+func newAdmission(cfg config.AdmissionConfig) *admissionControl {
+	if !cfg.Enabled {
+		return nil
+	}
+	settings := func(limit config.ConcurrencyLimit) admission.Settings {
+		return admission.Settings{
+			InitialLimit:     limit.InitialLimit,
+			MinLimit:         limit.MinLimit,
+			MaxLimit:         limit.MaxLimit,
+			LatencyThreshold: cfg.LatencyThreshold.Std(),
+			BackoffRatio:     cfg.BackoffRatio,
+			MaxQueue:         cfg.MaxQueue,
+			MaxQueueWait:     cfg.MaxQueueWait.Std(),
+		}
+	}
+	onState := func(scope string, limit float64, inFlight, queued int) {
+		metrics.AdmissionLimit.WithLabelValues(scope).Set(limit)
+		metrics.AdmissionInFlight.WithLabelValues(scope).Set(float64(inFlight))
+		metrics.AdmissionQueued.WithLabelValues(scope).Set(float64(queued))
+	}
+	return &admissionControl{
+		global:  admission.New(admissionScopeGlobal, settings(cfg.Global), onState),
+		shards:  admission.NewSet(settings(cfg.PerShard), onState),
+		maxWait: cfg.MaxQueueWait.Std(),
+	}
+}
+
+// slot is a call admitted by admit. A nil slot, returned while admission
+// control is disabled, does nothing.
+type slot struct {
+	op       string
+	start    time.Time
+	limiters []*admission.Limiter
+	once     sync.Once
+}
+
+// admit waits for a slot for a call to bucket, first from the shard's limit
+// and then from the global one, within a single max_queue_wait. It returns
+// errOverloaded if no slot became free in time. The slot must be released
+// once the call no longer uses its backend connection.
+func (s *TempoS3ShardServer) admit(ctx context.Context, op, bucket string) (*slot, error) {
+	if s.admission == nil {
+		return nil, nil
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, s.admission.maxWait)
+	defer cancel()
+
+	sl := &slot{op: op}
+	scopes := []string{bucket, admissionScopeGlobal}
+	for i, limiter := range []*admission.Limiter{s.admission.shards.Get(bucket), s.admission.global} {
+		if err := limiter.Acquire(waitCtx); err != nil {
+			sl.release()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			reason := "timeout"
+			if errors.Is(err, admission.ErrQueueFull) {
+				reason = "queue_full"
+			}
+			metrics.AdmissionRejectedTotal.WithLabelValues(scopes[i], reason).Inc()
+			s.logger.Debug("Backend call rejected by admission control", "operation", op, "bucket", bucket, "scope", scopes[i], "reason", reason)
+			return nil, fmt.Errorf("%w (%s)", errOverloaded, scopes[i])
+		}
+		sl.limiters = append(sl.limiters, limiter)
+	}
+	sl.start = time.Now()
+	return sl, nil
+}
+
+// observe feeds the outcome of the call to the limits: its latency if it
+// succeeded, or an overload signal if the backend was slow or throttling.
+// Uploads and repairs are not sampled, as their latency depends on the
+// object size.
+func (sl *slot) observe(err error) {
+	if sl == nil {
+		return
+	}
+	switch {
+	case isBackendOverload(err):
+		for _, limiter := range sl.limiters {
+			limiter.Drop()
+		}
+	case err != nil && !isNotFound(err):
+		// Other failures, including cancellations, say nothing about load
+	case sl.op == "put" || sl.op == "repair":
+	default:
+		latency := time.Since(sl.start)
+		for _, limiter := range sl.limiters {
+			limiter.Sample(latency)
+		}
+	}
+}
+
+// release frees the slot. It may be called more than once.
+func (sl *slot) release() {
+	if sl == nil {
+		return
+	}
+	sl.once.Do(func() {
+		for _, limiter := range sl.limiters {
+			limiter.Release()
+		}
+	})
+}
+
+// isBackendOverload reports whether err is the backend timing out or
+// asking clients to slow down.
+func isBackendOverload(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	resp := minio.ToErrorResponse(err)
+	switch resp.Code {
+	case "SlowDown", "ServiceUnavailable", "RequestTimeout", "Throttling":
+		return true
+	}
+	return resp.StatusCode == http.StatusServiceUnavailable
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"cmp"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// policy is a compiled config.PolicyConfig.
+type policy struct {
+	deny       bool
+	principals []*regexp.Regexp
+	actions    []*regexp.Regexp
+	// keys is empty to match every key.
+	keys []*regexp.Regexp
+}
+
+func compilePolicies(cfgs []config.PolicyConfig) []policy {
+	policies := make([]policy, len(cfgs))
+	for i, cfg := range cfgs {
+		policies[i] = policy{
+			deny:       cfg.Effect == config.EffectDeny,
+			principals: compileGlobs(cfg.Principals, false),
+			// Action names are case insensitive, as in IAM
+			actions: compileGlobs(cfg.Actions, true),
+			keys:    compileGlobs(cfg.Keys, false),
+		}
+	}
+	return policies
+}
+
+// compileGlobs compiles patterns in which "*" matches any sequence of
+// characters. Every such pattern is a valid regular expression.
+func compileGlobs(globs []string, foldCase bool) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, len(globs))
+	for i, glob := range globs {
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(glob), `\*`, ".*") + "$"
+		if foldCase {
+			expr = "(?i)" + expr
+		}
+		compiled[i] = regexp.MustCompile(expr)
+	}
+	return compiled
+}
+
+func (p *policy) matches(principal, action, key string) bool {
+	return matchesAny(p.principals, principal) && matchesAny(p.actions, action) &&
+		(len(p.keys) == 0 || matchesAny(p.keys, key))
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether some policy allows principal to perform action on
+// key and none denies it.
+func allowed(policies []policy, principal, action, key string) bool {
+	allow := false
+	for i := range policies {
+		if policies[i].matches(principal, action, key) {
+			if policies[i].deny {
+				return false
+			}
+			allow = true
+		}
+	}
+	return allow
+}
+
+// requestAction returns the S3 action a request performs and the key it
+// applies to, following the dispatch in handleRequest. The action is empty
+// for requests that handleRequest does not serve; authorize denies them.
+func requestAction(r *http.Request, pathParts []string) (action, key string) {
+	// The usage report matches policies by the tenant asked for, and a
+	// report of every tenant only matches keys patterns that match ""
+	if r.URL.Path == usagePath {
+		if r.Method == "GET" {
+			return config.ActionGetUsage, r.URL.Query().Get("tenant")
+		}
+		return "", ""
+	}
+	switch {
+	case len(pathParts) == 0 || pathParts[0] == "":
+		if r.Method == "GET" {
+			return config.ActionListAllMyBuckets, ""
+		}
+		return "", ""
+	case len(pathParts) == 1:
+		if r.Method == "HEAD" {
+			return config.ActionListBucket, ""
+		}
+		if r.Method != "GET" {
+			return "", ""
+		}
+		if _, hasLocation := r.URL.Query()["location"]; hasLocation {
+			return config.ActionGetBucketLocation, ""
+		}
+		if subresource, ok := bucketSubresource(r.URL.Query()); ok {
+			return bucketConfigs[subresource].action, ""
+		}
+		return config.ActionListBucket, r.URL.Query().Get("prefix")
+	}
+
+	key = strings.Join(pathParts[1:], "/")
+	// ?tagging carries no value, so only its presence counts
+	tagging := r.URL.Query().Has("tagging")
+	switch r.Method {
+	case "GET":
+		if tagging {
+			return config.ActionGetObjectTagging, key
+		}
+		return config.ActionGetObject, key
+	case "HEAD":
+		return config.ActionGetObject, key
+	case "PUT":
+		if tagging {
+			return config.ActionPutObjectTagging, key
+		}
+		return config.ActionPutObject, key
+	case "DELETE":
+		return config.ActionDeleteObject, key
+	}
+	return "", ""
+}
+
+// authorize checks the request against the authorization policies. If it
+// is denied, it writes AccessDenied and returns false.
+func (s *TempoS3ShardServer) authorize(w http.ResponseWriter, r *http.Request, pathParts []string) bool {
+	rt := s.runtime()
+	if !rt.config.Authorization.Enabled {
+		return true
+	}
+	action, key := requestAction(r, pathParts)
+	principal := clientIdentity(r)
+	if principal == "" {
+		principal = config.AnonymousPrincipal
+	}
+	// Requests that map to no action are denied, so that a route added
+	// without an action is not left open
+	if action != "" && allowed(rt.policies, principal, action, key) {
+		return true
+	}
+
+	metrics.AccessDeniedTotal.WithLabelValues(cmp.Or(action, "unknown")).Inc()
+	s.logger.Warn("Access denied", "principal", principal, "action", action, "object_key", key, "remote_addr", r.RemoteAddr)
+	writeS3Error(w, r, http.StatusForbidden, "AccessDenied", "Access Denied")
+	return false
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tempo-s3-shard/internal/config"
+)
+
+// splitPath splits a request path as handleRequest does.
+func splitPath(r *http.Request) []string {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+func TestRequestAction(t *testing.T) {
+	for _, tc := range []struct {
+		method, target string
+		action, key    string
+	}{
+		{"GET", "/", config.ActionListAllMyBuckets, ""},
+		{"PUT", "/", "", ""},
+		{"HEAD", "/tempo", config.ActionListBucket, ""},
+		{"GET", "/tempo", config.ActionListBucket, ""},
+		{"GET", "/tempo/?list-type=2&prefix=tenant/", config.ActionListBucket, "tenant/"},
+		{"GET", "/tempo?location", config.ActionGetBucketLocation, ""},
+		{"GET", "/tempo?versioning", config.ActionGetBucketVersioning, ""},
+		{"GET", "/tempo?object-lock", config.ActionGetBucketObjectLockConfiguration, ""},
+		{"PUT", "/tempo", "", ""},
+		{"DELETE", "/tempo", "", ""},
+		{"GET", "/tempo/tenant/block/meta.json", config.ActionGetObject, "tenant/block/meta.json"},
+		{"HEAD", "/tempo/tenant/block/meta.json", config.ActionGetObject, "tenant/block/meta.json"},
+		{"GET", "/tempo/tenant/block?tagging", config.ActionGetObjectTagging, "tenant/block"},
+		{"PUT", "/tempo/tenant/block", config.ActionPutObject, "tenant/block"},
+		{"PUT", "/tempo/tenant/block?tagging", config.ActionPutObjectTagging, "tenant/block"},
+		{"DELETE", "/tempo/tenant/block", config.ActionDeleteObject, "tenant/block"},
+		{"DELETE", "/tempo/tenant/block?tagging", config.ActionDeleteObject, "tenant/block"},
+		{"POST", "/tempo/tenant/block?uploads", "", ""},
+		{"GET", usagePath + "?tenant=X", config.ActionGetUsage, "X"},
+		{"GET", usagePath, config.ActionGetUsage, ""},
+		{"DELETE", usagePath, "", ""},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		action, key := requestAction(r, splitPath(r))
+		if action != tc.action || key != tc.key {
+			t.Errorf("%s %s: got %q on %q, want %q on %q", tc.method, tc.target, action, key, tc.action, tc.key)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	policies := compilePolicies([]config.PolicyConfig{
+		// The distributor writes blocks but never deletes them
+		{Principals: []string{"distributor"}, Actions: []string{"s3:PutObject", "s3:GetObject", "s3:ListBucket"}},
+		{Effect: config.EffectDeny, Principals: []string{"distributor"}, Actions: []string{"s3:DeleteObject"}},
+		// Grafana only reads
+		{Principals: []string{"grafana"}, Actions: []string{"s3:Get*", "s3:ListBucket"}},
+		// Tenant X is confined to its own keys
+		{Principals: []string{"tenant-x"}, Actions: []string{"s3:*"}, Keys: []string{"X/*"}},
+		// The compactor may do anything, except to the audit tenant
+		{Principals: []string{"compactor"}, Actions: []string{"*"}},
+		{Effect: config.EffectDeny, Principals: []string{"*"}, Actions: []string{"s3:DeleteObject"}, Keys: []string{"audit/*"}},
+	})
+
+	for _, tc := range []struct {
+		principal, action, key string
+		want                   bool
+	}{
+		{"distributor", config.ActionPutObject, "X/block", true},
+		{"distributor", config.ActionGetObject, "X/block", true},
+		{"distributor", config.ActionDeleteObject, "X/block", false},
+		{"distributor", config.ActionPutObjectTagging, "X/block", false},
+
+		{"grafana", config.ActionGetObject, "X/block", true},
+		{"grafana", config.ActionGetBucketVersioning, "", true},
+		{"grafana", config.ActionListBucket, "X/", true},
+		{"grafana", config.ActionPutObject, "X/block", false},
+		{"grafana", config.ActionDeleteObject, "X/block", false},
+
+		{"tenant-x", config.ActionGetObject, "X/block/meta.json", true},
+		{"tenant-x", config.ActionPutObject, "X/block/meta.json", true},
+		{"tenant-x", config.ActionListBucket, "X/", true},
+		{"tenant-x", config.ActionListBucket, "X/block/", true},
+		{"tenant-x", config.ActionGetObject, "Y/block/meta.json", false},
+		{"tenant-x", config.ActionListBucket, "", false},
+		{"tenant-x", config.ActionListBucket, "X", false},
+		// Keys are case sensitive
+		{"tenant-x", config.ActionGetObject, "x/block", false},
+
+		// Action names are case insensitive, as in IAM
+		{"grafana", "S3:GETOBJECT", "X/block", true},
+		{"distributor", "s3:deleteobject", "X/block", false},
+
+		// A deny overrides an allow whichever comes first
+		{"compactor", config.ActionDeleteObject, "X/block", true},
+		{"compactor", config.ActionDeleteObject, "audit/block", false},
+		{"compactor", config.ActionGetUsage, "X", true},
+
+		// Principals are matched exactly
+		{"grafana-dev", config.ActionGetObject, "X/block", false},
+		{config.AnonymousPrincipal, config.ActionGetObject, "X/block", false},
+	} {
+		if got := allowed(policies, tc.principal, tc.action, tc.key); got != tc.want {
+			t.Errorf("%s %s on %q: allowed %v, want %v", tc.principal, tc.action, tc.key, got, tc.want)
+		}
+	}
+
+	if allowed(nil, "compactor", config.ActionGetObject, "X/block") {
+		t.Fatal("allowed with no policies")
+	}
+}
+
+func TestAuthorizeDeniesUnmappedRequests(t *testing.T) {
+	s := newTestServer()
+	s.cfg().Authorization = config.AuthorizationConfig{Enabled: true, Policies: []config.PolicyConfig{
+		{Principals: []string{"*"}, Actions: []string{"*"}},
+	}}
+	s.runtime().policies = compilePolicies(s.cfg().Authorization.Policies)
+
+	for _, tc := range []struct {
+		method, target string
+		status         int
+	}{
+		{"GET", "/tempo/X/block", http.StatusOK},
+		{"POST", "/tempo/X/block?uploads", http.StatusForbidden},
+		{"PUT", "/", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		w := httptest.NewRecorder()
+		if ok := s.authorize(w, r, splitPath(r)); ok != (tc.status == http.StatusOK) {
+			t.Errorf("%s %s: authorized %v", tc.method, tc.target, ok)
+		} else if !ok && w.Code != tc.status {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.target, w.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/breaker"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// errShardUnavailable is returned by callBackend when the target shard's
+// circuit breaker is open.
+var errShardUnavailable = errors.New("shard unavailable: circuit breaker open")
+
+func newBreakerSet(cfg config.CircuitBreakerConfig, buckets []string, logger *slog.Logger) *breaker.Set {
+	if !cfg.Enabled {
+		return nil
+	}
+	// Breakers are created on first use; the gauge starts out closed so
+	// that shards appear before their first transition
+	for _, bucket := range buckets {
+		metrics.CircuitBreakerState.WithLabelValues(bucket).Set(float64(breaker.Closed))
+	}
+	settings := breaker.Settings{
+		Window:           cfg.Window.Std(),
+		MinRequests:      cfg.MinRequests,
+		ErrorThreshold:   *cfg.ErrorThreshold,
+		LatencyThreshold: cfg.LatencyThreshold.Std(),
+		OpenDuration:     cfg.OpenDuration.Std(),
+		HalfOpenRequests: cfg.HalfOpenRequests,
+	}
+	return breaker.NewSet(settings, func(bucket string, from, to breaker.State) {
+		metrics.CircuitBreakerState.WithLabelValues(bucket).Set(float64(to))
+		metrics.CircuitBreakerTransitionsTotal.WithLabelValues(bucket, from.String(), to.String()).Inc()
+		if to == breaker.Open {
+			logger.Warn("Circuit breaker opened", "bucket", bucket, "from", from.String())
+		} else {
+			logger.Info("Circuit breaker state changed", "bucket", bucket, "from", from.String(), "to", to.String())
+		}
+	})
+}
+
+// callBackend runs fn against a shard bucket once admission control has a
+// slot for it, guarded by that shard's circuit breaker. It returns
+// errShardUnavailable without calling fn when the breaker is open, and
+// errOverloaded when no slot became free in time.
+func (s *TempoS3ShardServer) callBackend(ctx context.Context, op, bucket string, fn func() error) error {
+	slot, err := s.admit(ctx, op, bucket)
+	if err != nil {
+		return err
+	}
+	defer slot.release()
+	err = s.guardBackend(op, bucket, fn)
+	slot.observe(err)
+	return err
+}
+
+// guardBackend runs fn guarded by the shard's circuit breaker.
+func (s *TempoS3ShardServer) guardBackend(op, bucket string, fn func() error) error {
+	if s.breakers == nil {
+		return fn()
+	}
+
+	b := s.breakers.Get(bucket)
+	generation, ok := b.Allow()
+	if !ok {
+		metrics.CircuitBreakerRejectionsTotal.WithLabelValues(op, bucket).Inc()
+		return errShardUnavailable
+	}
+
+	start := time.Now()
+	err := fn()
+	b.Record(generation, !isBackendFailure(err), time.Since(start))
+	return err
+}
+
+// isBackendFailure reports whether err indicates an unhealthy backend, as
+// opposed to a client-side condition such as a missing key.
+func isBackendFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	resp := minio.ToErrorResponse(err)
+	switch resp.Code {
+	case "SlowDown", "InternalError", "ServiceUnavailable", "RequestTimeout":
+		return true
+	}
+	if resp.StatusCode >= 500 {
+		return true
+	}
+	// Transport errors carry neither an S3 code nor a status code
+	return resp.StatusCode == 0 && resp.Code == ""
+}
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// writeS3Error writes an S3-style XML error response.
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+
+	body, _ := xml.Marshal(s3Error{Code: code, Message: message, Resource: r.URL.Path})
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+// statusClientClosedRequest is the non-standard status recorded when the
+// client disconnects before a response could be written.
+const statusClientClosedRequest = 499
+
+// operationContext derives the context for a backend operation from the
+// client request, bounded by the configured timeout for op. GETs use
+// getContext instead, and listings bound each page request.
+func (s *TempoS3ShardServer) operationContext(r *http.Request, op string) (context.Context, context.CancelFunc) {
+	var timeout config.Duration
+	switch op {
+	case "put":
+		timeout = s.cfg().Timeouts.Put
+	case "delete":
+		timeout = s.cfg().Timeouts.Delete
+	case "get_tagging", "put_tagging":
+		timeout = s.cfg().Timeouts.Tagging
+	default:
+		timeout = s.cfg().Timeouts.Head
+	}
+	if timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), timeout.Std())
+}
+
+// getContext derives the context for a GET from the client request. The
+// get timeout bounds the time to the first byte, not the whole transfer,
+// so that large blocks streamed over slow links are not cut off: calling
+// started once the backend has responded stops the timer.
+func (s *TempoS3ShardServer) getContext(r *http.Request) (ctx context.Context, cancel context.CancelFunc, started func()) {
+	timeout := s.cfg().Timeouts.Get
+	if timeout <= 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, func() {}
+	}
+	inner, cancelCause := context.WithCancelCause(r.Context())
+	timer := time.AfterFunc(timeout.Std(), func() { cancelCause(context.DeadlineExceeded) })
+	cancel = func() {
+		timer.Stop()
+		cancelCause(context.Canceled)
+	}
+	return causeContext{inner}, cancel, func() { timer.Stop() }
+}
+
+// causeContext reports the cause of its cancellation as its error, so that
+// a context ended by a timer reads as DeadlineExceeded, like one ended by a
+// deadline.
+type causeContext struct {
+	context.Context
+}
+
+func (c causeContext) Err() error {
+	if c.Context.Err() == nil {
+		return nil
+	}
+	return context.Cause(c.Context)
+}
+
+// abortReason reports why ctx ended: "client_cancelled" when the client
+// went away, "backend_timeout" when the operation timeout expired, or ""
+// if ctx is still live.
+func abortReason(r *http.Request, ctx context.Context) string {
+	if r.Context().Err() != nil {
+		return "client_cancelled"
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "backend_timeout"
+	}
+	return ""
+}
+
+// handleAborted records and responds to a backend operation that failed
+// because its context ended. It returns false if ctx is still live and the
+// error must be handled by the caller.
+func (s *TempoS3ShardServer) handleAborted(w http.ResponseWriter, r *http.Request, ctx context.Context, op, bucket string, err error) bool {
+	reason := abortReason(r, ctx)
+	if reason == "" {
+		return false
+	}
+	metrics.RequestAbortsTotal.WithLabelValues(op, bucket, reason).Inc()
+	metrics.S3OperationsTotal.WithLabelValues(op, bucket, reason).Inc()
+
+	if reason == "client_cancelled" {
+		s.logger.Debug("Client cancelled request", "operation", op, "bucket", bucket, "path", r.URL.Path)
+		w.WriteHeader(statusClientClosedRequest)
+		return true
+	}
+	s.logger.Warn("Backend operation timed out", "operation", op, "bucket", bucket, "path", r.URL.Path, "error", err)
+	writeS3Error(w, r, http.StatusGatewayTimeout, "RequestTimeout", "The backend did not respond in time")
+	return true
+}
+
+// isUnavailable reports whether err means the request could not be served
+// because shards are failing fast or too few replicas were reachable.
+func isUnavailable(err error) bool {
+	return errors.Is(err, errShardUnavailable) || errors.Is(err, errQuorumNotReached) || errors.Is(err, errOverloaded)
+}
+
+// writeShardUnavailable responds to a request whose shard is failing fast
+// or, if err is errOverloaded, that admission control turned away.
+func writeShardUnavailable(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errOverloaded) {
+		w.Header().Set("Retry-After", "1")
+		writeS3Error(w, r, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+		return
+	}
+	writeS3Error(w, r, http.StatusServiceUnavailable, "ServiceUnavailable", "The backend shard for this request is currently unavailable, please retry")
+}
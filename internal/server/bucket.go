@@ -0,0 +1,160 @@
+package server
+
+import (
+	"cmp"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+
+	"tempo-s3-shard/internal/config"
+)
+
+// virtualBucket is the single bucket the proxy presents to clients.
+const virtualBucket = "proxy-bucket"
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// bucketConfig is how the virtual bucket answers a read of one bucket
+// configuration subresource. It has none of them configured, so each is
+// answered as S3 answers for a bucket without it: with an empty document,
+// or with the not-found error code, which comes with a 404.
+type bucketConfig struct {
+	action  string
+	body    string
+	code    string
+	message string
+}
+
+// bucketConfigs holds the bucket configuration reads that SDKs and tools
+// probe, by query parameter.
+var bucketConfigs = map[string]bucketConfig{
+	"versioning":        {action: config.ActionGetBucketVersioning, body: `<VersioningConfiguration xmlns="` + s3Namespace + `"/>`},
+	"logging":           {action: config.ActionGetBucketLogging, body: `<BucketLoggingStatus xmlns="` + s3Namespace + `"/>`},
+	"notification":      {action: config.ActionGetBucketNotification, body: `<NotificationConfiguration xmlns="` + s3Namespace + `"/>`},
+	"accelerate":        {action: config.ActionGetAccelerateConfiguration, body: `<AccelerateConfiguration xmlns="` + s3Namespace + `"/>`},
+	"requestPayment":    {action: config.ActionGetBucketRequestPayment, body: `<RequestPaymentConfiguration xmlns="` + s3Namespace + `"><Payer>BucketOwner</Payer></RequestPaymentConfiguration>`},
+	"acl":               {action: config.ActionGetBucketAcl, body: ownerACL},
+	"lifecycle":         {action: config.ActionGetLifecycleConfiguration, code: "NoSuchLifecycleConfiguration", message: "The lifecycle configuration does not exist"},
+	"policy":            {action: config.ActionGetBucketPolicy, code: "NoSuchBucketPolicy", message: "The bucket policy does not exist"},
+	"policyStatus":      {action: config.ActionGetBucketPolicyStatus, code: "NoSuchBucketPolicy", message: "The bucket policy does not exist"},
+	"tagging":           {action: config.ActionGetBucketTagging, code: "NoSuchTagSet", message: "The TagSet does not exist"},
+	"cors":              {action: config.ActionGetBucketCORS, code: "NoSuchCORSConfiguration", message: "The CORS configuration does not exist"},
+	"encryption":        {action: config.ActionGetEncryptionConfiguration, code: "ServerSideEncryptionConfigurationNotFoundError", message: "The server side encryption configuration was not found"},
+	"website":           {action: config.ActionGetBucketWebsite, code: "NoSuchWebsiteConfiguration", message: "The specified bucket does not have a website configuration"},
+	"replication":       {action: config.ActionGetReplicationConfiguration, code: "ReplicationConfigurationNotFoundError", message: "The replication configuration was not found"},
+	"object-lock":       {action: config.ActionGetBucketObjectLockConfiguration, code: "ObjectLockConfigurationNotFoundError", message: "Object Lock configuration does not exist for this bucket"},
+	"ownershipControls": {action: config.ActionGetBucketOwnershipControls, code: "OwnershipControlsNotFoundError", message: "The bucket ownership controls were not found"},
+	"publicAccessBlock": {action: config.ActionGetBucketPublicAccessBlock, code: "NoSuchPublicAccessBlockConfiguration", message: "The public access block configuration was not found"},
+}
+
+// ownerACL grants the bucket owner full control, the ACL of a bucket that
+// never had one set.
+const ownerACL = `<AccessControlPolicy xmlns="` + s3Namespace + `">` +
+	`<Owner><ID>tempo-shard-owner</ID><DisplayName>Tempo S3 Shard</DisplayName></Owner>` +
+	`<AccessControlList><Grant>` +
+	`<Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser"><ID>tempo-shard-owner</ID><DisplayName>Tempo S3 Shard</DisplayName></Grantee>` +
+	`<Permission>FULL_CONTROL</Permission>` +
+	`</Grant></AccessControlList></AccessControlPolicy>`
+
+// unsupportedSubresources are query parameters selecting S3 calls the proxy
+// does not implement, such as multipart uploads, versions and ACL writes.
+var unsupportedSubresources = []string{
+	"acl", "analytics", "attributes", "delete", "intelligent-tiering", "inventory",
+	"legal-hold", "metrics", "partNumber", "restore", "retention", "select",
+	"torrent", "uploadId", "uploads", "versionId", "versions",
+}
+
+// bucketSubresource returns the bucket configuration subresource a request
+// reads, if any.
+func bucketSubresource(query url.Values) (string, bool) {
+	for name := range query {
+		if _, ok := bucketConfigs[name]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// isUnsupported reports whether handleRequest has no handler for the
+// request. Bucket configuration reads are supported; every other request
+// naming an unsupported subresource, and every write to a bucket, is not.
+func isUnsupported(r *http.Request, pathParts []string) bool {
+	query := r.URL.Query()
+	isBucket := len(pathParts) <= 1
+	if isBucket && r.Method == "GET" {
+		if _, ok := bucketSubresource(query); ok {
+			return false
+		}
+	}
+	for _, name := range unsupportedSubresources {
+		if query.Has(name) {
+			return true
+		}
+	}
+	switch r.Method {
+	case "GET":
+		return false
+	case "HEAD":
+		return len(pathParts) == 0
+	case "PUT":
+		return isBucket || r.Header.Get("X-Amz-Copy-Source") != ""
+	case "DELETE":
+		return isBucket || query.Has("tagging")
+	}
+	return true
+}
+
+// locationConstraint is the body of a GetBucketLocation response.
+type locationConstraint struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Region  string   `xml:",chardata"`
+}
+
+// locationBody returns the GetBucketLocation response for region.
+func locationBody(region string) []byte {
+	body, _ := xml.Marshal(locationConstraint{Region: region})
+	return append([]byte(xml.Header), body...)
+}
+
+// writeNotImplemented responds to a request isUnsupported rejects.
+func writeNotImplemented(w http.ResponseWriter, r *http.Request) {
+	writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented.")
+}
+
+// writeNoSuchBucket responds to a bucket request for a name other than the
+// virtual bucket.
+func writeNoSuchBucket(w http.ResponseWriter, r *http.Request) {
+	writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+}
+
+// region returns the region the virtual bucket reports: the configured
+// backend region, or us-east-1 if none is set, as S3 assumes.
+func (s *TempoS3ShardServer) region() string {
+	return cmp.Or(s.cfg().Region, "us-east-1")
+}
+
+func (s *TempoS3ShardServer) handleHeadBucket(w http.ResponseWriter, r *http.Request, bucketName string) {
+	if bucketName != virtualBucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Amz-Bucket-Region", s.region())
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGetBucketConfig answers a read of a bucket configuration
+// subresource.
+func (s *TempoS3ShardServer) handleGetBucketConfig(w http.ResponseWriter, r *http.Request, bucketName, subresource string) {
+	if bucketName != virtualBucket {
+		writeNoSuchBucket(w, r)
+		return
+	}
+	cfg := bucketConfigs[subresource]
+	if cfg.code != "" {
+		writeS3Error(w, r, http.StatusNotFound, cfg.code, cfg.message)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + cfg.body))
+}
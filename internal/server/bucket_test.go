@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBucketRequests(t *testing.T) {
+	s := newTestServer()
+	for _, tc := range []struct {
+		method, target string
+		header         string
+		status         int
+		// body is a part of the response body: the error code, or the
+		// configuration's root element
+		body string
+	}{
+		{"HEAD", "/proxy-bucket", "", http.StatusOK, ""},
+		{"HEAD", "/other-bucket", "", http.StatusNotFound, ""},
+		{"HEAD", "/", "", http.StatusNotImplemented, ""},
+		{"GET", "/proxy-bucket?location", "", http.StatusOK, "<LocationConstraint"},
+		{"GET", "/proxy-bucket?versioning", "", http.StatusOK, "<VersioningConfiguration"},
+		{"GET", "/proxy-bucket?requestPayment", "", http.StatusOK, "<Payer>BucketOwner</Payer>"},
+		// ACL reads of the bucket are answered, unlike those of objects
+		{"GET", "/proxy-bucket?acl", "", http.StatusOK, "<AccessControlPolicy"},
+		{"GET", "/proxy-bucket?lifecycle", "", http.StatusNotFound, "<Code>NoSuchLifecycleConfiguration</Code>"},
+		{"GET", "/proxy-bucket?policy", "", http.StatusNotFound, "<Code>NoSuchBucketPolicy</Code>"},
+		{"GET", "/proxy-bucket?object-lock", "", http.StatusNotFound, "<Code>ObjectLockConfigurationNotFoundError</Code>"},
+		{"GET", "/other-bucket?versioning", "", http.StatusNotFound, "<Code>NoSuchBucket</Code>"},
+		{"GET", "/proxy-bucket?uploads", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"PUT", "/proxy-bucket", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"PUT", "/proxy-bucket?versioning", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"DELETE", "/proxy-bucket", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"DELETE", "/proxy-bucket?policy", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"POST", "/proxy-bucket/tenant/block?uploads", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"GET", "/proxy-bucket/tenant/block?uploadId=1", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"GET", "/proxy-bucket/tenant/block?acl", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"PUT", "/proxy-bucket/tenant/block?acl", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"PUT", "/proxy-bucket/tenant/block", "X-Amz-Copy-Source", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"DELETE", "/proxy-bucket/tenant/block?tagging", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+		{"POST", "/proxy-bucket/tenant/block", "", http.StatusNotImplemented, "<Code>NotImplemented</Code>"},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, "/proxy-bucket/tenant/other")
+		}
+		w := httptest.NewRecorder()
+		s.handleRequest(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s %s got %d, want %d", tc.method, tc.target, w.Code, tc.status)
+			continue
+		}
+		if !strings.Contains(w.Body.String(), tc.body) {
+			t.Errorf("%s %s got body %s, want it to contain %s", tc.method, tc.target, w.Body, tc.body)
+		}
+	}
+}
+
+func TestHeadBucketRegion(t *testing.T) {
+	s := newTestServer()
+	for _, region := range []string{"", "eu-west-1"} {
+		s.cfg().Region = region
+		w := httptest.NewRecorder()
+		s.handleRequest(w, httptest.NewRequest("HEAD", "/proxy-bucket", nil))
+		want := region
+		if want == "" {
+			want = "us-east-1"
+		}
+		if got := w.Header().Get("X-Amz-Bucket-Region"); got != want {
+			t.Errorf("region %q: HEAD bucket reports %q, want %q", region, got, want)
+		}
+	}
+}
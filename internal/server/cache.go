@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/cache"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+func newObjectCache(cfg config.CacheConfig) (*cache.Cache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	return cache.New(cache.Options{
+		MaxMemoryBytes: cfg.MaxMemoryBytes,
+		Dir:            cfg.Dir,
+		MaxDiskBytes:   cfg.MaxDiskBytes,
+		OnEvict: func(tier string) {
+			metrics.CacheEvictionsTotal.WithLabelValues(tier).Inc()
+		},
+	})
+}
+
+// cacheAdmits reports whether GETs of key go through the object cache.
+func (s *TempoS3ShardServer) cacheAdmits(key string) bool {
+	if s.cache == nil {
+		return false
+	}
+	for _, pattern := range s.runtime().cachePatterns {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedObject returns the cached copy of key. Entries older than max_age
+// are revalidated with a HEAD and dropped if the backend ETag changed.
+func (s *TempoS3ShardServer) cachedObject(ctx context.Context, key string) (*cache.Entry, bool) {
+	entry, tier, ok := s.cache.Get(key)
+	if !ok {
+		metrics.CacheMissesTotal.WithLabelValues("absent").Inc()
+		return nil, false
+	}
+
+	if time.Since(entry.Validated) > s.cfg().Cache.MaxAge.Std() {
+		info, _, err := s.statObject(ctx, key)
+		if err != nil {
+			// Let the regular GET path report the error
+			if isNotFound(err) {
+				s.cache.Remove(key)
+			}
+			metrics.CacheMissesTotal.WithLabelValues("revalidate_failed").Inc()
+			return nil, false
+		}
+		if info.ETag != entry.ETag {
+			s.cache.Remove(key)
+			metrics.CacheMissesTotal.WithLabelValues("stale").Inc()
+			return nil, false
+		}
+		s.cache.Touch(key, time.Now())
+	}
+
+	metrics.CacheHitsTotal.WithLabelValues(tier).Inc()
+	return entry, true
+}
+
+// readWholeObject reads the whole of an opened object into an entry that
+// can be cached or shared between coalesced GETs.
+func (s *TempoS3ShardServer) readWholeObject(ctx context.Context, object *backendObject, info minio.ObjectInfo, bucket string) (*cache.Entry, error) {
+	body, err := s.objectBody(ctx, object, info, bucket, 0, info.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data := make([]byte, info.Size)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, fmt.Errorf("reading object: %w", err)
+	}
+
+	entry := &cache.Entry{
+		Data:         data,
+		ETag:         info.ETag,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+		Validated:    time.Now(),
+		// Encrypted objects are only kept in memory once decrypted
+		MemoryOnly: isEncrypted(info),
+	}
+	return entry, nil
+}
+
+// writeCached serves a GET from a cached or shared object, honouring Range.
+func (s *TempoS3ShardServer) writeCached(w http.ResponseWriter, r *http.Request, bucket string, entry *cache.Entry, start time.Time) {
+	size := int64(len(entry.Data))
+	offset, length, ranged, err := parseRange(r.Header.Get("Range"), size)
+	if err != nil {
+		metrics.S3OperationsTotal.WithLabelValues("get", bucket, "error").Inc()
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+		return
+	}
+
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("ETag", `"`+entry.ETag+`"`)
+	w.Header().Set("Last-Modified", entry.LastModified.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if ranged {
+		w.Header().Set("Content-Range", contentRange(offset, length, size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if _, err := w.Write(entry.Data[offset : offset+length]); err != nil {
+		if reason := abortReason(r, r.Context()); reason != "" {
+			metrics.RequestAbortsTotal.WithLabelValues("get", bucket, reason).Inc()
+			metrics.S3OperationsTotal.WithLabelValues("get", bucket, reason).Inc()
+		} else {
+			metrics.S3OperationsTotal.WithLabelValues("get", bucket, "error").Inc()
+		}
+		return
+	}
+
+	metrics.S3OperationsTotal.WithLabelValues("get", bucket, "success").Inc()
+	metrics.S3OperationDuration.WithLabelValues("get", bucket).Observe(time.Since(start).Seconds())
+	metrics.ObjectSizeBytes.WithLabelValues("get").Observe(float64(size))
+	metrics.BucketOperationsTotal.WithLabelValues(bucket, "get").Inc()
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// Codecs for objects stored compressed. The codec is recorded in the
+// object's user metadata under codecMetaKey, and its uncompressed size
+// under sizeMetaKey.
+const (
+	codecZstd    = "zstd"
+	codecGzip    = "gzip"
+	codecMetaKey = "Tss-Codec"
+)
+
+// zstd objects end with a seek table in the zstd seekable format: a
+// skippable frame holding the compressed and uncompressed size of every
+// frame, whose last 9 bytes are a footer giving the number of frames.
+const (
+	skippableFrameMagic = 0x184D2A5E
+	seekableMagic       = 0x8F92EAB1
+	seekFooterSize      = 9
+	seekChecksumFlag    = 1 << 7
+	// maxSeekTableSize bounds how much of a seek table is read.
+	maxSeekTableSize = 16 << 20
+	// maxFrameSize keeps frame sizes within the seek table's 32-bit fields.
+	maxFrameSize = 1 << 30
+)
+
+// errNoSeekTable is returned for zstd objects that cannot be read from an
+// offset because they lack a valid seek table.
+var errNoSeekTable = errors.New("compressed object has no valid seek table")
+
+// zstdEncoder is shared by all uploads; EncodeAll is safe for concurrent
+// use.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// validateCompression checks the compression settings that cannot be
+// defaulted.
+func validateCompression(cfg config.CompressionConfig) error {
+	if cfg.Codec != codecZstd && cfg.Codec != codecGzip {
+		return fmt.Errorf("unknown compression codec %q, want %q or %q", cfg.Codec, codecZstd, codecGzip)
+	}
+	if len(cfg.KeyPatterns) == 0 && len(cfg.ContentTypes) == 0 {
+		return errors.New("compression needs key_patterns or content_types to select objects")
+	}
+	if cfg.FrameSize < 1 || cfg.FrameSize > maxFrameSize {
+		return fmt.Errorf("compression frame_size must be between 1 and %d bytes, got %d", maxFrameSize, cfg.FrameSize)
+	}
+	return nil
+}
+
+// compressionCodec returns the codec to store an upload with, or "" to
+// store it as is.
+func (rt *runtimeState) compressionCodec(key, contentType string, size int64) string {
+	cfg := rt.config.Compression
+	if !cfg.Enabled || size == 0 || size < cfg.MinSize || size > cfg.MaxSize {
+		return ""
+	}
+	for _, pattern := range rt.compressPatterns {
+		if pattern.MatchString(key) {
+			return cfg.Codec
+		}
+	}
+	if contentTypeMatches(contentType, cfg.ContentTypes) {
+		return cfg.Codec
+	}
+	return ""
+}
+
+// contentTypeMatches reports whether contentType is one of types, ignoring
+// parameters. A type of the form "text/*" matches any subtype.
+func contentTypeMatches(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasSuffix(prefix, "/") && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressBody compresses an upload of size bytes with codec as it is
+// read. Whether compression pays off is judged from the first frame; if it
+// does not shrink, the body is returned uncompressed and cr is nil.
+// Otherwise compressed output is buffered up to streamPartSize: a smaller
+// object is returned whole with its stored size, a larger one is streamed
+// with a stored size of -1. cr reports how many bytes it produced.
+func compressBody(body io.Reader, size int64, codec string, frameSize int64) (out io.Reader, stored int64, cr *compressReader, err error) {
+	cr, err = newCompressReader(body, size, codec, frameSize)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if err := cr.next(); err != nil {
+		return nil, 0, nil, err
+	}
+	// A single frame is judged with the seek table or gzip trailer included
+	if int64(cr.buf.Len()) >= int64(len(cr.frame)) {
+		metrics.CompressionSkippedTotal.WithLabelValues(codec).Inc()
+		return io.MultiReader(bytes.NewReader(cr.frame), body), size, nil, nil
+	}
+
+	for !cr.done && cr.buf.Len() <= streamPartSize {
+		if err := cr.next(); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+	if cr.done {
+		return cr, int64(cr.buf.Len()), cr, nil
+	}
+	return cr, -1, cr, nil
+}
+
+// recordCompression updates the compression metrics of every replica of
+// key after a compressed object was stored.
+func (s *TempoS3ShardServer) recordCompression(key, codec string, size, stored int64) {
+	for _, bucket := range s.clients().GetReplicaBucketsForKey(key) {
+		metrics.CompressionLogicalBytesTotal.WithLabelValues(bucket, codec).Add(float64(size))
+		metrics.CompressionStoredBytesTotal.WithLabelValues(bucket, codec).Add(float64(stored))
+		metrics.CompressionRatio.WithLabelValues(bucket, codec).Observe(float64(size) / float64(stored))
+	}
+}
+
+// compressReader compresses the size bytes read from src one frame at a
+// time. zstd frames are independent and their sizes are collected into the
+// seek table written at the end; gzip output is flushed after every frame.
+type compressReader struct {
+	src       io.Reader
+	codec     string
+	frameSize int64
+	remaining int64
+	done      bool
+	// written counts the compressed bytes produced so far.
+	written int64
+
+	frame []byte
+	buf   bytes.Buffer
+	gz    *gzip.Writer
+	// zstd scratch space, and the seek table entries and frame count
+	scratch []byte
+	table   []byte
+	frames  int
+}
+
+func newCompressReader(src io.Reader, size int64, codec string, frameSize int64) (*compressReader, error) {
+	cr := &compressReader{
+		src:       src,
+		codec:     codec,
+		frameSize: frameSize,
+		remaining: size,
+		frame:     make([]byte, min(frameSize, size)),
+	}
+	switch codec {
+	case codecZstd:
+	case codecGzip:
+		cr.gz = gzip.NewWriter(&cr.buf)
+	default:
+		return nil, fmt.Errorf("unknown compression codec %q", codec)
+	}
+	return cr, nil
+}
+
+func (cr *compressReader) Read(p []byte) (int, error) {
+	for cr.buf.Len() == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+	}
+	return cr.buf.Read(p)
+}
+
+// next reads and compresses the next frame into buf, and finishes the
+// stream once the body has been read. cr.frame holds the frame's
+// uncompressed bytes afterwards.
+func (cr *compressReader) next() error {
+	n := len(cr.buf.Bytes())
+	cr.frame = cr.frame[:min(cr.frameSize, cr.remaining)]
+	if _, err := io.ReadFull(cr.src, cr.frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	cr.remaining -= int64(len(cr.frame))
+
+	switch cr.codec {
+	case codecZstd:
+		cr.scratch = zstdEncoder.EncodeAll(cr.frame, cr.scratch[:0])
+		cr.buf.Write(cr.scratch)
+		cr.table = binary.LittleEndian.AppendUint32(cr.table, uint32(len(cr.scratch)))
+		cr.table = binary.LittleEndian.AppendUint32(cr.table, uint32(len(cr.frame)))
+		cr.frames++
+		if cr.remaining == 0 {
+			cr.buf.Write(seekTable(cr.table, cr.frames))
+		}
+	case codecGzip:
+		if _, err := cr.gz.Write(cr.frame); err != nil {
+			return fmt.Errorf("compressing object: %w", err)
+		}
+		err := cr.gz.Flush()
+		if cr.remaining == 0 {
+			err = cr.gz.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("compressing object: %w", err)
+		}
+	}
+	cr.written += int64(cr.buf.Len() - n)
+	cr.done = cr.remaining == 0
+	return nil
+}
+
+// seekTable returns the skippable frame that ends a seekable zstd object,
+// given the table entries of its frames. Appended to independent zstd
+// frames it lets a range be read by decompressing only the frames it
+// covers, and the result is still a valid zstd stream.
+func seekTable(table []byte, frames int) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, skippableFrameMagic)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(table)+seekFooterSize))
+	out = append(out, table...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(frames))
+	out = append(out, 0) // no per-frame checksums
+	return binary.LittleEndian.AppendUint32(out, seekableMagic)
+}
+
+// seekFrame locates one frame of a seekable zstd object.
+type seekFrame struct {
+	compressedOffset int64
+	compressedSize   int64
+	offset           int64
+	size             int64
+}
+
+// readSeekTable reads the frame layout from the end of a seekable zstd
+// object.
+func readSeekTable(src byteSource) ([]seekFrame, error) {
+	end := src.size()
+	if end < seekFooterSize {
+		return nil, errNoSeekTable
+	}
+	footer, err := readFull(src, end-seekFooterSize, seekFooterSize)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, errNoSeekTable
+	}
+
+	count := int64(binary.LittleEndian.Uint32(footer))
+	entrySize := int64(8)
+	if footer[4]&seekChecksumFlag != 0 {
+		entrySize = 12
+	}
+	tableSize := count * entrySize
+	if tableSize > maxSeekTableSize || tableSize > end-seekFooterSize {
+		return nil, errNoSeekTable
+	}
+	table, err := readFull(src, end-seekFooterSize-tableSize, tableSize)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := make([]seekFrame, count)
+	var compressedOffset, offset int64
+	for i := range frames {
+		entry := table[int64(i)*entrySize:]
+		frames[i] = seekFrame{
+			compressedOffset: compressedOffset,
+			compressedSize:   int64(binary.LittleEndian.Uint32(entry)),
+			offset:           offset,
+			size:             int64(binary.LittleEndian.Uint32(entry[4:])),
+		}
+		compressedOffset += frames[i].compressedSize
+		offset += frames[i].size
+	}
+	return frames, nil
+}
+
+// decompressedBody returns a reader for length bytes of a compressed
+// object's uncompressed content starting at offset. size is the
+// uncompressed size. Ranges of zstd objects are read from the frames that
+// cover them; gzip objects are decompressed from the start.
+func decompressedBody(src byteSource, codec string, size, offset, length int64) (io.ReadCloser, error) {
+	start, end := int64(0), src.size()
+	skip := offset
+	if codec == codecZstd && (offset > 0 || length < size) {
+		frames, err := readSeekTable(src)
+		if err != nil {
+			return nil, err
+		}
+		if len(frames) == 0 {
+			return nil, errNoSeekTable
+		}
+		first := frameAt(frames, offset)
+		last := frameAt(frames, max(offset+length-1, 0))
+		start = frames[first].compressedOffset
+		end = frames[last].compressedOffset + frames[last].compressedSize
+		skip = offset - frames[first].offset
+	}
+
+	compressed, err := src.readRange(start, end-start)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader
+	var closeBody func() error
+	switch codec {
+	case codecZstd:
+		dec, err := zstd.NewReader(compressed, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			compressed.Close()
+			return nil, err
+		}
+		body = dec
+		closeBody = func() error {
+			dec.Close()
+			return compressed.Close()
+		}
+	case codecGzip:
+		zr, err := gzip.NewReader(compressed)
+		if err != nil {
+			compressed.Close()
+			return nil, err
+		}
+		body = zr
+		closeBody = func() error {
+			zr.Close()
+			return compressed.Close()
+		}
+	default:
+		compressed.Close()
+		return nil, fmt.Errorf("unknown compression codec %q", codec)
+	}
+
+	if _, err := io.CopyN(io.Discard, body, skip); err != nil {
+		closeBody()
+		return nil, err
+	}
+	return &readCloser{Reader: io.LimitReader(body, length), close: closeBody}, nil
+}
+
+// frameAt returns the index of the frame holding uncompressed offset.
+func frameAt(frames []seekFrame, offset int64) int {
+	i, _ := slices.BinarySearchFunc(frames, offset, func(f seekFrame, offset int64) int {
+		return cmp.Compare(f.offset+f.size, offset+1)
+	})
+	return min(i, len(frames)-1)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// memSource is a byteSource over bytes held in memory.
+type memSource []byte
+
+func (m memSource) size() int64 {
+	return int64(len(m))
+}
+
+func (m memSource) readRange(offset, length int64) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(m[offset : offset+length])), nil
+}
+
+// testData returns size bytes that compress well but not to nothing.
+func testData(size int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = "abcd"[rng.Intn(4)]
+	}
+	return data
+}
+
+func compressAll(t *testing.T, data []byte, codec string, frameSize int64) []byte {
+	t.Helper()
+	body, stored, cr, err := compressBody(bytes.NewReader(data), int64(len(data)), codec, frameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr == nil {
+		t.Fatal("compression skipped")
+	}
+	out, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored >= 0 && stored != int64(len(out)) {
+		t.Fatalf("stored size is %d, read %d bytes", stored, len(out))
+	}
+	if cr.written != int64(len(out)) {
+		t.Fatalf("written is %d, read %d bytes", cr.written, len(out))
+	}
+	return out
+}
+
+func TestSeekTable(t *testing.T) {
+	for _, size := range []int{1000, 1024, 1025, 4096, 10_000} {
+		data := testData(size)
+		src := memSource(compressAll(t, data, codecZstd, 1024))
+		frames, err := readSeekTable(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (size + 1023) / 1024; len(frames) != want {
+			t.Fatalf("size %d: %d frames, want %d", size, len(frames), want)
+		}
+		var offset, compressedOffset int64
+		for i, f := range frames {
+			if f.offset != offset || f.compressedOffset != compressedOffset {
+				t.Fatalf("size %d: frame %d at %d/%d, want %d/%d", size, i, f.offset, f.compressedOffset, offset, compressedOffset)
+			}
+			if want := min(1024, int64(size)-offset); f.size != want {
+				t.Fatalf("size %d: frame %d holds %d bytes, want %d", size, i, f.size, want)
+			}
+			offset += f.size
+			compressedOffset += f.compressedSize
+		}
+		if offset != int64(size) {
+			t.Fatalf("size %d: frames cover %d bytes", size, offset)
+		}
+	}
+}
+
+func TestSeekTableInvalid(t *testing.T) {
+	valid := compressAll(t, testData(4096), codecZstd, 1024)
+	for name, data := range map[string][]byte{
+		"short":     valid[:seekFooterSize-1],
+		"no footer": valid[:len(valid)-1],
+		"oversized": append(bytes.Clone(valid[:len(valid)-seekFooterSize]), 0xff, 0xff, 0xff, 0x00, 0, 0xb1, 0xea, 0x92, 0x8f),
+	} {
+		if _, err := readSeekTable(memSource(data)); err != errNoSeekTable {
+			t.Errorf("%s: got %v, want errNoSeekTable", name, err)
+		}
+	}
+}
+
+func TestFrameAt(t *testing.T) {
+	frames := []seekFrame{{offset: 0, size: 10}, {offset: 10, size: 10}, {offset: 20, size: 5}}
+	for offset, want := range map[int64]int{0: 0, 9: 0, 10: 1, 19: 1, 20: 2, 24: 2, 25: 2} {
+		if got := frameAt(frames, offset); got != want {
+			t.Errorf("frameAt(%d) = %d, want %d", offset, got, want)
+		}
+	}
+}
+
+func TestDecompressedRanges(t *testing.T) {
+	data := testData(5000)
+	for _, codec := range []string{codecZstd, codecGzip} {
+		src := memSource(compressAll(t, data, codec, 1024))
+		for _, r := range [][2]int64{{0, 5000}, {0, 1}, {1023, 2}, {1024, 1024}, {1000, 3000}, {4999, 1}, {4096, 904}} {
+			t.Run(fmt.Sprintf("%s/%d-%d", codec, r[0], r[1]), func(t *testing.T) {
+				body, err := decompressedBody(src, codec, int64(len(data)), r[0], r[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer body.Close()
+				got, err := io.ReadAll(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data[r[0]:r[0]+r[1]]) {
+					t.Fatalf("read %d bytes that do not match the original", len(got))
+				}
+			})
+		}
+	}
+}
+
+func TestCompressBodyStreams(t *testing.T) {
+	data := testData(6 * streamPartSize)
+	_, stored, _, err := compressBody(bytes.NewReader(data), int64(len(data)), codecZstd, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != -1 {
+		t.Fatalf("stored size is %d, want -1 for an object compressing to more than one part", stored)
+	}
+
+	out := compressAll(t, data, codecZstd, 1<<20)
+	body, err := decompressedBody(memSource(out), codecZstd, int64(len(data)), 0, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("streamed object does not decompress to the original")
+	}
+}
+
+func TestCompressBodySkipsIncompressible(t *testing.T) {
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+	body, stored, cr, err := compressBody(bytes.NewReader(data), int64(len(data)), codecZstd, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr != nil || stored != int64(len(data)) {
+		t.Fatalf("random data compressed, stored size %d", stored)
+	}
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("uncompressed body does not match the original")
+	}
+}
+
+func TestCompressBodyShortRead(t *testing.T) {
+	data := testData(4096)
+	body, _, _, err := compressBody(bytes.NewReader(data[:3000]), int64(len(data)), codecZstd, 1024)
+	if err == nil {
+		_, err = io.ReadAll(body)
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v for a truncated body, want io.ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/envelope"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// User metadata set on encrypted objects: the master key that wrapped the
+// data key, the wrapped data key itself and the chunk size it was written
+// with.
+const (
+	keyIDMetaKey     = "Tss-Key-Id"
+	dataKeyMetaKey   = "Tss-Data-Key"
+	chunkSizeMetaKey = "Tss-Chunk-Size"
+)
+
+// maxChunkSize bounds the encryption chunk size, and so the memory used
+// per read.
+const maxChunkSize = 16 << 20
+
+// SSE-C request headers forwarded to the backends.
+const (
+	sseCustomerAlgorithmHeader = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	sseCustomerKeyHeader       = "X-Amz-Server-Side-Encryption-Customer-Key"
+	sseCustomerKeyMD5Header    = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+)
+
+// errEncryptionDisabled is returned when reading an encrypted object while
+// encryption is not configured.
+var errEncryptionDisabled = errors.New("object is encrypted but encryption is not configured")
+
+// errSSECDisabled is returned for requests carrying SSE-C headers while
+// sse_c_passthrough is disabled.
+var errSSECDisabled = errors.New("SSE-C passthrough is disabled")
+
+// loadKeyring reads the configured master keys.
+func loadKeyring(cfg config.EncryptionConfig) (*envelope.Keyring, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.ChunkSize < 1 || cfg.ChunkSize > maxChunkSize {
+		return nil, fmt.Errorf("encryption chunk_size must be between 1 and %d bytes, got %d", maxChunkSize, cfg.ChunkSize)
+	}
+	if len(cfg.Keys) == 0 {
+		return nil, errors.New("encryption needs at least one master key")
+	}
+
+	keys := make(map[string][]byte, len(cfg.Keys))
+	for _, k := range cfg.Keys {
+		if k.ID == "" {
+			return nil, errors.New("every encryption master key needs an id")
+		}
+		if _, dup := keys[k.ID]; dup {
+			return nil, fmt.Errorf("duplicate encryption master key id %q", k.ID)
+		}
+		var encoded string
+		switch {
+		case k.File != "" && k.Env != "":
+			return nil, fmt.Errorf("master key %q: set only one of file and env", k.ID)
+		case k.File != "":
+			data, err := os.ReadFile(k.File)
+			if err != nil {
+				return nil, fmt.Errorf("master key %q: %w", k.ID, err)
+			}
+			encoded = string(data)
+		case k.Env != "":
+			value, ok := os.LookupEnv(k.Env)
+			if !ok {
+				return nil, fmt.Errorf("master key %q: environment variable %s is not set", k.ID, k.Env)
+			}
+			encoded = value
+		default:
+			return nil, fmt.Errorf("master key %q: set file or env", k.ID)
+		}
+		key, err := envelope.ParseKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("master key %q: %w", k.ID, err)
+		}
+		keys[k.ID] = key
+	}
+	return envelope.NewKeyring(keys, cfg.ActiveKey)
+}
+
+// isEncrypted reports whether info describes an object stored encrypted.
+func isEncrypted(info minio.ObjectInfo) bool {
+	return info.Metadata.Get("X-Amz-Meta-"+keyIDMetaKey) != ""
+}
+
+// dataKeyAAD binds a wrapped data key to the object it encrypts: its key
+// and logical size. A wrapped key copied to another object, or an object
+// whose recorded size was altered, fails to unwrap.
+func dataKeyAAD(key string, size int64) []byte {
+	return strconv.AppendInt([]byte(key+"\x00"), size, 10)
+}
+
+// encryptBody returns a reader of body encrypted with a new data key wrapped
+// by keyring and its encrypted size, and records the wrapped key in meta.
+// key and logicalSize identify the object the data key is bound to.
+func encryptBody(keyring *envelope.Keyring, chunkSize int64, key string, logicalSize int64, body io.Reader, size int64, meta map[string]string) (io.Reader, int64, error) {
+	dataKey, wrapped, err := keyring.NewDataKey(dataKeyAAD(key, logicalSize))
+	if err != nil {
+		return nil, 0, fmt.Errorf("generating data key: %w", err)
+	}
+	enc, err := envelope.NewEncrypter(body, dataKey, chunkSize, size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keyID := keyring.ActiveKey()
+	meta[keyIDMetaKey] = keyID
+	meta[dataKeyMetaKey] = base64.StdEncoding.EncodeToString(wrapped)
+	meta[chunkSizeMetaKey] = strconv.FormatInt(chunkSize, 10)
+	metrics.EncryptionOperationsTotal.WithLabelValues("encrypt", keyID).Inc()
+	return enc, envelope.EncryptedSize(size, chunkSize), nil
+}
+
+// decryptSource unwraps the data key of an encrypted object and returns a
+// source of its plaintext read from src. info must have its logical size.
+func (s *TempoS3ShardServer) decryptSource(src byteSource, info minio.ObjectInfo) (byteSource, error) {
+	keyring := s.runtime().keyring
+	if keyring == nil {
+		return nil, errEncryptionDisabled
+	}
+	keyID := info.Metadata.Get("X-Amz-Meta-" + keyIDMetaKey)
+	wrapped, err := base64.StdEncoding.DecodeString(info.Metadata.Get("X-Amz-Meta-" + dataKeyMetaKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped data key: %w", err)
+	}
+	chunkSize, err := strconv.ParseInt(info.Metadata.Get("X-Amz-Meta-"+chunkSizeMetaKey), 10, 64)
+	if err != nil || chunkSize < 1 || chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("invalid encryption chunk size %q", info.Metadata.Get("X-Amz-Meta-"+chunkSizeMetaKey))
+	}
+	dataKey, err := keyring.Unwrap(keyID, wrapped, dataKeyAAD(info.Key, info.Size))
+	if err != nil {
+		metrics.DecryptionFailuresTotal.WithLabelValues(keyID).Inc()
+		return nil, err
+	}
+	metrics.EncryptionOperationsTotal.WithLabelValues("decrypt", keyID).Inc()
+	return &decryptingSource{
+		src:       src,
+		keyID:     keyID,
+		dataKey:   dataKey,
+		chunkSize: chunkSize,
+		plainSize: envelope.PlaintextSize(src.size(), chunkSize),
+	}, nil
+}
+
+// decryptingSource reads ranges of an encrypted object's plaintext by
+// decrypting the chunks that cover them.
+type decryptingSource struct {
+	src       byteSource
+	keyID     string
+	dataKey   []byte
+	chunkSize int64
+	plainSize int64
+}
+
+func (d *decryptingSource) size() int64 {
+	return d.plainSize
+}
+
+func (d *decryptingSource) readRange(offset, length int64) (io.ReadCloser, error) {
+	// An empty object's final chunk is still read to authenticate it
+	if length <= 0 && d.plainSize > 0 {
+		return http.NoBody, nil
+	}
+	stride := d.chunkSize + envelope.Overhead
+	first := offset / d.chunkSize
+	last := (offset + length - 1) / d.chunkSize
+	start := first * stride
+	end := min(d.src.size(), (last+1)*stride)
+
+	sealed, err := d.src.readRange(start, end-start)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := envelope.NewDecrypter(sealed, d.dataKey, d.chunkSize, d.plainSize, first)
+	if err == nil {
+		_, err = io.CopyN(io.Discard, dec, offset-first*d.chunkSize)
+	}
+	if err != nil {
+		sealed.Close()
+		if errors.Is(err, envelope.ErrDecrypt) {
+			metrics.DecryptionFailuresTotal.WithLabelValues(d.keyID).Inc()
+		}
+		return nil, err
+	}
+	return &readCloser{Reader: io.LimitReader(dec, length), close: sealed.Close}, nil
+}
+
+// sseFromRequest returns the SSE-C key a client supplied, or nil if it
+// supplied none. It returns errSSECDisabled for a key supplied while
+// passthrough is disabled, rather than storing the object unencrypted.
+func (s *TempoS3ShardServer) sseFromRequest(r *http.Request) (encrypt.ServerSide, error) {
+	if r.Header.Get(sseCustomerAlgorithmHeader) == "" {
+		return nil, nil
+	}
+	if !s.cfg().Encryption.SSECPassthrough {
+		return nil, errSSECDisabled
+	}
+	if r.Header.Get(sseCustomerAlgorithmHeader) != "AES256" {
+		return nil, errors.New("unsupported SSE-C algorithm")
+	}
+	key, err := base64.StdEncoding.DecodeString(r.Header.Get(sseCustomerKeyHeader))
+	if err != nil {
+		return nil, errors.New("invalid SSE-C key")
+	}
+	if md5Header := r.Header.Get(sseCustomerKeyMD5Header); md5Header != "" {
+		sum := md5.Sum(key)
+		if base64.StdEncoding.EncodeToString(sum[:]) != md5Header {
+			return nil, errors.New("SSE-C key MD5 does not match")
+		}
+	}
+	return encrypt.NewSSEC(key)
+}
+
+// writeSSEError responds to a request whose SSE-C headers sseFromRequest
+// rejected.
+func writeSSEError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errSSECDisabled) {
+		writeNotImplemented(w, r)
+		return
+	}
+	writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", err.Error())
+}
@@ -0,0 +1,515 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// erasurePrefix is the reserved key prefix under which erasure-coded pieces
+// are stored. Keys under it are hidden from listings.
+const erasurePrefix = ".tss-erasure/"
+
+// User metadata set on manifest objects. The logical size lets HEAD report
+// the size of the encoded object without reading the manifest.
+const (
+	erasureMetaKey = "Tss-Erasure"
+	sizeMetaKey    = "Tss-Size"
+)
+
+// maxManifestSize bounds how much of a manifest object is read.
+const maxManifestSize = 1 << 20
+
+var (
+	// errTooFewPieces is returned when fewer than DataShards pieces of an
+	// erasure-coded object can be read.
+	errTooFewPieces = errors.New("too few erasure pieces available")
+	// errPieceAborted is returned by encodeStripes when a piece upload
+	// stopped reading; the upload's own error explains why.
+	errPieceAborted = errors.New("erasure piece upload aborted")
+)
+
+type erasurePiece struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// erasureManifest describes the layout of an erasure-coded object. It is
+// stored under the object's own key at the ring owner. Piece locations are
+// recorded explicitly so objects stay readable if the ring changes.
+//
+// The object is cut into stripes of DataShards*BlockSize bytes, the last
+// one zero padded. Piece i holds block i of every stripe, so the first
+// DataShards pieces contain the data and the rest hold parity.
+type erasureManifest struct {
+	Size         int64          `json:"size"`
+	DataShards   int            `json:"data_shards"`
+	ParityShards int            `json:"parity_shards"`
+	BlockSize    int64          `json:"block_size"`
+	Pieces       []erasurePiece `json:"pieces"`
+}
+
+func (m *erasureManifest) stripeSize() int64 {
+	return int64(m.DataShards) * m.BlockSize
+}
+
+func (m *erasureManifest) stripes() int64 {
+	return (m.Size + m.stripeSize() - 1) / m.stripeSize()
+}
+
+// isReservedKey reports whether key belongs to the proxy's internal
+// namespace rather than to clients.
+func isReservedKey(key string) bool {
+	return strings.HasPrefix(key, erasurePrefix) || strings.HasPrefix(key, lifecyclePrefix)
+}
+
+// isErasureManifest reports whether info describes an erasure manifest
+// rather than a whole object.
+func isErasureManifest(info minio.ObjectInfo) bool {
+	return info.Metadata.Get("X-Amz-Meta-"+erasureMetaKey) != ""
+}
+
+// logicalInfo returns info with Size replaced by the size of the object a
+// manifest or compressed object stands for. Other objects are returned
+// unchanged.
+func logicalInfo(info minio.ObjectInfo) minio.ObjectInfo {
+	if size, err := strconv.ParseInt(info.Metadata.Get("X-Amz-Meta-"+sizeMetaKey), 10, 64); err == nil {
+		info.Size = size
+	}
+	return info
+}
+
+// useErasure reports whether an object of the given size is erasure coded.
+func (s *TempoS3ShardServer) useErasure(size int64) bool {
+	cfg := s.cfg().Erasure
+	return cfg.Enabled && size > 0 && size >= cfg.MinSize
+}
+
+// validateErasure checks that there are enough buckets to place every piece
+// of an erasure-coded object in a different one.
+func validateErasure(dataShards, parityShards, buckets int) error {
+	if dataShards < 1 || parityShards < 1 {
+		return fmt.Errorf("erasure coding needs at least one data and one parity shard, got %d+%d", dataShards, parityShards)
+	}
+	if dataShards+parityShards > buckets {
+		return fmt.Errorf("erasure coding with %d+%d shards needs at least %d buckets, have %d", dataShards, parityShards, dataShards+parityShards, buckets)
+	}
+	return nil
+}
+
+// putErasure encodes body into data and parity pieces, uploads them to
+// distinct buckets and then writes the manifest under key with meta added
+// to its user metadata. Every piece must be stored for the write to
+// succeed; pieces of a failed write are removed in the background. A size
+// of -1 streams the pieces and records the size once body is read.
+func (s *TempoS3ShardServer) putErasure(ctx context.Context, key string, body io.Reader, size int64, contentType string, meta map[string]string) (minio.UploadInfo, error) {
+	cfg := s.cfg().Erasure
+	enc, err := reedsolomon.New(cfg.DataShards, cfg.ParityShards)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+
+	manifest := &erasureManifest{
+		Size:         size,
+		DataShards:   cfg.DataShards,
+		ParityShards: cfg.ParityShards,
+		BlockSize:    cfg.BlockSize,
+	}
+	if size >= 0 {
+		manifest.BlockSize = min(cfg.BlockSize, (size+int64(cfg.DataShards)-1)/int64(cfg.DataShards))
+	}
+	// A fresh prefix per upload keeps an overwrite from clobbering the
+	// pieces a concurrent reader of the previous version is using
+	id := make([]byte, 8)
+	rand.Read(id)
+	for i, bucket := range s.clients().GetBucketsForKey(key, cfg.DataShards+cfg.ParityShards) {
+		manifest.Pieces = append(manifest.Pieces, erasurePiece{
+			Bucket: bucket,
+			Key:    fmt.Sprintf("%s%s/%s/%d", erasurePrefix, key, hex.EncodeToString(id), i),
+		})
+	}
+	pieceSize := int64(-1)
+	if size >= 0 {
+		pieceSize = manifest.stripes() * manifest.BlockSize
+	}
+
+	errs := make([]error, len(manifest.Pieces))
+	writers := make([]*io.PipeWriter, len(manifest.Pieces))
+	var wg sync.WaitGroup
+	for i, piece := range manifest.Pieces {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func(i int, piece erasurePiece) {
+			defer wg.Done()
+			errs[i] = s.callBackend(ctx, "put", piece.Bucket, func() error {
+				_, err := s.putObject(ctx, piece.Bucket, piece.Key, pr, pieceSize, minio.PutObjectOptions{
+					ContentType: "application/octet-stream",
+				})
+				return err
+			})
+			// Unblock the encoder if this piece stopped reading early
+			pr.CloseWithError(errs[i])
+		}(i, piece)
+	}
+
+	encodeErr := encodeStripes(enc, manifest, body, writers)
+	for _, pw := range writers {
+		pw.CloseWithError(encodeErr)
+	}
+	wg.Wait()
+
+	failed := 0
+	var firstErr error
+	for i, err := range errs {
+		if err == nil || encodeErr != nil && !errors.Is(encodeErr, errPieceAborted) {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		failed++
+		metrics.ErasurePieceFailuresTotal.WithLabelValues("put", manifest.Pieces[i].Bucket).Inc()
+		s.logger.Warn("Erasure piece write failed", "object_key", key, "bucket", manifest.Pieces[i].Bucket, "piece", i, "error", err)
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case failed > 0:
+		err = fmt.Errorf("%w: %d of %d erasure pieces failed: %v", errQuorumNotReached, failed, len(manifest.Pieces), firstErr)
+	case encodeErr != nil:
+		err = encodeErr
+	}
+	if err != nil {
+		go s.removeErasurePieces(manifest)
+		return minio.UploadInfo{}, err
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	userMetadata := map[string]string{
+		erasureMetaKey: "1",
+		sizeMetaKey:    strconv.FormatInt(manifest.Size, 10),
+	}
+	// The logical size of a compressed or encrypted object is in meta
+	maps.Copy(userMetadata, meta)
+	info, err := s.putReplicated(ctx, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: userMetadata,
+	})
+	if err != nil {
+		go s.removeErasurePieces(manifest)
+		return minio.UploadInfo{}, err
+	}
+	return info, nil
+}
+
+// encodeStripes reads the object from body one stripe at a time and writes
+// each stripe's data and parity blocks to the matching piece writers. If
+// m.Size is -1, body is read up to EOF and m.Size set to the bytes read.
+func encodeStripes(enc reedsolomon.Encoder, m *erasureManifest, body io.Reader, writers []*io.PipeWriter) error {
+	shards := make([][]byte, len(writers))
+	for i := range shards {
+		shards[i] = make([]byte, m.BlockSize)
+	}
+
+	if m.Size >= 0 {
+		body = io.LimitReader(body, m.Size)
+	}
+	var read int64
+	for eof := false; !eof; {
+		stripe := read
+		for i := 0; i < m.DataShards; i++ {
+			n := 0
+			if !eof {
+				var err error
+				n, err = io.ReadFull(body, shards[i])
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					eof = true
+				} else if err != nil {
+					return fmt.Errorf("reading object body: %w", err)
+				}
+			}
+			clear(shards[i][n:])
+			read += int64(n)
+		}
+		if read == stripe {
+			break
+		}
+		if err := enc.Encode(shards); err != nil {
+			return err
+		}
+		for i, pw := range writers {
+			if _, err := pw.Write(shards[i]); err != nil {
+				return errPieceAborted
+			}
+		}
+	}
+	if m.Size >= 0 && read != m.Size {
+		return fmt.Errorf("reading object body: %w", io.ErrUnexpectedEOF)
+	}
+	m.Size = read
+	return nil
+}
+
+// loadManifest returns the erasure manifest stored under key, or nil if
+// the key does not exist or holds a whole object.
+func (s *TempoS3ShardServer) loadManifest(ctx context.Context, key string) (*erasureManifest, error) {
+	info, _, err := s.statObject(ctx, key)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil || !isErasureManifest(info) {
+		return nil, err
+	}
+
+	object, _, _, err := s.openObjectFailover(ctx, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return readManifest(object)
+}
+
+// readManifest decodes and sanity checks a manifest object's body.
+func readManifest(r io.Reader) (*erasureManifest, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxManifestSize))
+	if err != nil {
+		return nil, err
+	}
+	var m erasureManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid erasure manifest: %w", err)
+	}
+	if m.DataShards < 1 || m.ParityShards < 1 || m.BlockSize < 1 || len(m.Pieces) != m.DataShards+m.ParityShards {
+		return nil, fmt.Errorf("invalid erasure manifest: %d+%d shards, %d pieces, block size %d", m.DataShards, m.ParityShards, len(m.Pieces), m.BlockSize)
+	}
+	return &m, nil
+}
+
+// removeErasurePieces deletes the pieces of an erasure-coded object. It is
+// best effort: pieces that cannot be removed are logged and left behind.
+func (s *TempoS3ShardServer) removeErasurePieces(m *erasureManifest) {
+	timeout := s.cfg().Timeouts.Delete.Std()
+	if timeout <= 0 {
+		timeout = defaultRepairTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, piece := range m.Pieces {
+		err := s.removeObject(ctx, piece.Bucket, piece.Key)
+		if err != nil && !isNotFound(err) {
+			metrics.ErasurePieceFailuresTotal.WithLabelValues("delete", piece.Bucket).Inc()
+			s.logger.Warn("Failed to remove erasure piece", "bucket", piece.Bucket, "piece_key", piece.Key, "error", err)
+		}
+	}
+}
+
+// erasureReader streams a byte range of an erasure-coded object, decoding
+// one stripe at a time from the first DataShards pieces that can be read.
+// A piece that fails is dropped and the next one takes its place.
+type erasureReader struct {
+	ctx    context.Context
+	s      *TempoS3ShardServer
+	m      *erasureManifest
+	enc    reedsolomon.Encoder
+	bucket string
+	open   pieceOpener
+
+	// pos and end delimit the logical bytes still to be returned; stripe
+	// is the index of the next stripe to decode.
+	pos, end int64
+	stripe   int64
+
+	pieces []io.ReadCloser
+	failed []bool
+	blocks [][]byte
+	shards [][]byte
+	out    []byte
+	buf    []byte
+}
+
+// pieceOpener opens an erasure piece for reading from offset.
+type pieceOpener func(ctx context.Context, piece erasurePiece, offset int64) (io.ReadCloser, error)
+
+// openPiece opens a piece stored on the backend.
+func (s *TempoS3ShardServer) openPiece(ctx context.Context, piece erasurePiece, offset int64) (io.ReadCloser, error) {
+	object, _, err := s.openObject(ctx, piece.Bucket, piece.Key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// minio.Object ignores a Range option once stat'ed; seeking makes the
+	// next read request the piece from offset onwards
+	if offset > 0 {
+		if _, err := object.Seek(offset, io.SeekStart); err != nil {
+			object.Close()
+			return nil, err
+		}
+	}
+	return object, nil
+}
+
+// newErasureReader returns a reader for length bytes of the object m
+// describes, starting at offset, opening its pieces with open. bucket
+// labels metrics. The first stripe is decoded before returning so that
+// missing pieces are reported before the response starts.
+func (s *TempoS3ShardServer) newErasureReader(ctx context.Context, bucket string, m *erasureManifest, offset, length int64, open pieceOpener) (*erasureReader, error) {
+	enc, err := reedsolomon.New(m.DataShards, m.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &erasureReader{
+		ctx:    ctx,
+		s:      s,
+		m:      m,
+		enc:    enc,
+		bucket: bucket,
+		open:   open,
+		pos:    offset,
+		end:    offset + length,
+		stripe: offset / m.stripeSize(),
+		pieces: make([]io.ReadCloser, len(m.Pieces)),
+		failed: make([]bool, len(m.Pieces)),
+		blocks: make([][]byte, len(m.Pieces)),
+		shards: make([][]byte, len(m.Pieces)),
+		out:    make([]byte, m.stripeSize()),
+	}
+	for i := range r.blocks {
+		r.blocks[i] = make([]byte, m.BlockSize)
+	}
+	if length > 0 {
+		if err := r.decodeStripe(); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *erasureReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.pos >= r.end {
+			return 0, io.EOF
+		}
+		if err := r.decodeStripe(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// decodeStripe reads the next stripe from the pieces, reconstructing
+// missing data blocks from parity, and buffers the part of it that falls
+// within the requested range.
+func (r *erasureReader) decodeStripe() error {
+	have := 0
+	for i := range r.m.Pieces {
+		r.shards[i] = r.blocks[i][:0]
+		if have == r.m.DataShards || r.failed[i] {
+			continue
+		}
+		if err := r.readBlock(i); err != nil {
+			if r.ctx.Err() != nil {
+				return r.ctx.Err()
+			}
+			r.fail(i, err)
+			continue
+		}
+		r.shards[i] = r.blocks[i]
+		have++
+	}
+	if have < r.m.DataShards {
+		return fmt.Errorf("%w: %d of %d needed for stripe %d", errTooFewPieces, have, r.m.DataShards, r.stripe)
+	}
+
+	for i := 0; i < r.m.DataShards; i++ {
+		if len(r.shards[i]) == 0 {
+			if err := r.enc.ReconstructData(r.shards); err != nil {
+				return err
+			}
+			metrics.ErasureReconstructionsTotal.WithLabelValues(r.bucket).Inc()
+			break
+		}
+	}
+	for i := 0; i < r.m.DataShards; i++ {
+		copy(r.out[int64(i)*r.m.BlockSize:], r.shards[i])
+	}
+
+	stripeStart := r.stripe * r.m.stripeSize()
+	to := min(r.end, stripeStart+r.m.stripeSize())
+	r.buf = r.out[r.pos-stripeStart : to-stripeStart]
+	r.pos = to
+	r.stripe++
+	return nil
+}
+
+// readBlock reads piece i's block of the current stripe, opening the piece
+// at that stripe if it is not open yet.
+func (r *erasureReader) readBlock(i int) error {
+	if r.pieces[i] == nil {
+		piece, err := r.open(r.ctx, r.m.Pieces[i], r.stripe*r.m.BlockSize)
+		if err != nil {
+			return err
+		}
+		r.pieces[i] = piece
+	}
+	_, err := io.ReadFull(r.pieces[i], r.blocks[i])
+	return err
+}
+
+func (r *erasureReader) fail(i int, err error) {
+	if r.pieces[i] != nil {
+		r.pieces[i].Close()
+		r.pieces[i] = nil
+	}
+	r.failed[i] = true
+	piece := r.m.Pieces[i]
+	metrics.ErasurePieceFailuresTotal.WithLabelValues("get", piece.Bucket).Inc()
+	r.s.logger.Warn("Erasure piece unavailable, trying next piece", "bucket", piece.Bucket, "piece_key", piece.Key, "error", err)
+}
+
+func (r *erasureReader) Close() error {
+	for i, object := range r.pieces {
+		if object != nil {
+			object.Close()
+			r.pieces[i] = nil
+		}
+	}
+	return nil
+}
+
+// erasureSource reads ranges of an erasure-coded object from its pieces.
+type erasureSource struct {
+	s        *TempoS3ShardServer
+	ctx      context.Context
+	bucket   string
+	manifest *erasureManifest
+}
+
+func (src *erasureSource) size() int64 {
+	return src.manifest.Size
+}
+
+func (src *erasureSource) readRange(offset, length int64) (io.ReadCloser, error) {
+	return src.s.newErasureReader(src.ctx, src.bucket, src.manifest, offset, length, src.s.openPiece)
+}
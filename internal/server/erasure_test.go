@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// memPieces is an in-memory store of erasure pieces by key.
+type memPieces map[string][]byte
+
+func (p memPieces) open(_ context.Context, piece erasurePiece, offset int64) (io.ReadCloser, error) {
+	data, ok := p[piece.Key]
+	if !ok {
+		return nil, errNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data[min(offset, int64(len(data))):])), nil
+}
+
+// encodePieces erasure codes data with the given layout into memory. A
+// size of -1 encodes data as a stream of unknown length.
+func encodePieces(t *testing.T, data []byte, size int64, dataShards, parityShards int, blockSize int64) (*erasureManifest, memPieces) {
+	t.Helper()
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &erasureManifest{Size: size, DataShards: dataShards, ParityShards: parityShards, BlockSize: blockSize}
+	for i := range dataShards + parityShards {
+		m.Pieces = append(m.Pieces, erasurePiece{
+			Bucket: fmt.Sprintf("shard%d", i),
+			Key:    fmt.Sprintf("%stenant/block/0123/%d", erasurePrefix, i),
+		})
+	}
+
+	pieces := make(memPieces)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	writers := make([]*io.PipeWriter, len(m.Pieces))
+	for i, piece := range m.Pieces {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, _ := io.ReadAll(pr)
+			mu.Lock()
+			pieces[piece.Key] = data
+			mu.Unlock()
+		}()
+	}
+	err = encodeStripes(enc, m, bytes.NewReader(data), writers)
+	for _, pw := range writers {
+		pw.Close()
+	}
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, pieces
+}
+
+// readErasure reads length bytes at offset of the object m describes.
+func readErasure(s *TempoS3ShardServer, m *erasureManifest, pieces memPieces, offset, length int64) ([]byte, error) {
+	r, err := s.newErasureReader(context.Background(), "shard0", m, offset, length, pieces.open)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rand.IntN(256))
+	}
+	return data
+}
+
+func TestErasureRoundTrip(t *testing.T) {
+	s := newTestServer()
+	// Stripes of 4 blocks of 16 bytes
+	for _, size := range []int{1, 15, 16, 63, 64, 65, 3*64 + 17} {
+		for _, streamed := range []bool{false, true} {
+			data := randomBytes(size)
+			encodeSize := int64(size)
+			if streamed {
+				encodeSize = -1
+			}
+			m, pieces := encodePieces(t, data, encodeSize, 4, 2, 16)
+			if m.Size != int64(size) {
+				t.Fatalf("size %d: manifest records %d bytes", size, m.Size)
+			}
+			for _, piece := range m.Pieces {
+				if got, want := int64(len(pieces[piece.Key])), m.stripes()*m.BlockSize; got != want {
+					t.Fatalf("size %d: piece %s holds %d bytes, want %d", size, piece.Key, got, want)
+				}
+			}
+
+			got, err := readErasure(s, m, pieces, 0, m.Size)
+			if err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("size %d, streamed %v: read back different bytes", size, streamed)
+			}
+		}
+	}
+}
+
+// TestErasureMissingPieces drops every combination of up to ParityShards
+// pieces, and then one more.
+func TestErasureMissingPieces(t *testing.T) {
+	s := newTestServer()
+	data := randomBytes(5*64 + 9)
+	m, pieces := encodePieces(t, data, int64(len(data)), 4, 2, 16)
+
+	for i := range m.Pieces {
+		for j := i; j < len(m.Pieces); j++ {
+			available := make(memPieces)
+			for k, piece := range m.Pieces {
+				if k != i && k != j {
+					available[piece.Key] = pieces[piece.Key]
+				}
+			}
+			got, err := readErasure(s, m, available, 0, m.Size)
+			if err != nil {
+				t.Fatalf("pieces %d and %d missing: %v", i, j, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("pieces %d and %d missing: read back different bytes", i, j)
+			}
+		}
+	}
+
+	available := make(memPieces)
+	for _, piece := range m.Pieces[3:] {
+		available[piece.Key] = pieces[piece.Key]
+	}
+	if _, err := readErasure(s, m, available, 0, m.Size); !errors.Is(err, errTooFewPieces) {
+		t.Fatalf("three pieces missing got %v, want errTooFewPieces", err)
+	}
+}
+
+// TestErasureTruncatedPiece checks that a piece failing partway through
+// the object is replaced by parity from the stripe where it failed.
+func TestErasureTruncatedPiece(t *testing.T) {
+	s := newTestServer()
+	data := randomBytes(5 * 64)
+	m, pieces := encodePieces(t, data, int64(len(data)), 4, 2, 16)
+	for _, i := range []int{0, 3} {
+		damaged := make(memPieces)
+		for key, piece := range pieces {
+			damaged[key] = piece
+		}
+		// Two whole blocks, then a short one
+		key := m.Pieces[i].Key
+		damaged[key] = damaged[key][:2*m.BlockSize+5]
+
+		got, err := readErasure(s, m, damaged, 0, m.Size)
+		if err != nil {
+			t.Fatalf("piece %d truncated: %v", i, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("piece %d truncated: read back different bytes", i)
+		}
+	}
+}
+
+func TestErasureRanges(t *testing.T) {
+	s := newTestServer()
+	data := randomBytes(3*64 + 17)
+	m, pieces := encodePieces(t, data, int64(len(data)), 4, 2, 16)
+	// Reading around the first data piece exercises reconstruction
+	degraded := make(memPieces)
+	for key, piece := range pieces {
+		if key != m.Pieces[0].Key {
+			degraded[key] = piece
+		}
+	}
+
+	for _, tc := range []struct {
+		name           string
+		offset, length int64
+	}{
+		{"within a block", 3, 10},
+		{"across a block boundary", 10, 12},
+		{"across a stripe boundary", 60, 10},
+		{"a whole stripe", 64, 64},
+		{"across several stripes", 30, 150},
+		{"from a stripe start to the end", 128, int64(len(data)) - 128},
+		{"the padded last stripe", 195, 14},
+		{"the last byte", int64(len(data)) - 1, 1},
+		{"nothing", 70, 0},
+	} {
+		for name, available := range map[string]memPieces{"complete": pieces, "degraded": degraded} {
+			got, err := readErasure(s, m, available, tc.offset, tc.length)
+			if err != nil {
+				t.Fatalf("%s, %s: %v", tc.name, name, err)
+			}
+			if want := data[tc.offset : tc.offset+tc.length]; !bytes.Equal(got, want) {
+				t.Fatalf("%s, %s: read %d bytes differing from the %d at offset %d", tc.name, name, len(got), len(want), tc.offset)
+			}
+		}
+	}
+}
+
+func TestReservedKeysRejected(t *testing.T) {
+	s := newTestServer()
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete} {
+		for _, path := range []string{
+			"/tempo/.tss-erasure/tenant/block/0123/0",
+			"/tempo/%2Etss-erasure%2Ftenant/block",
+			"/tempo/.tss-lifecycle/lease",
+			"/tempo/%2Etss-lifecycle%2Flease",
+		} {
+			w := httptest.NewRecorder()
+			s.handleRequest(w, httptest.NewRequest(method, path, nil))
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s %s got %d, want 403", method, path, w.Code)
+			}
+		}
+	}
+
+	for _, key := range []string{"tenant/.tss-erasure/x", ".tss-erasurex", "tss-erasure/x", "tenant/.tss-lifecycle/lease", ".tss-lifecycle"} {
+		if isReservedKey(key) {
+			t.Errorf("client key %q reported as reserved", key)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"tempo-s3-shard/internal/metrics"
+)
+
+// flightGroup coalesces concurrent identical operations. The first caller
+// for a key becomes the leader and performs the operation; callers that
+// arrive while it is in flight wait for the leader's result instead of
+// issuing their own backend request.
+type flightGroup[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[V]
+}
+
+// flightCall is an in-flight operation. val and err are valid once done is
+// closed; shared reports whether the leader produced a result that waiters
+// may use.
+type flightCall[V any] struct {
+	done   chan struct{}
+	ended  bool
+	val    V
+	err    error
+	shared bool
+}
+
+func newFlightGroup[V any]() *flightGroup[V] {
+	return &flightGroup[V]{calls: make(map[string]*flightCall[V])}
+}
+
+// join returns the call in flight for key, or starts a new one. leader is
+// true if the caller must perform the operation and end it with finish or
+// abandon.
+func (g *flightGroup[V]) join(key string) (call *flightCall[V], leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call, false
+	}
+	call = &flightCall[V]{done: make(chan struct{})}
+	g.calls[key] = call
+	return call, true
+}
+
+// finish publishes the leader's result. Successes and NoSuchKey are shared
+// with waiters; any other error is not, since it may be specific to the
+// leader's request, and waiters retry on their own.
+func (g *flightGroup[V]) finish(key string, call *flightCall[V], val V, err error) {
+	g.end(key, call, val, err, err == nil || isNotFound(err))
+}
+
+// abandon ends the call without a result for waiters. It does nothing if
+// the call has already ended, so leaders can defer it.
+func (g *flightGroup[V]) abandon(key string, call *flightCall[V]) {
+	var zero V
+	g.end(key, call, zero, nil, false)
+}
+
+func (g *flightGroup[V]) end(key string, call *flightCall[V], val V, err error, shared bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	if call.ended {
+		return
+	}
+	call.ended = true
+	call.val, call.err, call.shared = val, err, shared
+	close(call.done)
+}
+
+// forget detaches the call in flight for key, if any, so that later
+// callers start a new one. It is used after writes: requests that arrived
+// before the write may still get the old result, later ones must not.
+func (g *flightGroup[V]) forget(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.calls, key)
+}
+
+// forgetAll detaches every call in flight.
+func (g *flightGroup[V]) forgetAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	clear(g.calls)
+}
+
+// wait blocks until the leader ends the call or ctx is done. shared is
+// false if the waiter must perform the operation itself.
+func (c *flightCall[V]) wait(ctx context.Context) (val V, shared bool, err error) {
+	select {
+	case <-c.done:
+		return c.val, c.shared, c.err
+	case <-ctx.Done():
+		return val, false, ctx.Err()
+	}
+}
+
+// coalesce runs fn once for concurrent callers with the same key, falling
+// back to calling fn directly when the leader's result cannot be shared.
+func coalesce[V any](ctx context.Context, g *flightGroup[V], op, key string, fn func() (V, error)) (V, error) {
+	if g == nil {
+		return fn()
+	}
+	call, leader := g.join(key)
+	if leader {
+		val, err := fn()
+		g.finish(key, call, val, err)
+		return val, err
+	}
+	val, shared, err := call.wait(ctx)
+	if shared {
+		metrics.CoalescedRequestsTotal.WithLabelValues(op).Inc()
+		return val, err
+	}
+	if ctx.Err() != nil {
+		return val, ctx.Err()
+	}
+	return fn()
+}
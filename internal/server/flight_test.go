@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tempo-s3-shard/internal/cache"
+)
+
+func TestFlightJoinAndFinish(t *testing.T) {
+	g := newFlightGroup[string]()
+	call, leader := g.join("k")
+	if !leader {
+		t.Fatal("first caller is not the leader")
+	}
+
+	const waiters = 20
+	var joined sync.WaitGroup
+	results := make(chan string, waiters)
+	for range waiters {
+		joined.Add(1)
+		go func() {
+			c, leader := g.join("k")
+			joined.Done()
+			if leader {
+				results <- "leader"
+				return
+			}
+			val, shared, err := c.wait(context.Background())
+			if !shared || err != nil {
+				results <- fmt.Sprintf("shared %v, err %v", shared, err)
+				return
+			}
+			results <- val
+		}()
+	}
+	joined.Wait()
+	g.finish("k", call, "value", nil)
+	for range waiters {
+		if got := <-results; got != "value" {
+			t.Fatalf("waiter got %s, want the leader's value", got)
+		}
+	}
+
+	// A finished call is no longer joined
+	if _, leader := g.join("k"); !leader {
+		t.Fatal("caller after the leader finished joined the old call")
+	}
+}
+
+func TestFlightSharesOnlyDefiniteResults(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		err    error
+		shared bool
+	}{
+		{"success", nil, true},
+		{"missing key", errNotFound, true},
+		// A failure may be specific to the leader's request
+		{"backend error", errBackend, false},
+	} {
+		g := newFlightGroup[string]()
+		call, _ := g.join("k")
+		waiter, _ := g.join("k")
+		g.finish("k", call, "value", tc.err)
+		_, shared, err := waiter.wait(context.Background())
+		if shared != tc.shared {
+			t.Errorf("%s: shared %v, want %v", tc.name, shared, tc.shared)
+		}
+		if shared && err != tc.err {
+			t.Errorf("%s: waiter got %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestFlightAbandon(t *testing.T) {
+	g := newFlightGroup[string]()
+	call, _ := g.join("k")
+	waiter, _ := g.join("k")
+	g.abandon("k", call)
+	if _, shared, err := waiter.wait(context.Background()); shared || err != nil {
+		t.Fatalf("abandoned call gave waiters shared %v, err %v", shared, err)
+	}
+
+	// Leaders defer abandon; after finish it must not change the result
+	call, _ = g.join("k")
+	waiter, _ = g.join("k")
+	g.finish("k", call, "value", nil)
+	g.abandon("k", call)
+	if val, shared, _ := waiter.wait(context.Background()); !shared || val != "value" {
+		t.Fatalf("abandon after finish changed the result to %q, shared %v", val, shared)
+	}
+}
+
+func TestFlightForget(t *testing.T) {
+	g := newFlightGroup[string]()
+	old, _ := g.join("k")
+	early, _ := g.join("k")
+
+	// After a write, new callers start a new call
+	g.forget("k")
+	current, leader := g.join("k")
+	if !leader {
+		t.Fatal("caller after forget joined the old call")
+	}
+	late, _ := g.join("k")
+
+	// The old leader ending must not detach the new call
+	g.finish("k", old, "old", nil)
+	if _, leader := g.join("k"); leader {
+		t.Fatal("old leader's finish detached the new call")
+	}
+	g.finish("k", current, "new", nil)
+
+	if val, _, _ := early.wait(context.Background()); val != "old" {
+		t.Fatalf("caller from before the write got %q, want the old result", val)
+	}
+	if val, _, _ := late.wait(context.Background()); val != "new" {
+		t.Fatalf("caller from after the write got %q, want the new result", val)
+	}
+
+	g.join("a")
+	g.join("b")
+	g.forgetAll()
+	if len(g.calls) != 0 {
+		t.Fatalf("%d calls in flight after forgetAll", len(g.calls))
+	}
+}
+
+func TestFlightWaitCancelled(t *testing.T) {
+	g := newFlightGroup[string]()
+	g.join("k")
+	waiter, _ := g.join("k")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, shared, err := waiter.wait(ctx); shared || err != context.DeadlineExceeded {
+		t.Fatalf("wait past its deadline got shared %v, err %v", shared, err)
+	}
+}
+
+// TestCoalesce checks that concurrent callers never run the operation
+// twice at once, and that all of them get its result.
+func TestCoalesce(t *testing.T) {
+	g := newFlightGroup[string]()
+	var running, calls atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+	fn := func() (string, error) {
+		if running.Add(1) > 1 {
+			t.Error("operation run concurrently")
+		}
+		defer running.Add(-1)
+		if calls.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		return "value", nil
+	}
+
+	const callers = 20
+	results := make(chan string, callers)
+	go func() {
+		val, _ := coalesce(context.Background(), g, "get", "k", fn)
+		results <- val
+	}()
+	<-started
+	var wg sync.WaitGroup
+	for range callers - 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, _ := coalesce(context.Background(), g, "get", "k", fn)
+			results <- val
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for range callers {
+		if val := <-results; val != "value" {
+			t.Fatalf("caller got %q", val)
+		}
+	}
+}
+
+// TestCoalesceFallback checks that waiters run the operation themselves
+// when the leader's failure cannot be shared.
+func TestCoalesceFallback(t *testing.T) {
+	g := newFlightGroup[string]()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+	fn := func() (string, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-release
+			return "", errBackend
+		}
+		return "value", nil
+	}
+
+	leaderErr := make(chan error)
+	go func() {
+		_, err := coalesce(context.Background(), g, "get", "k", fn)
+		leaderErr <- err
+	}()
+	<-started
+	waiterResult := make(chan string)
+	go func() {
+		val, _ := coalesce(context.Background(), g, "get", "k", fn)
+		waiterResult <- val
+	}()
+	close(release)
+	if err := <-leaderErr; err != errBackend {
+		t.Fatalf("leader got %v, want its own error", err)
+	}
+	if val := <-waiterResult; val != "value" {
+		t.Fatalf("waiter got %q, want the result of its own call", val)
+	}
+}
+
+// TestSharedEntryRanges checks that waiters sharing one whole-object
+// result each get the range they asked for.
+func TestSharedEntryRanges(t *testing.T) {
+	s := newTestServer()
+	entry := &cache.Entry{Data: []byte("0123456789"), ETag: "etag", LastModified: time.Now()}
+
+	for _, tc := range []struct {
+		rangeHeader string
+		status      int
+		body        string
+	}{
+		{"", http.StatusOK, "0123456789"},
+		{"bytes=0-3", http.StatusPartialContent, "0123"},
+		{"bytes=4-", http.StatusPartialContent, "456789"},
+		{"bytes=-2", http.StatusPartialContent, "89"},
+		{"bytes=20-30", http.StatusRequestedRangeNotSatisfiable, ""},
+	} {
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := httptest.NewRequest(http.MethodGet, "/tempo/k", nil)
+				if tc.rangeHeader != "" {
+					r.Header.Set("Range", tc.rangeHeader)
+				}
+				w := httptest.NewRecorder()
+				s.writeCached(w, r, "shard1", entry, time.Now())
+				if w.Code != tc.status {
+					t.Errorf("range %q got %d, want %d", tc.rangeHeader, w.Code, tc.status)
+				} else if tc.status != http.StatusRequestedRangeNotSatisfiable && w.Body.String() != tc.body {
+					t.Errorf("range %q got %q, want %q", tc.rangeHeader, w.Body, tc.body)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	if string(entry.Data) != "0123456789" {
+		t.Fatalf("shared entry changed to %q", entry.Data)
+	}
+}
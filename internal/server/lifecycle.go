@@ -0,0 +1,388 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// blockMetaFiles are deleted first when a block directory expires, so that
+// clients of other proxy replicas, which do not hide the directory, stop
+// seeing the block before the rest of it goes.
+var blockMetaFiles = []string{"meta.json", "meta.compacted.json"}
+
+// blockDir returns the block directory of key, its first two segments
+// with the trailing slash, or "" if key is not in one.
+func blockDir(key string) string {
+	first := strings.Index(key, "/")
+	if first < 0 {
+		return ""
+	}
+	second := strings.Index(key[first+1:], "/")
+	if second < 0 {
+		return ""
+	}
+	return key[:first+1+second+1]
+}
+
+// expiring reports whether key is being deleted by the lifecycle worker.
+// Such keys are hidden from clients so that a block directory disappears at
+// once rather than object by object.
+func (s *TempoS3ShardServer) expiring(key string) bool {
+	if _, ok := s.expired.Load(key); ok {
+		return true
+	}
+	if dir := blockDir(key); dir != "" {
+		_, ok := s.expired.Load(dir)
+		return ok
+	}
+	return false
+}
+
+// runLifecycle applies the lifecycle rules every lifecycle.interval until
+// the server shuts down, while this replica holds the lifecycle lease. The
+// lease is renewed every third of lifecycle.lease_duration, between and
+// during runs, and a run is cancelled if the lease is lost.
+func (s *TempoS3ShardServer) runLifecycle() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.done
+		cancel()
+	}()
+
+	holder := leaseHolder()
+	var leader context.Context
+	resign := func() {}
+	// running is closed when the current run ends; nil when none runs
+	var running chan struct{}
+	var expires time.Time
+	next := time.Now()
+	for {
+		start := time.Now()
+		held, err := s.acquireLease(ctx, holder)
+		if err != nil {
+			// A lease that could not be renewed still stands until it
+			// expires
+			held = leader != nil && time.Now().Before(expires)
+			s.logger.Warn("Failed to take or renew the lifecycle lease", "holder", holder, "error", err)
+		} else if held {
+			expires = start.Add(s.cfg().Lifecycle.LeaseDuration.Std())
+		}
+		switch {
+		case held && leader == nil:
+			leader, resign = context.WithCancel(ctx)
+			metrics.LifecycleLeader.Set(1)
+			s.logger.Info("Acquired the lifecycle lease", "holder", holder)
+		case !held && leader != nil:
+			resign()
+			leader = nil
+			metrics.LifecycleLeader.Set(0)
+			s.logger.Warn("Lost the lifecycle lease", "holder", holder)
+		}
+		if leader != nil && running == nil && !time.Now().Before(next) {
+			running = make(chan struct{})
+			go func(ctx context.Context, running chan struct{}) {
+				defer close(running)
+				s.applyLifecycle(ctx)
+			}(leader, running)
+		}
+
+		wait := s.cfg().Lifecycle.LeaseDuration.Std() / 3
+		if leader != nil && running == nil {
+			wait = min(wait, time.Until(next))
+		}
+		select {
+		case <-s.done:
+			resign()
+			return
+		case <-running:
+			running = nil
+			next = time.Now().Add(s.cfg().Lifecycle.Interval.Std())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// applyLifecycle makes one pass of every rule over all shards.
+func (s *TempoS3ShardServer) applyLifecycle(ctx context.Context) {
+	cfg := s.cfg().Lifecycle
+	start := time.Now()
+	run := &lifecycleRun{expired: make(map[string]bool), failed: make(map[string]bool)}
+	for _, rule := range cfg.Rules {
+		if rule.ExpireAfter > 0 {
+			s.expireObjects(ctx, rule, cfg.DryRun, run)
+		}
+		if rule.AbortIncompleteUploadsAfter > 0 {
+			s.abortIncompleteUploads(ctx, rule, cfg.DryRun)
+		}
+	}
+
+	// Cached listings may still hold the common prefixes of expired
+	// directories, so they are dropped before the directories are shown
+	// again
+	if s.listCache != nil && run.deleted {
+		s.listCache.clear()
+	}
+	// Groups with objects left stay hidden until a run deletes them. One
+	// that a complete run no longer lists is gone, or no longer matched
+	s.expired.Range(func(name, _ any) bool {
+		if !run.failed[name.(string)] && (run.expired[name.(string)] || !run.incomplete) {
+			s.expired.Delete(name)
+		}
+		return true
+	})
+	metrics.LifecycleLastRun.SetToCurrentTime()
+	s.logger.Info("Lifecycle run complete", "rules", len(cfg.Rules), "dry_run", cfg.DryRun, "hidden", len(run.failed), "duration_ms", time.Since(start).Seconds()*1000)
+}
+
+// lifecycleRun collects the outcome of one lifecycle run.
+type lifecycleRun struct {
+	// deleted is set once any object has been deleted.
+	deleted bool
+	// expired holds the groups whose objects were all deleted, and failed
+	// those with deletes that failed.
+	expired, failed map[string]bool
+	// incomplete is set when a listing failed, so that groups hidden by
+	// an earlier run may not have been seen.
+	incomplete bool
+}
+
+// expiryGroup is the set of objects that expire together: a block
+// directory, or a single object outside one.
+type expiryGroup struct {
+	name   string
+	keys   []string
+	bytes  int64
+	newest time.Time
+}
+
+// expireObjects deletes the objects matched by rule that are older than
+// its expire_after. A block directory the rule matches as a whole expires
+// once its newest object is old enough, and is then deleted entirely.
+func (s *TempoS3ShardServer) expireObjects(ctx context.Context, rule config.LifecycleRule, dryRun bool, run *lifecycleRun) {
+	cutoff := time.Now().Add(-rule.ExpireAfter.Std())
+	merger := s.newListMerger(ctx, rule.ListPrefix(), "")
+	err := merger.prime()
+
+	var group *expiryGroup
+	flush := func() {
+		if group != nil && group.newest.Before(cutoff) {
+			s.expireGroup(ctx, rule, group, dryRun, run)
+		}
+		group = nil
+	}
+	for err == nil {
+		var entry listEntry
+		var ok bool
+		entry, ok, err = merger.next()
+		if err != nil || !ok {
+			break
+		}
+		if !rule.Matches(entry.key) {
+			continue
+		}
+		name := entry.key
+		if dir := blockDir(entry.key); dir != "" && rule.Matches(dir) {
+			name = dir
+		}
+		if group == nil || group.name != name {
+			flush()
+			group = &expiryGroup{name: name}
+		}
+		group.keys = append(group.keys, entry.key)
+		group.bytes += entry.object.Size
+		if entry.object.LastModified.After(group.newest) {
+			group.newest = entry.object.LastModified
+		}
+	}
+	if err != nil {
+		// A directory cut short by the failure may have newer objects
+		// that were not listed
+		s.logger.Warn("Lifecycle listing failed", "rule", rule.ID, "prefix", rule.ListPrefix(), "error", err)
+		run.incomplete = true
+		return
+	}
+	flush()
+}
+
+// expireGroup deletes the objects of group, hiding them from clients until
+// the end of the lifecycle run, or until a later run if some of them could
+// not be deleted. Block metadata goes first.
+func (s *TempoS3ShardServer) expireGroup(ctx context.Context, rule config.LifecycleRule, group *expiryGroup, dryRun bool, run *lifecycleRun) {
+	if dryRun {
+		metrics.LifecycleExpiredObjectsTotal.WithLabelValues(rule.ID, "dry_run").Add(float64(len(group.keys)))
+		s.logger.Info("Lifecycle would expire objects", "rule", rule.ID, "name", group.name, "objects", len(group.keys), "bytes", group.bytes, "newest", group.newest)
+		return
+	}
+
+	s.expired.Store(group.name, struct{}{})
+	slices.SortStableFunc(group.keys, func(a, b string) int {
+		aMeta, bMeta := slices.Contains(blockMetaFiles, path.Base(a)), slices.Contains(blockMetaFiles, path.Base(b))
+		switch {
+		case aMeta && !bMeta:
+			return -1
+		case bMeta && !aMeta:
+			return 1
+		}
+		return 0
+	})
+	failed := 0
+	for _, key := range group.keys {
+		if err := s.deleteObject(ctx, key); err != nil {
+			failed++
+			metrics.LifecycleExpiredObjectsTotal.WithLabelValues(rule.ID, "error").Inc()
+			s.logger.Warn("Lifecycle failed to delete object", "rule", rule.ID, "object_key", key, "error", err)
+			continue
+		}
+		metrics.LifecycleExpiredObjectsTotal.WithLabelValues(rule.ID, "success").Inc()
+	}
+	if failed < len(group.keys) {
+		run.deleted = true
+	}
+	if failed > 0 {
+		run.failed[group.name] = true
+	} else {
+		run.expired[group.name] = true
+	}
+	s.logger.Info("Lifecycle expired objects", "rule", rule.ID, "name", group.name, "objects", len(group.keys)-failed, "failed", failed, "bytes", group.bytes, "newest", group.newest)
+}
+
+// abortIncompleteUploads aborts the multipart uploads matched by rule that
+// were started longer than its abort_incomplete_uploads_after ago, on
+// every shard, including those of erasure pieces.
+func (s *TempoS3ShardServer) abortIncompleteUploads(ctx context.Context, rule config.LifecycleRule, dryRun bool) {
+	cutoff := time.Now().Add(-rule.AbortIncompleteUploadsAfter.Std())
+	prefixes := []string{rule.ListPrefix()}
+	if prefixes[0] != "" {
+		prefixes = append(prefixes, erasurePrefix+prefixes[0])
+	}
+
+	core := minio.Core{Client: s.clients().GetClient()}
+	for _, bucket := range s.clients().GetAllBuckets() {
+		for _, prefix := range prefixes {
+			for info := range core.ListIncompleteUploads(ctx, bucket, prefix, true) {
+				if info.Err != nil {
+					s.logger.Warn("Lifecycle failed to list multipart uploads", "rule", rule.ID, "bucket", bucket, "prefix", prefix, "error", info.Err)
+					break
+				}
+				if !rule.Matches(strings.TrimPrefix(info.Key, erasurePrefix)) || !info.Initiated.Before(cutoff) {
+					continue
+				}
+				if dryRun {
+					metrics.LifecycleAbortedUploadsTotal.WithLabelValues(rule.ID, "dry_run").Inc()
+					s.logger.Info("Lifecycle would abort multipart upload", "rule", rule.ID, "bucket", bucket, "object_key", info.Key, "upload_id", info.UploadID, "initiated", info.Initiated)
+					continue
+				}
+				if err := core.AbortMultipartUpload(ctx, bucket, info.Key, info.UploadID); err != nil {
+					metrics.LifecycleAbortedUploadsTotal.WithLabelValues(rule.ID, "error").Inc()
+					s.logger.Warn("Lifecycle failed to abort multipart upload", "rule", rule.ID, "bucket", bucket, "object_key", info.Key, "upload_id", info.UploadID, "error", err)
+					continue
+				}
+				metrics.LifecycleAbortedUploadsTotal.WithLabelValues(rule.ID, "success").Inc()
+				s.logger.Info("Lifecycle aborted multipart upload", "rule", rule.ID, "bucket", bucket, "object_key", info.Key, "upload_id", info.UploadID, "initiated", info.Initiated)
+			}
+		}
+	}
+}
+
+// lifecyclePrefix is the reserved key prefix of the lifecycle lease. Keys
+// under it are hidden from listings.
+const lifecyclePrefix = ".tss-lifecycle/"
+
+// lifecycleLeaseKey is the object on the first shard bucket that records
+// which proxy replica runs the lifecycle worker.
+const lifecycleLeaseKey = lifecyclePrefix + "lease"
+
+// maxLeaseSize bounds the lease object read back.
+const maxLeaseSize = 4 << 10
+
+// lifecycleLease is the body of the lease object.
+type lifecycleLease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// leaseHolder returns a name for this process in the lease: its host name,
+// which is the pod name on Kubernetes, and a random suffix in case a
+// restarted pod keeps it.
+func leaseHolder() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// acquireLease takes the lifecycle lease for holder, or renews it, for
+// lifecycle.lease_duration. It reports false while another holder's lease
+// has not expired. The lease object is replaced with conditional writes,
+// so that of replicas racing for an expired lease only one wins.
+func (s *TempoS3ShardServer) acquireLease(ctx context.Context, holder string) (bool, error) {
+	bucket := s.cfg().Buckets[0]
+	var current lifecycleLease
+	etag := ""
+	err := s.retryBackend(ctx, "get", bucket, func() error {
+		object, err := s.clients().GetIdempotentClient().GetObject(ctx, bucket, lifecycleLeaseKey, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+		info, err := object.Stat()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(object, maxLeaseSize))
+		if err != nil {
+			return err
+		}
+		// An unreadable lease is taken over as if it had expired
+		current = lifecycleLease{}
+		json.Unmarshal(data, &current)
+		etag = info.ETag
+		return nil
+	})
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+
+	now := time.Now()
+	if etag != "" && current.Holder != holder && now.Before(current.Expires) {
+		return false, nil
+	}
+	data, _ := json.Marshal(lifecycleLease{Holder: holder, Expires: now.Add(s.cfg().Lifecycle.LeaseDuration.Std())})
+	opts := minio.PutObjectOptions{ContentType: "application/json"}
+	if etag == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(etag)
+	}
+	err = s.callBackend(ctx, "put", bucket, func() error {
+		_, err := s.putObject(ctx, bucket, lifecycleLeaseKey, bytes.NewReader(data), int64(len(data)), opts)
+		return err
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// isConditionFailed reports whether err means a conditional write lost to
+// a concurrent one.
+func isConditionFailed(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "PreconditionFailed" || resp.Code == "ConditionalRequestConflict" ||
+		resp.StatusCode == http.StatusPreconditionFailed
+}
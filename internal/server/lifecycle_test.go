@@ -0,0 +1,399 @@
+package server
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tempo-s3-shard/internal/client"
+	"tempo-s3-shard/internal/config"
+)
+
+// fakeS3 is an in-memory S3 backend holding the shard buckets. It serves
+// the object reads and writes, conditional PUTs, and ListObjectsV2.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]map[string]fakeObject
+	// deleted records the keys deleted, in order.
+	deleted []string
+	// fail, if set, is called for every request and fails it with the
+	// status it returns, if not 0.
+	fail func(r *http.Request, bucket, key string) int
+}
+
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string]map[string]fakeObject)}
+}
+
+// store adds an object to bucket, last modified at modified.
+func (f *fakeS3) store(bucket, key string, data []byte, modified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sum := md5.Sum(data)
+	if f.objects[bucket] == nil {
+		f.objects[bucket] = make(map[string]fakeObject)
+	}
+	f.objects[bucket][key] = fakeObject{data: data, etag: `"` + hex.EncodeToString(sum[:]) + `"`, modified: modified.UTC().Truncate(time.Second)}
+}
+
+func (f *fakeS3) get(bucket, key string) (fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[bucket][key]
+	return object, ok
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if f.fail != nil {
+		if status := f.fail(r, bucket, key); status != 0 {
+			fakeError(w, r, status, "InternalError")
+			return
+		}
+	}
+	if key == "" {
+		f.list(w, r, bucket)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, exists := f.objects[bucket][key]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			fakeError(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", object.etag)
+		w.Header().Set("Last-Modified", object.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(object.data)
+		}
+	case http.MethodPut:
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != object.etag) ||
+			r.Header.Get("If-None-Match") == "*" && exists {
+			fakeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			fakeError(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		sum := md5.Sum(data)
+		if f.objects[bucket] == nil {
+			f.objects[bucket] = make(map[string]fakeObject)
+		}
+		object = fakeObject{data: data, etag: `"` + hex.EncodeToString(sum[:]) + `"`, modified: time.Now().UTC().Truncate(time.Second)}
+		f.objects[bucket][key] = object
+		w.Header().Set("ETag", object.etag)
+	case http.MethodDelete:
+		delete(f.objects[bucket], key)
+		f.deleted = append(f.deleted, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeError(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// readBody reads the body of a PUT, decoding the chunks of a streaming
+// signed upload.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	body := bufio.NewReader(r.Body)
+	for {
+		header, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, n+2)
+		if _, err := io.ReadFull(body, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:n]...)
+	}
+}
+
+type fakeListing struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeListEntry
+}
+
+type fakeListEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	after := max(query.Get("start-after"), query.Get("continuation-token"))
+	maxKeys, err := strconv.Atoi(query.Get("max-keys"))
+	if err != nil {
+		maxKeys = 1000
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects[bucket] {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	result := fakeListing{Name: bucket, Prefix: prefix, MaxKeys: maxKeys}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		object := f.objects[bucket][key]
+		result.Contents = append(result.Contents, fakeListEntry{
+			Key:          key,
+			LastModified: object.modified.Format(time.RFC3339),
+			ETag:         object.etag,
+			Size:         len(object.data),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func fakeError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+}
+
+// newLifecycleServer returns a test server over three shard buckets held
+// by a fakeS3, expiring objects of tenant t an hour old.
+func newLifecycleServer(t *testing.T) (*TempoS3ShardServer, *fakeS3) {
+	t.Helper()
+	backend := newFakeS3()
+	srv := httptest.NewServer(backend)
+	t.Cleanup(srv.Close)
+
+	s := newTestServer()
+	cfg := s.cfg()
+	cfg.Endpoint = srv.URL
+	cfg.Region = "us-east-1"
+	cfg.Credentials.Provider = config.CredentialsStatic
+	cfg.AccessKeyID, cfg.SecretAccessKey = "a", "b"
+	cfg.Buckets = []string{"shard1", "shard2", "shard3"}
+	cfg.Replication = config.ReplicationConfig{Factor: 1, WriteQuorum: 1}
+	cfg.Lifecycle = config.LifecycleConfig{
+		Enabled:       true,
+		LeaseDuration: config.Duration(time.Minute),
+		Rules:         []config.LifecycleRule{{ID: "t", Tenant: "t", ExpireAfter: config.Duration(time.Hour)}},
+	}
+	clients, err := client.NewS3ClientManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.runtime().clients = clients
+	return s, backend
+}
+
+// storeObject stores key in the shard bucket the ring maps it to.
+func storeObject(s *TempoS3ShardServer, backend *fakeS3, key string, modified time.Time) {
+	backend.store(s.clients().GetBucketForKey(key), key, []byte(key), modified)
+}
+
+func storedKeys(backend *fakeS3) []string {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	var keys []string
+	for _, objects := range backend.objects {
+		for key := range objects {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestLifecycleLease(t *testing.T) {
+	s, backend := newLifecycleServer(t)
+	ctx := t.Context()
+
+	if held, err := s.acquireLease(ctx, "a"); !held || err != nil {
+		t.Fatalf("free lease not taken: %v, %v", held, err)
+	}
+	if held, err := s.acquireLease(ctx, "b"); held || err != nil {
+		t.Fatalf("lease held by another taken: %v, %v", held, err)
+	}
+	if held, err := s.acquireLease(ctx, "a"); !held || err != nil {
+		t.Fatalf("own lease not renewed: %v, %v", held, err)
+	}
+
+	// An expired lease is taken over
+	expired, _ := json.Marshal(lifecycleLease{Holder: "a", Expires: time.Now().Add(-time.Second)})
+	backend.store("shard1", lifecycleLeaseKey, expired, time.Now())
+	if held, err := s.acquireLease(ctx, "b"); !held || err != nil {
+		t.Fatalf("expired lease not taken over: %v, %v", held, err)
+	}
+	object, ok := backend.get("shard1", lifecycleLeaseKey)
+	if !ok {
+		t.Fatal("lease not stored on the first bucket")
+	}
+	var lease lifecycleLease
+	if err := json.Unmarshal(object.data, &lease); err != nil || lease.Holder != "b" {
+		t.Fatalf("lease holds %s, %v, want holder b", object.data, err)
+	}
+
+	// A replica that renews the lease between our read and write wins
+	backend.store("shard1", lifecycleLeaseKey, expired, time.Now())
+	backend.fail = func(r *http.Request, bucket, key string) int {
+		if r.Method == http.MethodPut && key == lifecycleLeaseKey {
+			backend.fail = nil
+			backend.store(bucket, key, []byte(`{"holder": "c"}`), time.Now())
+		}
+		return 0
+	}
+	if held, err := s.acquireLease(ctx, "b"); held || err != nil {
+		t.Fatalf("lease lost to a concurrent write got %v, %v", held, err)
+	}
+
+	// The lease is hidden from listings
+	entries, _, err := s.listPage(ctx, "shard1", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("listing shows %s", entryKeys(entries))
+	}
+}
+
+func TestLifecycleExpiresBlocks(t *testing.T) {
+	s, backend := newLifecycleServer(t)
+	old, recent := time.Now().Add(-2*time.Hour), time.Now().Add(-time.Minute)
+	for _, key := range []string{"t/old/data", "t/old/index", "t/old/meta.json", "t/old/meta.compacted.json"} {
+		storeObject(s, backend, key, old)
+	}
+	// A block is kept while any of its objects is recent
+	storeObject(s, backend, "t/live/data", old)
+	storeObject(s, backend, "t/live/meta.json", recent)
+	storeObject(s, backend, "t/single", old)
+	storeObject(s, backend, "u/old/data", old)
+
+	// The first run cannot delete the block's data
+	var hiddenDuringRun bool
+	backend.fail = func(r *http.Request, bucket, key string) int {
+		if r.Method == http.MethodDelete && key == "t/old/data" {
+			hiddenDuringRun = s.expiring("t/old/data") && s.expiring("t/old/index")
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	s.applyLifecycle(t.Context())
+	if !hiddenDuringRun {
+		t.Fatal("block not hidden while it was being deleted")
+	}
+	if got, want := strings.Join(storedKeys(backend), ","), "t/live/data,t/live/meta.json,t/old/data,u/old/data"; got != want {
+		t.Fatalf("after the first run stored %s, want %s", got, want)
+	}
+	if deleted := backend.deleted; len(deleted) < 2 || !slices.Contains(blockMetaFiles, deleted[0][len("t/old/"):]) ||
+		!slices.Contains(blockMetaFiles, deleted[1][len("t/old/"):]) {
+		t.Fatalf("deleted %v, want the block's metadata first", deleted)
+	}
+	// The block stays hidden while objects of it remain
+	if !s.expiring("t/old/data") {
+		t.Fatal("partly deleted block shown again")
+	}
+	if s.expiring("t/single") || s.expiring("t/live/data") {
+		t.Fatal("objects hidden after the run")
+	}
+
+	backend.fail = nil
+	s.applyLifecycle(t.Context())
+	if got, want := strings.Join(storedKeys(backend), ","), "t/live/data,t/live/meta.json,u/old/data"; got != want {
+		t.Fatalf("after the second run stored %s, want %s", got, want)
+	}
+	if s.expiring("t/old/data") {
+		t.Fatal("deleted block still hidden")
+	}
+}
+
+// TestLifecycleFailedListing checks that a block hidden by an earlier run
+// stays hidden when a run cannot list it.
+func TestLifecycleFailedListing(t *testing.T) {
+	s, backend := newLifecycleServer(t)
+	s.cfg().Retry = config.RetryConfig{MaxAttempts: 1}
+	s.expired.Store("t/old/", struct{}{})
+	backend.fail = func(r *http.Request, bucket, key string) int {
+		if key == "" {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	s.applyLifecycle(t.Context())
+	if !s.expiring("t/old/data") {
+		t.Fatal("block unhidden by a run that could not list it")
+	}
+
+	backend.fail = nil
+	s.applyLifecycle(t.Context())
+	if s.expiring("t/old/data") {
+		t.Fatal("block no longer listed still hidden")
+	}
+}
+
+func TestLifecycleDryRun(t *testing.T) {
+	s, backend := newLifecycleServer(t)
+	s.cfg().Lifecycle.DryRun = true
+	storeObject(s, backend, "t/old/meta.json", time.Now().Add(-2*time.Hour))
+	storeObject(s, backend, "t/single", time.Now().Add(-2*time.Hour))
+
+	s.applyLifecycle(t.Context())
+	if len(backend.deleted) != 0 {
+		t.Fatalf("dry run deleted %v", backend.deleted)
+	}
+	if s.expiring("t/old/meta.json") || s.expiring("t/single") {
+		t.Fatal("dry run hid objects")
+	}
+}
@@ -0,0 +1,561 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// listPageSize is the number of keys requested per backend list call. It
+// also bounds how many entries each shard buffers ahead of the merge.
+const listPageSize = 1000
+
+func (s *TempoS3ShardServer) handleListObjects(w http.ResponseWriter, r *http.Request, bucketName string) {
+	start := time.Now()
+	// The list timeout bounds each page request to a shard rather than the
+	// whole response, which streams for as long as the client reads it
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+	maxKeysStr := r.URL.Query().Get("max-keys")
+	marker := r.URL.Query().Get("marker")
+
+	maxKeys := 1000
+	if maxKeysStr != "" {
+		if mk, err := strconv.Atoi(maxKeysStr); err == nil && mk > 0 {
+			maxKeys = mk
+		}
+	}
+
+	// Record list operation
+	metrics.ListOperationsTotal.WithLabelValues(prefix).Inc()
+
+	cacheKey := listCacheKey{prefix: prefix, delimiter: delimiter}
+	var src listSource
+	if s.listCache != nil && r.Header.Get("Cache-Control") != "no-cache" {
+		if entries, ok := s.listCache.lookup(cacheKey); ok {
+			src = &sliceSource{entries: entries}
+		}
+	} else if s.listCache != nil {
+		metrics.ListCacheRequestsTotal.WithLabelValues("bypass").Inc()
+	}
+	
+	// Concurrent identical listings wait for the first one and replay its
+	// entries
+	var flight *flightCall[[]listEntry]
+	flightKey := prefix + "\x00" + delimiter
+	if src == nil && s.listFlights != nil {
+		call, leader := s.listFlights.join(flightKey)
+		if leader {
+			flight = call
+			defer s.listFlights.abandon(flightKey, call)
+		} else if entries, shared, _ := call.wait(ctx); shared {
+			metrics.CoalescedRequestsTotal.WithLabelValues("list").Inc()
+			src = &sliceSource{entries: entries}
+		}
+	}
+	
+	// A listing fetched from the backends is captured to fill the cache
+	// and to share with coalesced requests
+	var merger *listMerger
+	var captured []listEntry
+	filling := false
+	var fillStart uint64
+	if src == nil {
+		if s.listCache != nil {
+			filling = true
+			fillStart = s.listCache.beginFill()
+		}
+		merger = s.newListMerger(ctx, prefix, delimiter)
+		src = merger
+	}
+	abortFill := func() {
+		if filling {
+			s.listCache.abort(fillStart)
+			filling = false
+		}
+	}
+	defer abortFill()
+	
+	if err := src.prime(); err != nil {
+		if reason := listAbortReason(r, ctx, err); reason != "" {
+			metrics.RequestAbortsTotal.WithLabelValues("list", "", reason).Inc()
+			if reason == "client_cancelled" {
+				w.WriteHeader(statusClientClosedRequest)
+			} else {
+				s.logger.Warn("List timed out", "bucket", bucketName, "prefix", prefix, "error", err)
+				writeS3Error(w, r, http.StatusGatewayTimeout, "RequestTimeout", "The backend did not respond in time")
+			}
+			return
+		}
+		// Fail the whole listing rather than return a partial view that
+		// would make clients believe objects have disappeared
+		s.logger.Warn("Failing list, shard unavailable", "bucket", bucketName, "prefix", prefix, "error", err)
+		writeShardUnavailable(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+
+	enc := xml.NewEncoder(w)
+	root := xml.StartElement{
+		Name: xml.Name{Local: "ListBucketResult"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: "http://s3.amazonaws.com/doc/2006-03-01/"}},
+	}
+	enc.EncodeToken(root)
+	enc.EncodeElement(bucketName, xml.StartElement{Name: xml.Name{Local: "Name"}})
+	enc.EncodeElement(prefix, xml.StartElement{Name: xml.Name{Local: "Prefix"}})
+	enc.EncodeElement(marker, xml.StartElement{Name: xml.Name{Local: "Marker"}})
+	enc.EncodeElement(maxKeys, xml.StartElement{Name: xml.Name{Local: "MaxKeys"}})
+	if delimiter != "" {
+		enc.EncodeElement(delimiter, xml.StartElement{Name: xml.Name{Local: "Delimiter"}})
+	}
+	enc.EncodeElement(false, xml.StartElement{Name: xml.Name{Local: "IsTruncated"}})
+
+	objectCount, prefixCount := 0, 0
+	for {
+		entry, ok, err := src.next()
+		if err != nil {
+			// The status line is already sent. Leave the document unclosed so
+			// clients fail to parse it instead of trusting a partial listing.
+			enc.Flush()
+			if reason := listAbortReason(r, ctx, err); reason != "" {
+				metrics.RequestAbortsTotal.WithLabelValues("list", "", reason).Inc()
+			}
+			s.logger.Error("Aborting list, shard failed mid-stream", "bucket", bucketName, "prefix", prefix, "error", err)
+			return
+		}
+		if !ok {
+			break
+		}
+		if filling || flight != nil {
+			captured = append(captured, entry)
+			if filling && len(captured) > s.cfg().ListCache.MaxEntries {
+				abortFill()
+			}
+			if flight != nil && len(captured) > s.cfg().SingleFlight.MaxListEntries {
+				s.listFlights.abandon(flightKey, flight)
+				flight = nil
+			}
+			if !filling && flight == nil {
+				captured = nil
+			}
+		}
+
+		if s.expiring(entry.key) {
+			continue
+		}
+		if entry.isPrefix {
+			enc.EncodeElement(listCommonPrefix{Prefix: entry.key}, xml.StartElement{Name: xml.Name{Local: "CommonPrefixes"}})
+			prefixCount++
+			continue
+		}
+		enc.EncodeElement(listContents{
+			Key:          entry.key,
+			LastModified: entry.object.LastModified.Format(time.RFC3339),
+			ETag:         `"` + entry.object.ETag + `"`,
+			Size:         entry.object.Size,
+			StorageClass: "STANDARD",
+		}, xml.StartElement{Name: xml.Name{Local: "Contents"}})
+		objectCount++
+	}
+
+	enc.EncodeToken(root.End())
+	if err := enc.Flush(); err != nil {
+		s.logger.Debug("Client went away during list", "bucket", bucketName, "prefix", prefix, "error", err)
+	}
+	if merger != nil && !merger.partial {
+		if flight != nil {
+			s.listFlights.finish(flightKey, flight, captured, nil)
+		}
+		if filling {
+			// The cache patches its listings in place, so it must not hold
+			// the slice shared with waiters
+			if flight != nil {
+				captured = slices.Clone(captured)
+			}
+			s.listCache.commit(cacheKey, captured, fillStart)
+			filling = false
+		}
+	}
+	if merger == nil {
+		s.logger.Debug("List objects served without listing shards", "bucket", bucketName, "prefix", prefix, "object_count", objectCount, "prefix_count", prefixCount)
+		return
+	}
+
+	// Record overall list operation metrics
+	duration := time.Since(start).Seconds()
+	s.logger.Debug("List objects operation completed",
+		"bucket", bucketName,
+		"prefix", prefix,
+		"object_count", objectCount,
+		"prefix_count", prefixCount,
+		"duration_ms", duration*1000,
+		"shard_duration_ms", merger.shardDurations(),
+	)
+}
+
+// listSource yields the entries of a listing in key order. prime is called
+// once before the response starts so that early failures get an error
+// status.
+type listSource interface {
+	prime() error
+	next() (listEntry, bool, error)
+}
+
+type listContents struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type listCommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listEntry is a single object or common prefix in a shard listing.
+type listEntry struct {
+	key      string
+	isPrefix bool
+	object   minio.ObjectInfo
+}
+
+// shardStream carries the entries of one shard bucket in key order. err,
+// count and duration are only valid once entries has been closed.
+type shardStream struct {
+	index    int
+	bucket   string
+	entries  chan listEntry
+	head     listEntry
+	err      error
+	count    int
+	duration time.Duration
+}
+
+// listMerger merges the sorted shard streams into a single sorted listing,
+// holding at most one buffered page per shard in memory.
+type listMerger struct {
+	s       *TempoS3ShardServer
+	ctx     context.Context
+	prefix  string
+	streams []*shardStream
+	heap    streamHeap
+	lastKey string
+	emitted bool
+	// partial is set once a failed shard has been omitted.
+	partial bool
+}
+
+// newListMerger starts listing every shard bucket in the background. The
+// number of backend list calls in flight is bounded by the configured list
+// concurrency.
+func (s *TempoS3ShardServer) newListMerger(ctx context.Context, prefix, delimiter string) *listMerger {
+	return s.mergeShards(ctx, s.clients().GetAllBuckets(), prefix, func(ctx context.Context, bucket, startAfter string) ([]listEntry, string, error) {
+		return s.listPage(ctx, bucket, prefix, delimiter, startAfter)
+	})
+}
+
+// shardPager fetches the page of a shard listing that follows the backend
+// key startAfter, in key order. It also returns the key that the next page
+// starts after, or "" at the end of the listing.
+type shardPager func(ctx context.Context, bucket, startAfter string) ([]listEntry, string, error)
+
+// mergeShards starts paging through buckets with pager and returns the
+// merger of their listings.
+func (s *TempoS3ShardServer) mergeShards(ctx context.Context, buckets []string, prefix string, pager shardPager) *listMerger {
+	concurrency := s.cfg().List.Concurrency
+	if concurrency <= 0 || concurrency > len(buckets) {
+		concurrency = len(buckets)
+	}
+	sem := make(chan struct{}, concurrency)
+
+	m := &listMerger{s: s, ctx: ctx, prefix: prefix}
+	for i, bucket := range buckets {
+		st := &shardStream{
+			index:   i,
+			bucket:  bucket,
+			entries: make(chan listEntry, listPageSize),
+		}
+		m.streams = append(m.streams, st)
+		go s.listShard(ctx, st, prefix, pager, sem)
+	}
+	return m
+}
+
+// prime waits for the first entry of every shard so that shards failing
+// up front can still be reported with a proper error status.
+func (m *listMerger) prime() error {
+	for _, st := range m.streams {
+		if err := m.advance(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next returns the next entry in key order, skipping keys already returned
+// by another shard.
+func (m *listMerger) next() (listEntry, bool, error) {
+	for m.heap.Len() > 0 {
+		st := heap.Pop(&m.heap).(*shardStream)
+		entry := st.head
+		if err := m.advance(st); err != nil {
+			return listEntry{}, false, err
+		}
+		if m.emitted && entry.key == m.lastKey {
+			continue
+		}
+		m.lastKey = entry.key
+		m.emitted = true
+		return entry, true, nil
+	}
+	return listEntry{}, false, nil
+}
+
+// advance reads the next entry of st and pushes it back on the heap. A
+// failed shard either aborts the merge or is dropped, per failure policy;
+// the merge is always aborted once the request itself has ended.
+func (m *listMerger) advance(st *shardStream) error {
+	entry, ok := <-st.entries
+	if ok {
+		st.head = entry
+		heap.Push(&m.heap, st)
+		return nil
+	}
+	if st.err == nil {
+		return nil
+	}
+	if m.ctx.Err() == nil && m.s.cfg().List.FailurePolicy == config.ListFailurePolicyPartial {
+		m.s.logger.Warn("Omitting failed shard from list", "bucket", st.bucket, "prefix", m.prefix, "error", st.err)
+		m.partial = true
+		return nil
+	}
+	return st.err
+}
+
+// shardDurations returns the time each finished shard took to list, in
+// milliseconds.
+func (m *listMerger) shardDurations() map[string]float64 {
+	durations := make(map[string]float64, len(m.streams))
+	for _, st := range m.streams {
+		durations[st.bucket] = float64(st.duration.Microseconds()) / 1000
+	}
+	return durations
+}
+
+type streamHeap []*shardStream
+
+func (h streamHeap) Len() int { return len(h) }
+func (h streamHeap) Less(i, j int) bool {
+	if h[i].head.key == h[j].head.key {
+		return h[i].index < h[j].index
+	}
+	return h[i].head.key < h[j].head.key
+}
+func (h streamHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *streamHeap) Push(x interface{}) { *h = append(*h, x.(*shardStream)) }
+func (h *streamHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// pageTimeout returns the time limit for each page requested from a shard:
+// the shorter of the list timeout and the per-shard timeout, or zero if
+// neither is set.
+func (s *TempoS3ShardServer) pageTimeout() time.Duration {
+	timeout := s.cfg().Timeouts.List.Std()
+	if shard := s.cfg().List.ShardTimeout.Std(); shard > 0 && (timeout <= 0 || shard < timeout) {
+		timeout = shard
+	}
+	return max(timeout, 0)
+}
+
+// listAbortReason is abortReason for a listing, whose context carries no
+// deadline of its own: a page request that timed out is reported through
+// err.
+func listAbortReason(r *http.Request, ctx context.Context, err error) string {
+	if reason := abortReason(r, ctx); reason != "" {
+		return reason
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "backend_timeout"
+	}
+	return ""
+}
+
+// listShard pages through a single shard bucket, feeding entries into
+// st.entries in key order until the listing ends, fails, or ctx is done.
+func (s *TempoS3ShardServer) listShard(ctx context.Context, st *shardStream, prefix string, pager shardPager, sem chan struct{}) {
+	start := time.Now()
+	defer close(st.entries)
+	// The timeout bounds each page request, not the whole stream: time
+	// spent waiting for the merge to consume entries is not the shard's.
+	timeout := s.pageTimeout()
+
+	startAfter := ""
+	for st.err == nil {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			st.err = ctx.Err()
+			continue
+		}
+
+		var page []listEntry
+		var next string
+		err := s.retryBackend(ctx, "list", st.bucket, func() error {
+			pageCtx, cancel := ctx, context.CancelFunc(func() {})
+			if timeout > 0 {
+				pageCtx, cancel = context.WithTimeout(ctx, timeout)
+			}
+			defer cancel()
+			var err error
+			page, next, err = pager(pageCtx, st.bucket, startAfter)
+			return err
+		})
+		<-sem
+		if err != nil {
+			st.err = err
+			break
+		}
+
+		for _, entry := range page {
+			select {
+			case st.entries <- entry:
+				st.count++
+			case <-ctx.Done():
+				st.err = ctx.Err()
+			}
+			if st.err != nil {
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		startAfter = next
+	}
+	st.duration = time.Since(start)
+
+	status := "success"
+	switch {
+	case errors.Is(st.err, errShardUnavailable):
+		status = "unavailable"
+	case errors.Is(st.err, errOverloaded):
+		status = "overloaded"
+	case errors.Is(st.err, context.DeadlineExceeded):
+		status = "timeout"
+	case errors.Is(st.err, context.Canceled):
+		status = "cancelled"
+	case st.err != nil:
+		status = "error"
+	}
+	if st.err != nil && status != "cancelled" {
+		s.logger.Error("Error listing objects", "bucket", st.bucket, "prefix", prefix, "status", status, "error", st.err)
+	}
+
+	metrics.S3OperationsTotal.WithLabelValues("list", st.bucket, status).Inc()
+	metrics.S3OperationDuration.WithLabelValues("list", st.bucket).Observe(st.duration.Seconds())
+	metrics.ListObjectsCount.WithLabelValues(st.bucket).Observe(float64(st.count))
+	metrics.BucketOperationsTotal.WithLabelValues(st.bucket, "list").Inc()
+
+	s.logger.Debug("List shard completed",
+		"bucket", st.bucket,
+		"prefix", prefix,
+		"status", status,
+		"object_count", st.count,
+		"duration_ms", float64(st.duration.Microseconds())/1000,
+	)
+}
+
+// listPage fetches the page of a shard listing that follows startAfter.
+// The listing runs under a context of its own, cancelled once the page has
+// been read, so the iterator neither outlives the call nor goes on to fetch
+// the following page.
+//
+// minio-go only delimits at "/", so other delimiters are applied here to a
+// recursive listing.
+func (s *TempoS3ShardServer) listPage(ctx context.Context, bucket, prefix, delimiter, startAfter string) ([]listEntry, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opts := minio.ListObjectsOptions{
+		Prefix:     prefix,
+		Recursive:  delimiter != "/",
+		StartAfter: startAfter,
+		MaxKeys:    listPageSize,
+	}
+	entries := make([]listEntry, 0, listPageSize)
+	read, last := 0, ""
+	for object := range s.clients().GetIdempotentClient().ListObjectsIter(ctx, bucket, opts) {
+		if object.Err != nil {
+			return nil, "", object.Err
+		}
+		read++
+		last = max(last, object.Key)
+		// A listing that starts after a common prefix returns that prefix
+		// again when keys under it follow
+		if entry, ok := pageEntry(object, prefix, delimiter); ok && entry.key > startAfter {
+			entries = append(entries, entry)
+		}
+		if read == listPageSize {
+			break
+		}
+	}
+	if read < listPageSize {
+		last = ""
+	}
+	return sortPage(entries), last, nil
+}
+
+// pageEntry converts an object returned by a shard listing to a list
+// entry, rolling it up into its common prefix for delimiters other than
+// "/". It reports false for the proxy's internal keys.
+func pageEntry(object minio.ObjectInfo, prefix, delimiter string) (listEntry, bool) {
+	if isReservedKey(object.Key) {
+		return listEntry{}, false
+	}
+	if delimiter != "" && delimiter != "/" {
+		if i := strings.Index(object.Key[len(prefix):], delimiter); i >= 0 {
+			return listEntry{key: object.Key[:len(prefix)+i+len(delimiter)], isPrefix: true}, true
+		}
+	}
+	// Common prefixes come back as bare keys, without an ETag
+	if delimiter == "/" && object.ETag == "" && strings.HasSuffix(object.Key, "/") {
+		return listEntry{key: object.Key, isPrefix: true}, true
+	}
+	object.ETag = strings.Trim(object.ETag, `"`)
+	return listEntry{key: object.Key, object: object}, true
+}
+
+// sortPage puts the entries of a page in key order and drops repeated
+// common prefixes. Each page covers a contiguous key range, but S3 returns
+// its objects and prefixes as two separate lists.
+func sortPage(entries []listEntry) []listEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return slices.CompactFunc(entries, func(a, b listEntry) bool {
+		return a.isPrefix && b.isPrefix && a.key == b.key
+	})
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tempo-s3-shard/internal/config"
+)
+
+// fakeShards lists keys spread round-robin over a number of shards, as
+// consistent hashing does, generating each page on demand.
+type fakeShards struct {
+	shards int
+	keys   int
+}
+
+func (f fakeShards) buckets() []string {
+	buckets := make([]string, f.shards)
+	for i := range buckets {
+		buckets[i] = "shard" + strconv.Itoa(i)
+	}
+	return buckets
+}
+
+func fakeKey(n int) string {
+	return fmt.Sprintf("tenant/%012d", n)
+}
+
+func (f fakeShards) page(_ context.Context, bucket, startAfter string) ([]listEntry, string, error) {
+	shard, _ := strconv.Atoi(strings.TrimPrefix(bucket, "shard"))
+	n := shard
+	if startAfter != "" {
+		last, _ := strconv.Atoi(strings.TrimPrefix(startAfter, "tenant/"))
+		n = last + f.shards
+	}
+	entries := make([]listEntry, 0, listPageSize)
+	for ; n < f.keys && len(entries) < listPageSize; n += f.shards {
+		entries = append(entries, listEntry{key: fakeKey(n)})
+	}
+	if n >= f.keys {
+		return entries, "", nil
+	}
+	return entries, entries[len(entries)-1].key, nil
+}
+
+func newTestServer() *TempoS3ShardServer {
+	s := &TempoS3ShardServer{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	s.state.Store(&runtimeState{config: &config.Config{}})
+	return s
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func TestListMergerOrder(t *testing.T) {
+	s := newTestServer()
+	f := fakeShards{shards: 4, keys: 2500}
+	m := s.mergeShards(context.Background(), f.buckets(), "tenant/", f.page)
+	if err := m.prime(); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; ; n++ {
+		entry, ok, err := m.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			if n != f.keys {
+				t.Fatalf("listed %d keys, want %d", n, f.keys)
+			}
+			return
+		}
+		if want := fakeKey(n); entry.key != want {
+			t.Fatalf("entry %d is %q, want %q", n, entry.key, want)
+		}
+	}
+}
+
+// TestShardTimeoutPerPage checks that the shard and list timeouts bound
+// each page request, not the time a shard waits for a slow reader to take its
+// entries.
+func TestShardTimeoutPerPage(t *testing.T) {
+	s := newTestServer()
+	s.cfg().List.ShardTimeout = config.Duration(20 * time.Millisecond)
+
+	f := fakeShards{shards: 1, keys: 3 * listPageSize}
+	m := s.mergeShards(context.Background(), f.buckets(), "tenant/", f.page)
+	if err := m.prime(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	n := 0
+	for ; ; n++ {
+		_, ok, err := m.next()
+		if err != nil {
+			t.Fatalf("slow reader failed after %d keys: %v", n, err)
+		}
+		if !ok {
+			break
+		}
+	}
+	if n != f.keys {
+		t.Fatalf("listed %d keys, want %d", n, f.keys)
+	}
+
+	stuck := func(ctx context.Context, bucket, startAfter string) ([]listEntry, string, error) {
+		<-ctx.Done()
+		return nil, "", ctx.Err()
+	}
+	m = s.mergeShards(context.Background(), f.buckets(), "tenant/", stuck)
+	if err := m.prime(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("stuck page got %v, want DeadlineExceeded", err)
+	}
+
+	// The list timeout bounds pages the same way
+	s.cfg().List.ShardTimeout = 0
+	s.cfg().Timeouts.List = config.Duration(20 * time.Millisecond)
+	m = s.mergeShards(context.Background(), f.buckets(), "tenant/", stuck)
+	if err := m.prime(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("stuck page under the list timeout got %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestSortPage(t *testing.T) {
+	page := sortPage([]listEntry{
+		{key: "a/c"},
+		{key: "a/b/", isPrefix: true},
+		{key: "a/a"},
+		{key: "a/b/", isPrefix: true},
+		{key: "a/d/", isPrefix: true},
+	})
+	var keys []string
+	for _, entry := range page {
+		keys = append(keys, entry.key)
+	}
+	if got, want := strings.Join(keys, ","), "a/a,a/b/,a/c,a/d/"; got != want {
+		t.Fatalf("sorted page is %s, want %s", got, want)
+	}
+}
+
+// BenchmarkListMerger merges listings of increasing size. The heap in use
+// halfway through the merge stays flat as the listing grows, since each
+// shard buffers at most one page ahead.
+func BenchmarkListMerger(b *testing.B) {
+	for _, keys := range []int{10_000, 100_000, 1_000_000} {
+		b.Run(strconv.Itoa(keys), func(b *testing.B) {
+			s := newTestServer()
+			f := fakeShards{shards: 8, keys: keys}
+			b.ReportAllocs()
+			var live uint64
+			for b.Loop() {
+				base := heapAlloc()
+				m := s.mergeShards(context.Background(), f.buckets(), "tenant/", f.page)
+				if err := m.prime(); err != nil {
+					b.Fatal(err)
+				}
+				for n := 0; ; n++ {
+					_, ok, err := m.next()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if !ok {
+						break
+					}
+					if n == keys/2 {
+						if inUse := heapAlloc(); inUse > base {
+							live = max(live, inUse-base)
+						}
+					}
+				}
+			}
+			b.ReportMetric(float64(live), "live-B")
+		})
+	}
+}
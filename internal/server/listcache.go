@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+type listCacheKey struct {
+	prefix    string
+	delimiter string
+}
+
+// cachedListing is the complete, sorted result of one listing.
+type cachedListing struct {
+	entries []listEntry
+	fetched time.Time
+	// used records whether the listing was served since it was last
+	// refreshed; unused listings are dropped instead of refreshed.
+	used bool
+}
+
+// listMutation is a PUT or DELETE that passed through the proxy. object is
+// nil for deletes.
+type listMutation struct {
+	seq    uint64
+	key    string
+	object *minio.ObjectInfo
+}
+
+// listCache keeps recent listings in memory and patches them with the
+// writes made through the proxy. Listings being fetched when a write
+// happens would miss it, so every write is also journaled and replayed
+// onto fills that started before it.
+type listCache struct {
+	cfg config.ListCacheConfig
+
+	mu       sync.Mutex
+	listings map[listCacheKey]*cachedListing
+	seq      uint64
+	journal  []listMutation
+	// fills counts the in-flight fills by the sequence number they started
+	// at; the journal is kept back to the oldest of them.
+	fills map[uint64]int
+	// cleared is the sequence number of the last clear; fills that started
+	// before it are discarded.
+	cleared uint64
+}
+
+func newListCache(cfg config.ListCacheConfig) *listCache {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &listCache{
+		cfg:      cfg,
+		listings: make(map[listCacheKey]*cachedListing),
+		fills:    make(map[uint64]int),
+	}
+}
+
+// lookup returns a copy of the cached listing for key if it is within the
+// staleness bound.
+func (c *listCache) lookup(key listCacheKey) ([]listEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	listing, ok := c.listings[key]
+	if !ok {
+		metrics.ListCacheRequestsTotal.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	if time.Since(listing.fetched) > c.cfg.MaxStaleness.Std() {
+		metrics.ListCacheRequestsTotal.WithLabelValues("stale").Inc()
+		return nil, false
+	}
+	listing.used = true
+	metrics.ListCacheRequestsTotal.WithLabelValues("hit").Inc()
+	return slices.Clone(listing.entries), true
+}
+
+// beginFill registers a listing about to be fetched from the backends and
+// returns the sequence number to pass to commit or abort.
+func (c *listCache) beginFill() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fills[c.seq]++
+	return c.seq
+}
+
+// commit stores a freshly fetched listing, replaying the writes made since
+// the fill began. Listings larger than max_entries are not kept.
+func (c *listCache) commit(key listCacheKey, entries []listEntry, start uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.endFill(start)
+
+	if start < c.cleared {
+		return
+	}
+	if len(entries) > c.cfg.MaxEntries {
+		delete(c.listings, key)
+		return
+	}
+	for _, m := range c.journal {
+		if m.seq > start {
+			entries = applyMutation(entries, key, m)
+		}
+	}
+	c.listings[key] = &cachedListing{entries: entries, fetched: time.Now()}
+}
+
+// abort ends a fill that failed or was cut short.
+func (c *listCache) abort(start uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.endFill(start)
+}
+
+func (c *listCache) endFill(start uint64) {
+	if c.fills[start]--; c.fills[start] == 0 {
+		delete(c.fills, start)
+	}
+	if len(c.fills) == 0 {
+		c.journal = nil
+		return
+	}
+	oldest := c.seq
+	for seq := range c.fills {
+		oldest = min(oldest, seq)
+	}
+	i := 0
+	for i < len(c.journal) && c.journal[i].seq <= oldest {
+		i++
+	}
+	c.journal = c.journal[i:]
+}
+
+// clear drops every cached listing, along with the fills in flight.
+func (c *listCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	c.cleared = c.seq
+	clear(c.listings)
+}
+
+// record applies a write to every cached listing it belongs to.
+func (c *listCache) record(key string, object *minio.ObjectInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	m := listMutation{seq: c.seq, key: key, object: object}
+	if len(c.fills) > 0 {
+		c.journal = append(c.journal, m)
+	}
+	for lk, listing := range c.listings {
+		listing.entries = applyMutation(listing.entries, lk, m)
+	}
+}
+
+// due returns the listings to refresh, dropping those that have not been
+// served since their last refresh.
+func (c *listCache) due() []listCacheKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []listCacheKey
+	for key, listing := range c.listings {
+		if !listing.used {
+			delete(c.listings, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// applyMutation patches a sorted listing for key with m. Deletes only
+// remove the object itself: whether a common prefix still has other keys
+// under it is not known until the next refresh.
+func applyMutation(entries []listEntry, key listCacheKey, m listMutation) []listEntry {
+	rest, ok := strings.CutPrefix(m.key, key.prefix)
+	if !ok {
+		return entries
+	}
+
+	entry := listEntry{key: m.key}
+	if key.delimiter != "" {
+		if i := strings.Index(rest, key.delimiter); i >= 0 {
+			entry = listEntry{key: key.prefix + rest[:i+len(key.delimiter)], isPrefix: true}
+		}
+	}
+
+	i, found := slices.BinarySearchFunc(entries, entry.key, func(e listEntry, k string) int {
+		return strings.Compare(e.key, k)
+	})
+	switch {
+	case entry.isPrefix:
+		if !found && m.object != nil {
+			entries = slices.Insert(entries, i, entry)
+		}
+	case m.object == nil:
+		if found && !entries[i].isPrefix {
+			entries = slices.Delete(entries, i, i+1)
+		}
+	default:
+		entry.object = *m.object
+		entry.object.Key = m.key
+		if found {
+			entries[i] = entry
+		} else {
+			entries = slices.Insert(entries, i, entry)
+		}
+	}
+	return entries
+}
+
+// recordListWrite patches cached listings after a successful PUT.
+func (s *TempoS3ShardServer) recordListWrite(key string, info minio.UploadInfo, size int64) {
+	if s.listCache == nil {
+		return
+	}
+	if info.Size > 0 {
+		size = info.Size
+	}
+	modified := info.LastModified
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	s.listCache.record(key, &minio.ObjectInfo{
+		Key:          key,
+		ETag:         info.ETag,
+		Size:         size,
+		LastModified: modified.UTC(),
+	})
+}
+
+// recordListDelete patches cached listings after a DELETE.
+func (s *TempoS3ShardServer) recordListDelete(key string) {
+	if s.listCache != nil {
+		s.listCache.record(key, nil)
+	}
+}
+
+// runListRefresh refreshes the cached listings that are still in use on
+// every refresh interval.
+func (s *TempoS3ShardServer) runListRefresh() {
+	ticker := time.NewTicker(s.cfg().ListCache.RefreshInterval.Std())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		for _, key := range s.listCache.due() {
+			s.refreshListing(key)
+		}
+	}
+}
+
+func (s *TempoS3ShardServer) refreshListing(key listCacheKey) {
+	// Each page request is bounded by the list timeout
+	ctx := context.Background()
+	start := s.listCache.beginFill()
+	merger := s.newListMerger(ctx, key.prefix, key.delimiter)
+	err := merger.prime()
+	var entries []listEntry
+	for err == nil {
+		var entry listEntry
+		var ok bool
+		entry, ok, err = merger.next()
+		if !ok {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	if err != nil || merger.partial {
+		s.listCache.abort(start)
+		metrics.ListCacheRefreshesTotal.WithLabelValues("error").Inc()
+		s.logger.Warn("List cache refresh failed", "prefix", key.prefix, "delimiter", key.delimiter, "error", err)
+		return
+	}
+	s.listCache.commit(key, entries, start)
+	metrics.ListCacheRefreshesTotal.WithLabelValues("success").Inc()
+}
+
+// sliceSource serves a cached listing through the same interface as a
+// listMerger.
+type sliceSource struct {
+	entries []listEntry
+}
+
+func (src *sliceSource) prime() error {
+	return nil
+}
+
+func (src *sliceSource) next() (listEntry, bool, error) {
+	if len(src.entries) == 0 {
+		return listEntry{}, false, nil
+	}
+	entry := src.entries[0]
+	src.entries = src.entries[1:]
+	return entry, true, nil
+}
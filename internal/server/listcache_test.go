@@ -0,0 +1,207 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/config"
+)
+
+func newTestListCache() *listCache {
+	return newListCache(config.ListCacheConfig{
+		Enabled:      true,
+		MaxStaleness: config.Duration(time.Minute),
+		MaxEntries:   100,
+	})
+}
+
+// listing returns entries for objects with the given keys.
+func listing(keys ...string) []listEntry {
+	entries := make([]listEntry, len(keys))
+	for i, key := range keys {
+		entries[i] = listEntry{key: key, object: minio.ObjectInfo{Key: key}}
+		if strings.HasSuffix(key, "/") {
+			entries[i] = listEntry{key: key, isPrefix: true}
+		}
+	}
+	return entries
+}
+
+func entryKeys(entries []listEntry) string {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.key
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestApplyMutation(t *testing.T) {
+	put := func(key string) listMutation {
+		return listMutation{key: key, object: &minio.ObjectInfo{Size: 7}}
+	}
+	del := func(key string) listMutation {
+		return listMutation{key: key}
+	}
+	flat := listCacheKey{prefix: "t/"}
+	dirs := listCacheKey{prefix: "t/", delimiter: "/"}
+
+	for _, tc := range []struct {
+		name    string
+		key     listCacheKey
+		entries []listEntry
+		m       listMutation
+		want    string
+	}{
+		{"put inserts in order", flat, listing("t/a", "t/c"), put("t/b"), "t/a,t/b,t/c"},
+		{"put overwrites", flat, listing("t/a", "t/b"), put("t/b"), "t/a,t/b"},
+		{"delete removes", flat, listing("t/a", "t/b"), del("t/a"), "t/b"},
+		{"delete of a missing key", flat, listing("t/a"), del("t/b"), "t/a"},
+		{"outside the prefix", flat, listing("t/a"), put("u/a"), "t/a"},
+		{"put adds its common prefix", dirs, listing("t/a", "t/c"), put("t/b/meta.json"), "t/a,t/b/,t/c"},
+		{"put under a known prefix", dirs, listing("t/b/"), put("t/b/index"), "t/b/"},
+		// Other keys may remain under the prefix until the next refresh
+		{"delete keeps the common prefix", dirs, listing("t/b/"), del("t/b/index"), "t/b/"},
+		{"delete of an object beside a prefix", dirs, listing("t/b", "t/b/"), del("t/b"), "t/b/"},
+	} {
+		got := applyMutation(tc.entries, tc.key, tc.m)
+		if keys := entryKeys(got); keys != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, keys, tc.want)
+		}
+	}
+
+	got := applyMutation(listing("t/a"), flat, put("t/a"))
+	if got[0].object.Key != "t/a" || got[0].object.Size != 7 {
+		t.Fatalf("overwritten entry holds %+v, want the new object", got[0].object)
+	}
+}
+
+// TestListCacheReplay checks that writes made while a listing is fetched
+// are applied to it, and writes made before are not applied twice.
+func TestListCacheReplay(t *testing.T) {
+	c := newTestListCache()
+	key := listCacheKey{prefix: "t/"}
+
+	c.record("t/before", &minio.ObjectInfo{})
+	first := c.beginFill()
+	c.record("t/b", &minio.ObjectInfo{})
+	second := c.beginFill()
+	c.record("t/a", nil)
+
+	// The second fill saw t/b but not the delete of t/a
+	c.commit(key, listing("t/a", "t/b", "t/before"), second)
+	if entries, _ := c.lookup(key); entryKeys(entries) != "t/b,t/before" {
+		t.Fatalf("second fill cached %s, want t/b,t/before", entryKeys(entries))
+	}
+	// The first fill saw neither write; its journal is still kept
+	if len(c.journal) != 2 {
+		t.Fatalf("journal holds %d writes with a fill in flight, want 2", len(c.journal))
+	}
+	c.commit(key, listing("t/a", "t/before"), first)
+	if entries, _ := c.lookup(key); entryKeys(entries) != "t/b,t/before" {
+		t.Fatalf("first fill cached %s, want t/b,t/before", entryKeys(entries))
+	}
+	if len(c.journal) != 0 || len(c.fills) != 0 {
+		t.Fatalf("%d journaled writes and %d fills left after every fill ended", len(c.journal), len(c.fills))
+	}
+
+	// Writes patch cached listings directly
+	c.record("t/c", &minio.ObjectInfo{})
+	if entries, _ := c.lookup(key); entryKeys(entries) != "t/b,t/before,t/c" {
+		t.Fatalf("listing is %s after a write, want t/b,t/before,t/c", entryKeys(entries))
+	}
+}
+
+func TestListCacheDiscardsFills(t *testing.T) {
+	c := newTestListCache()
+	key := listCacheKey{prefix: "t/"}
+
+	// A clear, such as a lifecycle run's, discards fills in flight
+	start := c.beginFill()
+	c.clear()
+	c.commit(key, listing("t/a"), start)
+	if _, ok := c.lookup(key); ok {
+		t.Fatal("fill that started before a clear was cached")
+	}
+
+	// Listings over max_entries are not kept
+	start = c.beginFill()
+	c.commit(key, make([]listEntry, 101), start)
+	if _, ok := c.lookup(key); ok {
+		t.Fatal("listing over max_entries was cached")
+	}
+
+	start = c.beginFill()
+	c.abort(start)
+	if len(c.fills) != 0 {
+		t.Fatal("aborted fill still registered")
+	}
+}
+
+func TestListCacheStaleness(t *testing.T) {
+	c := newTestListCache()
+	key := listCacheKey{prefix: "t/"}
+	c.commit(key, listing("t/a"), c.beginFill())
+
+	entries, ok := c.lookup(key)
+	if !ok {
+		t.Fatal("fresh listing not served")
+	}
+	// Callers get a copy they may not alter the cache through
+	entries[0].key = "t/z"
+	if entries, _ := c.lookup(key); entryKeys(entries) != "t/a" {
+		t.Fatalf("cached listing changed to %s through a lookup's result", entryKeys(entries))
+	}
+
+	c.listings[key].fetched = time.Now().Add(-time.Minute - time.Second)
+	if _, ok := c.lookup(key); ok {
+		t.Fatal("listing older than max_staleness served")
+	}
+}
+
+func TestListCacheRefreshOnlyUsed(t *testing.T) {
+	c := newTestListCache()
+	used := listCacheKey{prefix: "used/"}
+	unused := listCacheKey{prefix: "unused/"}
+	c.commit(used, nil, c.beginFill())
+	c.commit(unused, nil, c.beginFill())
+	c.lookup(used)
+
+	due := c.due()
+	if len(due) != 1 || due[0] != used {
+		t.Fatalf("due for refresh: %v, want only %v", due, used)
+	}
+	if _, ok := c.listings[unused]; ok {
+		t.Fatal("unused listing kept")
+	}
+}
+
+func TestListNoCacheBypass(t *testing.T) {
+	s := newReplicatedServer(t, 2)
+	s.cfg().ListCache = config.ListCacheConfig{Enabled: true, MaxStaleness: config.Duration(time.Minute), MaxEntries: 100}
+	s.listCache = newListCache(s.cfg().ListCache)
+	key := listCacheKey{prefix: "t/"}
+	s.listCache.commit(key, listing("t/cached"), s.listCache.beginFill())
+
+	w := httptest.NewRecorder()
+	s.handleListObjects(w, httptest.NewRequest(http.MethodGet, "/tempo?prefix=t/", nil), "tempo")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<Key>t/cached</Key>") {
+		t.Fatalf("cached listing not served: %d %s", w.Code, w.Body)
+	}
+
+	// The backend is unreachable, so a listing that bypasses the cache
+	// fails
+	r := httptest.NewRequest(http.MethodGet, "/tempo?prefix=t/", nil)
+	r.Header.Set("Cache-Control", "no-cache")
+	w = httptest.NewRecorder()
+	s.handleListObjects(w, r, "tempo")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("no-cache listing got %d %s, want 503 from the backend", w.Code, w.Body)
+	}
+	if entries, _ := s.listCache.lookup(key); entryKeys(entries) != "t/cached" {
+		t.Fatalf("failed bypass changed the cached listing to %s", entryKeys(entries))
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// storeObject writes an upload of size bytes under key, compressing,
+// encrypting and erasure coding it as configured. Everything needed to
+// read it back is recorded in the object's user metadata. sse, if set, is
+// passed to the backends, and the object is then stored replicated.
+func (s *TempoS3ShardServer) storeObject(ctx context.Context, key string, body io.Reader, size int64, contentType string, sse encrypt.ServerSide) (minio.UploadInfo, error) {
+	rt := s.runtime()
+	meta := make(map[string]string)
+	stored := size
+
+	// An object that compresses to more than one part is streamed, and
+	// its stored size is only known once it has been written
+	var cr *compressReader
+	codec := rt.compressionCodec(key, contentType, size)
+	if codec != "" {
+		var err error
+		if body, stored, cr, err = compressBody(body, size, codec, rt.config.Compression.FrameSize); err != nil {
+			return minio.UploadInfo{}, err
+		}
+		if cr != nil {
+			meta[codecMetaKey] = codec
+		}
+	}
+
+	if rt.keyring != nil {
+		var err error
+		if body, stored, err = encryptBody(rt.keyring, rt.config.Encryption.ChunkSize, key, size, body, stored, meta); err != nil {
+			return minio.UploadInfo{}, err
+		}
+	}
+	if len(meta) > 0 {
+		meta[sizeMetaKey] = strconv.FormatInt(size, 10)
+	}
+
+	var info minio.UploadInfo
+	var err error
+	// A streamed object is erasure coded by its uncompressed size
+	erasureSize := stored
+	if stored < 0 {
+		erasureSize = size
+	}
+	if sse == nil && s.useErasure(erasureSize) {
+		info, err = s.putErasure(ctx, key, body, stored, contentType, meta)
+	} else {
+		info, err = s.putReplicated(ctx, key, body, stored, minio.PutObjectOptions{
+			ContentType:          contentType,
+			UserMetadata:         meta,
+			ServerSideEncryption: sse,
+		})
+	}
+	if err == nil && cr != nil {
+		s.recordCompression(key, codec, size, cr.written)
+	}
+	return info, err
+}
+
+// deleteObject removes key from every replica, along with the pieces if it
+// is erasure coded, and drops it from the caches.
+func (s *TempoS3ShardServer) deleteObject(ctx context.Context, key string) error {
+	var manifest *erasureManifest
+	if s.cfg().Erasure.Enabled {
+		var err error
+		if manifest, err = s.loadManifest(ctx, key); err != nil {
+			s.logger.Warn("Failed to read erasure manifest, pieces may be left behind", "object_key", key, "error", err)
+		}
+	}
+
+	err := s.writeReplicated(ctx, "delete", key, func(bucket string) error {
+		return s.removeObject(ctx, bucket, key)
+	})
+	s.invalidate(key)
+	if err != nil {
+		return err
+	}
+	if manifest != nil {
+		s.removeErasurePieces(manifest)
+	}
+	s.recordListDelete(key)
+	return nil
+}
+
+// removeObject removes key from bucket, retrying transient failures, and
+// accounts the delete to the usage. S3 deletes succeed whether or not the
+// object exists, so its size is taken by a stat before the first attempt;
+// a retry may find the object already removed.
+func (s *TempoS3ShardServer) removeObject(ctx context.Context, bucket, key string) error {
+	size, stat := int64(-1), true
+	err := s.retryBackend(ctx, "delete", bucket, func() error {
+		if stat {
+			stat = false
+			var err error
+			if size, err = s.storedSize(ctx, bucket, key); err != nil {
+				s.logger.Debug("Failed to stat object being deleted, usage may overcount until the next scan", "bucket", bucket, "object_key", key, "error", err)
+			}
+		}
+		return s.clients().GetIdempotentClient().RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+	})
+	if err == nil {
+		s.recordDelete(bucket, key, size)
+	}
+	return err
+}
+
+// byteSource reads ranges of an object's bytes at one layer of the storage
+// format. Each layer presents the object one step closer to what the
+// client wrote: the stored object or erasure pieces, then decryption, then
+// decompression. Ranges must be read one at a time.
+type byteSource interface {
+	size() int64
+	readRange(offset, length int64) (io.ReadCloser, error)
+}
+
+// objectSource reads ranges of an opened backend object. Closing a range
+// does not close the object.
+type objectSource struct {
+	object *backendObject
+	length int64
+	used   bool
+}
+
+func (src *objectSource) size() int64 {
+	return src.length
+}
+
+func (src *objectSource) readRange(offset, length int64) (io.ReadCloser, error) {
+	if offset > 0 || src.used {
+		// minio.Object reissues the request from the new offset on the
+		// next read
+		if _, err := src.object.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	src.used = true
+	return io.NopCloser(io.LimitReader(src.object, length)), nil
+}
+
+// readFull reads a whole range from src.
+func readFull(src byteSource, offset, length int64) ([]byte, error) {
+	r, err := src.readRange(offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readCloser pairs a reader with the function that releases what it reads
+// from.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// objectBody returns a reader for length bytes of an opened object starting
+// at offset, in terms of the object the client wrote: erasure manifests are
+// resolved to their pieces, and encrypted and compressed objects are
+// decrypted and decompressed. info must already have its logical size.
+// Closing the returned reader does not close object.
+func (s *TempoS3ShardServer) objectBody(ctx context.Context, object *backendObject, info minio.ObjectInfo, bucket string, offset, length int64) (io.ReadCloser, error) {
+	var src byteSource
+	if isErasureManifest(info) {
+		manifest, err := readManifest(object)
+		if err != nil {
+			return nil, err
+		}
+		src = &erasureSource{s: s, ctx: ctx, bucket: bucket, manifest: manifest}
+	} else {
+		stored, err := object.Stat()
+		if err != nil {
+			return nil, err
+		}
+		src = &objectSource{object: object, length: stored.Size}
+	}
+
+	if isEncrypted(info) {
+		var err error
+		if src, err = s.decryptSource(src, info); err != nil {
+			return nil, err
+		}
+	}
+	if codec := info.Metadata.Get("X-Amz-Meta-" + codecMetaKey); codec != "" {
+		return decompressedBody(src, codec, info.Size, offset, length)
+	}
+	return src.readRange(offset, length)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+	"tempo-s3-shard/internal/ratelimit"
+)
+
+// rateLimiterIdleTimeout is how long the limiter of a tenant and operation
+// is kept after its last request.
+const rateLimiterIdleTimeout = 10 * time.Minute
+
+// tenantOf returns the tenant of an object key or list prefix: its first
+// path segment, or "" if it has none.
+func tenantOf(key string) string {
+	tenant, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return ""
+	}
+	return tenant
+}
+
+// tenantLabel returns tenant for use as a metric label. Tenants come from
+// request paths, so only those named in configured keep their name and the
+// rest share "other", keeping the number of series bounded.
+func tenantLabel[V any](configured map[string]V, tenant string) string {
+	if _, ok := configured[tenant]; ok {
+		return tenant
+	}
+	return "other"
+}
+
+// requestOperation returns the rate-limited operation of a request with
+// the given action, or "" if it is not rate limited.
+func requestOperation(r *http.Request, action string) string {
+	switch action {
+	case config.ActionGetObject:
+		if r.Method == "HEAD" {
+			return "head"
+		}
+		return "get"
+	case config.ActionGetObjectTagging:
+		return "head"
+	case config.ActionPutObject, config.ActionPutObjectTagging:
+		return "put"
+	case config.ActionDeleteObject:
+		return "delete"
+	case config.ActionListBucket:
+		return "list"
+	}
+	return ""
+}
+
+// limitRequest applies the rate limits of the request's tenant and
+// operation. If the request is throttled it writes SlowDown and returns
+// false. Otherwise the request must be served through the returned
+// writer, which counts response bytes, and done called when it finishes.
+// The request body is counted too, so uploads whose Content-Length is not
+// known up front are charged for what they send.
+func (s *TempoS3ShardServer) limitRequest(w http.ResponseWriter, r *http.Request, pathParts []string) (http.ResponseWriter, func(), bool) {
+	cfg := s.cfg().RateLimit
+	if !cfg.Enabled {
+		return w, func() {}, true
+	}
+	action, key := requestAction(r, pathParts)
+	operation := requestOperation(r, action)
+	if operation == "" {
+		return w, func() {}, true
+	}
+	tenant := tenantOf(key)
+	limit := cfg.Limit(tenant, operation)
+
+	var bytes int64
+	if r.ContentLength > 0 {
+		bytes = r.ContentLength
+	}
+	limiter := s.rateLimiters.Get(tenant + "\x00" + operation)
+	ok, reason, retryAfter := limiter.Acquire(ratelimit.Limits{
+		RequestsPerSecond: limit.RequestsPerSecond,
+		Burst:             limit.Burst,
+		BytesPerSecond:    float64(limit.BytesPerSecond),
+		BurstBytes:        limit.BurstBytes,
+		MaxConcurrent:     limit.MaxConcurrent,
+	}, bytes)
+	if !ok {
+		metrics.ThrottledRequestsTotal.WithLabelValues(tenantLabel(cfg.Tenants, tenant), operation, string(reason)).Inc()
+		s.logger.Debug("Request throttled", "tenant", tenant, "operation", operation, "reason", reason, "retry_after", retryAfter)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+		writeS3Error(w, r, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+		return w, nil, false
+	}
+
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	counter := &countingWriter{ResponseWriter: w}
+	return counter, func() { limiter.Release(counter.written + max(body.read-bytes, 0)) }, true
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes of the response body.
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"tempo-s3-shard/internal/client"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/envelope"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// runtimeState is the part of the server built from the config that is
+// replaced as a whole on reload. Requests load it once per decision, so a
+// reload never mixes the settings of two configs within one decision.
+type runtimeState struct {
+	config *config.Config
+	// clients holds the backend clients and the bucket ring.
+	clients          *client.S3ClientManager
+	hedgePatterns    []*regexp.Regexp
+	cachePatterns    []*regexp.Regexp
+	compressPatterns []*regexp.Regexp
+	keyring          *envelope.Keyring
+	// tls is the listener's TLS config; nil when serving plain HTTP.
+	tls      *tls.Config
+	policies []policy
+}
+
+// newRuntimeState validates cfg and builds the state derived from it.
+func newRuntimeState(cfg *config.Config) (*runtimeState, error) {
+	hedgePatterns, err := compilePatterns(cfg.Hedge.KeyPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hedge key pattern: %w", err)
+	}
+	cachePatterns, err := compilePatterns(cfg.Cache.KeyPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache key pattern: %w", err)
+	}
+	compressPatterns, err := compilePatterns(cfg.Compression.KeyPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression key pattern: %w", err)
+	}
+	if cfg.Compression.Enabled {
+		if err := validateCompression(cfg.Compression); err != nil {
+			return nil, err
+		}
+	}
+	keyring, err := loadKeyring(cfg.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("loading encryption keys: %w", err)
+	}
+	if cfg.Erasure.Enabled {
+		if err := validateErasure(cfg.Erasure.DataShards, cfg.Erasure.ParityShards, len(cfg.Buckets)); err != nil {
+			return nil, err
+		}
+	}
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled() {
+		if tlsConfig, err = newListenerTLS(cfg.TLS); err != nil {
+			return nil, err
+		}
+	}
+	return &runtimeState{
+		config:           cfg,
+		hedgePatterns:    hedgePatterns,
+		cachePatterns:    cachePatterns,
+		compressPatterns: compressPatterns,
+		keyring:          keyring,
+		tls:              tlsConfig,
+		policies:         compilePolicies(cfg.Authorization.Policies),
+	}, nil
+}
+
+// ValidateConfig checks the settings of cfg that the server interprets
+// itself, such as key patterns, encryption keys and TLS certificates, in
+// addition to cfg.Validate.
+func ValidateConfig(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if _, err := client.NewTransport(cfg); err != nil {
+		return err
+	}
+	_, err := newRuntimeState(cfg)
+	return err
+}
+
+// cfg returns the current config.
+func (s *TempoS3ShardServer) cfg() *config.Config {
+	return s.state.Load().config
+}
+
+// clients returns the current backend clients and bucket ring.
+func (s *TempoS3ShardServer) clients() *client.S3ClientManager {
+	return s.state.Load().clients
+}
+
+// runtime returns the current reloadable state.
+func (s *TempoS3ShardServer) runtime() *runtimeState {
+	return s.state.Load()
+}
+
+// Reload switches the server to cfg while it keeps serving. The new config
+// is validated first and rejected as a whole if invalid. Settings that only
+// take effect at startup keep their current values.
+func (s *TempoS3ShardServer) Reload(cfg *config.Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	err := s.reload(cfg)
+	recordReload(err)
+	return err
+}
+
+func (s *TempoS3ShardServer) reload(cfg *config.Config) error {
+	current := s.cfg()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	for _, setting := range keepRestartOnly(cfg, current) {
+		s.logger.Warn("Config setting change requires a restart, keeping current value", "setting", setting)
+	}
+
+	state, err := newRuntimeState(cfg)
+	if err != nil {
+		return err
+	}
+	// The clients and the ring are published with the rest of the state,
+	// so no request sees the clients of one config with another's settings
+	if state.clients, err = client.NewS3ClientManager(cfg); err != nil {
+		return err
+	}
+	previous := s.clients()
+	if !slices.Equal(current.Buckets, cfg.Buckets) {
+		s.changeBuckets(current.Buckets, cfg.Buckets, previous, state.clients)
+	}
+	s.state.Store(state)
+	s.logLevel.Set(cfg.GetLogLevel())
+	// Requests still using the old clients keep their connections
+	if previous != nil {
+		previous.CloseIdleConnections()
+	}
+
+	changes := config.Diff(current, cfg)
+	for _, change := range changes {
+		s.logger.Info("Config setting changed", "setting", change.Path, "old", change.Old, "new", change.New)
+	}
+	hash := cfg.Hash()
+	metrics.ConfigInfo.Reset()
+	metrics.ConfigInfo.WithLabelValues(hash).Set(1)
+	s.logger.Info("Config reloaded", "hash", hash, "changes", len(changes))
+	return nil
+}
+
+// changeBuckets prepares a switch of the ring from the buckets in current to
+// those in next. Objects are not moved, so it warns how many keys will be
+// looked up in another bucket than the one holding them.
+func (s *TempoS3ShardServer) changeBuckets(current, next []string, previous, clients *client.S3ClientManager) {
+	var added, removed []string
+	for _, bucket := range next {
+		if !slices.Contains(current, bucket) {
+			added = append(added, bucket)
+		}
+	}
+	for _, bucket := range current {
+		if !slices.Contains(next, bucket) {
+			removed = append(removed, bucket)
+		}
+	}
+	attrs := []any{"added", added, "removed", removed}
+	if previous != nil {
+		attrs = append(attrs, "remapped_keys", fmt.Sprintf("%.1f%%", 100*remappedShare(previous, clients)))
+	}
+	s.logger.Warn("Shard buckets changed, keys will remap to other buckets without their objects being moved", attrs...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := clients.EnsureBucketsExist(ctx); err != nil {
+		s.logger.Warn("Failed to ensure buckets exist", "error", err)
+	}
+}
+
+// remappedShare estimates the share of keys whose primary bucket differs
+// between two rings.
+func remappedShare(current, next *client.S3ClientManager) float64 {
+	const samples = 10000
+	moved := 0
+	for i := range samples {
+		key := strconv.Itoa(i)
+		if current.GetBucketForKey(key) != next.GetBucketForKey(key) {
+			moved++
+		}
+	}
+	return float64(moved) / samples
+}
+
+func recordReload(err error) {
+	if err != nil {
+		metrics.ConfigReloadsTotal.WithLabelValues("failure").Inc()
+		metrics.ConfigLastReloadSuccessful.Set(0)
+		return
+	}
+	metrics.ConfigReloadsTotal.WithLabelValues("success").Inc()
+	metrics.ConfigLastReloadSuccessful.Set(1)
+}
+
+// keepRestartOnly copies the settings that are only read at startup from
+// current into next, and returns the names of those that differed.
+func keepRestartOnly(next, current *config.Config) []string {
+	var kept []string
+	keep(&kept, "listen_addr", &next.ListenAddr, current.ListenAddr)
+	keep(&kept, "circuit_breaker", &next.CircuitBreaker, current.CircuitBreaker)
+	keep(&kept, "cache.enabled", &next.Cache.Enabled, current.Cache.Enabled)
+	keep(&kept, "cache.max_memory_bytes", &next.Cache.MaxMemoryBytes, current.Cache.MaxMemoryBytes)
+	keep(&kept, "cache.dir", &next.Cache.Dir, current.Cache.Dir)
+	keep(&kept, "cache.max_disk_bytes", &next.Cache.MaxDiskBytes, current.Cache.MaxDiskBytes)
+	keep(&kept, "stat_cache", &next.StatCache, current.StatCache)
+	keep(&kept, "list_cache", &next.ListCache, current.ListCache)
+	keep(&kept, "single_flight.enabled", &next.SingleFlight.Enabled, current.SingleFlight.Enabled)
+	keep(&kept, "server.read_header_timeout", &next.Server.ReadHeaderTimeout, current.Server.ReadHeaderTimeout)
+	keep(&kept, "server.read_timeout", &next.Server.ReadTimeout, current.Server.ReadTimeout)
+	keep(&kept, "server.write_timeout", &next.Server.WriteTimeout, current.Server.WriteTimeout)
+	keep(&kept, "server.idle_timeout", &next.Server.IdleTimeout, current.Server.IdleTimeout)
+	keep(&kept, "admission", &next.Admission, current.Admission)
+	keep(&kept, "usage.enabled", &next.Usage.Enabled, current.Usage.Enabled)
+	keep(&kept, "lifecycle.enabled", &next.Lifecycle.Enabled, current.Lifecycle.Enabled)
+	if next.TLS.Enabled() != current.TLS.Enabled() {
+		keep(&kept, "tls", &next.TLS, current.TLS)
+	}
+	return kept
+}
+
+func keep[T any](kept *[]string, name string, next *T, current T) {
+	if !reflect.DeepEqual(*next, current) {
+		*kept = append(*kept, name)
+		*next = current
+	}
+}
+
+// WatchConfig reloads the config from path, applying overrides as
+// config.LoadConfig does, on every signal received from hup and, every
+// reload.watch_interval, whenever the file or a key, credential or
+// certificate file it names has changed. It returns when the server shuts
+// down.
+func (s *TempoS3ShardServer) WatchConfig(path string, overrides []string, hup <-chan os.Signal) {
+	last := s.configSum(path)
+	for {
+		var tick <-chan time.Time
+		if interval := s.cfg().Reload.WatchInterval.Std(); interval > 0 {
+			tick = time.After(interval)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-hup:
+			s.logger.Info("Received SIGHUP, reloading config", "path", path)
+		case <-tick:
+			if s.configSum(path) == last {
+				continue
+			}
+			s.logger.Info("Config file changed, reloading", "path", path)
+		}
+
+		cfg, err := config.LoadConfig(path, overrides...)
+		if err == nil {
+			err = s.Reload(cfg)
+		} else {
+			recordReload(err)
+		}
+		if err != nil {
+			s.logger.Error("Config reload failed, keeping current config", "path", path, "error", err)
+		}
+		last = s.configSum(path)
+	}
+}
+
+// configSum returns a checksum of the config file at path and of the
+// credential, key and certificate files the current config reads. Files that cannot be read count
+// as empty.
+func (s *TempoS3ShardServer) configSum(path string) [sha256.Size]byte {
+	cfg := s.cfg()
+	files := []string{
+		path, cfg.AccessKeyIDFile, cfg.SecretAccessKeyFile,
+		cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile,
+		cfg.BackendTLS.CAFile, cfg.BackendTLS.CertFile, cfg.BackendTLS.KeyFile,
+	}
+	for _, key := range cfg.Encryption.Keys {
+		files = append(files, key.File)
+	}
+
+	h := sha256.New()
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		data, _ := os.ReadFile(file)
+		sum := sha256.Sum256(data)
+		h.Write(sum[:])
+	}
+	return [sha256.Size]byte(h.Sum(nil))
+}
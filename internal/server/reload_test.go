@@ -0,0 +1,47 @@
+package server
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"tempo-s3-shard/internal/config"
+)
+
+func loadTestConfig(t *testing.T, data string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestReloadBuckets(t *testing.T) {
+	s := newReplicatedServer(t, 2)
+	s.logLevel = new(slog.LevelVar)
+	s.state.Load().config = loadTestConfig(t, `{"endpoint": "http://127.0.0.1:1", "region": "us-east-1", "access_key_id": "a", "secret_access_key": "b", "buckets": ["shard1", "shard2", "shard3"]}`)
+	before := s.clients()
+
+	cfg := loadTestConfig(t, `{"endpoint": "http://127.0.0.1:1", "region": "us-east-1", "access_key_id": "a", "secret_access_key": "b", "buckets": ["shard1", "shard2", "shard3", "shard4"]}`)
+	if err := s.reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.clients().GetAllBuckets(); !slices.Contains(got, "shard4") || len(got) != 4 {
+		t.Fatalf("ring holds %v after adding shard4", got)
+	}
+	if !slices.Equal(s.cfg().Buckets, cfg.Buckets) {
+		t.Fatalf("config holds buckets %v, want %v", s.cfg().Buckets, cfg.Buckets)
+	}
+
+	// Adding one bucket to three moves about a quarter of the keys
+	if share := remappedShare(before, s.clients()); share < 0.1 || share > 0.4 {
+		t.Fatalf("%.2f of keys remapped after adding a fourth bucket", share)
+	}
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// defaultRepairTimeout bounds a read repair when PUT timeouts are disabled.
+const defaultRepairTimeout = 10 * time.Minute
+
+// errQuorumNotReached is returned when fewer replicas than the write
+// quorum acknowledged a write.
+var errQuorumNotReached = errors.New("write quorum not reached")
+
+// isNotFound reports whether err means the object does not exist.
+func isNotFound(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "NoSuchKey" || (resp.Code == "" && resp.StatusCode == 404)
+}
+
+// putReplicated streams body to every replica of key concurrently. It
+// succeeds once the write quorum of replicas has stored the object; the
+// upload info of the first successful replica is returned.
+func (s *TempoS3ShardServer) putReplicated(ctx context.Context, key string, body io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	return s.putReplicas(ctx, key, body, func(bucket string, body io.Reader) (minio.UploadInfo, error) {
+		var info minio.UploadInfo
+		err := s.callBackend(ctx, "put", bucket, func() error {
+			var err error
+			info, err = s.putObject(ctx, bucket, key, body, size, opts)
+			return err
+		})
+		return info, err
+	})
+}
+
+// putReplicas is putReplicated with the write of one replica done by put,
+// which must read body to the end or fail.
+func (s *TempoS3ShardServer) putReplicas(ctx context.Context, key string, body io.Reader, put func(bucket string, body io.Reader) (minio.UploadInfo, error)) (minio.UploadInfo, error) {
+	replicas := s.clients().GetReplicaBucketsForKey(key)
+	if len(replicas) == 1 {
+		return put(replicas[0], body)
+	}
+
+	type result struct {
+		bucket string
+		info   minio.UploadInfo
+		err    error
+	}
+	results := make([]result, len(replicas))
+	writers := make([]*io.PipeWriter, len(replicas))
+
+	var wg sync.WaitGroup
+	for i, bucket := range replicas {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func(i int, bucket string) {
+			defer wg.Done()
+			info, err := put(bucket, pr)
+			results[i] = result{bucket: bucket, info: info, err: err}
+			// Unblock the fan-out if this replica stopped reading early
+			if err != nil {
+				pr.CloseWithError(err)
+			} else {
+				pr.Close()
+			}
+		}(i, bucket)
+	}
+
+	copyErr := fanOut(body, writers)
+	for _, pw := range writers {
+		if copyErr != nil {
+			pw.CloseWithError(copyErr)
+		} else {
+			pw.Close()
+		}
+	}
+	wg.Wait()
+
+	acked := 0
+	var info minio.UploadInfo
+	var firstErr error
+	for _, res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			metrics.ReplicaWriteFailuresTotal.WithLabelValues("put", res.bucket).Inc()
+			s.logger.Warn("Replica write failed", "object_key", key, "bucket", res.bucket, "error", res.err)
+			continue
+		}
+		if acked == 0 {
+			info = res.info
+		}
+		acked++
+	}
+
+	if copyErr != nil {
+		return minio.UploadInfo{}, copyErr
+	}
+	// A cancelled request is an abort, not a quorum failure
+	if ctx.Err() != nil {
+		return minio.UploadInfo{}, ctx.Err()
+	}
+	if acked < s.writeQuorum(len(replicas)) {
+		return minio.UploadInfo{}, fmt.Errorf("%w: %d of %d replicas stored object: %v", errQuorumNotReached, acked, len(replicas), firstErr)
+	}
+	return info, nil
+}
+
+// writeQuorum returns the number of acknowledgements a write to the given
+// number of replicas needs, never more than there are replicas.
+func (s *TempoS3ShardServer) writeQuorum(replicas int) int {
+	return min(s.cfg().Replication.WriteQuorum, replicas)
+}
+
+// fanOut copies src to every writer. A writer that fails is dropped; the
+// copy only fails if reading src fails.
+func fanOut(src io.Reader, writers []*io.PipeWriter) error {
+	live := make([]bool, len(writers))
+	for i := range live {
+		live[i] = true
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			for i, pw := range writers {
+				if live[i] {
+					if _, err := pw.Write(buf[:n]); err != nil {
+						live[i] = false
+					}
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// openObjectFailover opens key on the first replica that has it, returning
+// the bucket it was read from. Replicas found missing the object are
+// repaired in the background when read repair is enabled.
+func (s *TempoS3ShardServer) openObjectFailover(ctx context.Context, key string, opts minio.GetObjectOptions) (*backendObject, minio.ObjectInfo, string, error) {
+	var object *backendObject
+	var info minio.ObjectInfo
+	bucket, err := s.failover(ctx, "get", key, func(bucket string) error {
+		var err error
+		object, info, err = s.openObject(ctx, bucket, key, opts)
+		return err
+	})
+	return object, info, bucket, err
+}
+
+// statObjectFailover stats key on the first replica that has it.
+func (s *TempoS3ShardServer) statObjectFailover(ctx context.Context, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, string, error) {
+	var info minio.ObjectInfo
+	bucket, err := s.failover(ctx, "head", key, func(bucket string) error {
+		return s.retryBackend(ctx, "head", bucket, func() error {
+			var err error
+			info, err = s.clients().GetIdempotentClient().StatObject(ctx, bucket, key, opts)
+			return err
+		})
+	})
+	return info, bucket, err
+}
+
+// getObjectTaggingFailover reads key's tags from the first replica that has
+// the object.
+func (s *TempoS3ShardServer) getObjectTaggingFailover(ctx context.Context, key string) (*tags.Tags, string, error) {
+	var objectTags *tags.Tags
+	bucket, err := s.failover(ctx, "get_tagging", key, func(bucket string) error {
+		return s.retryBackend(ctx, "get_tagging", bucket, func() error {
+			var err error
+			objectTags, err = s.clients().GetIdempotentClient().GetObjectTagging(ctx, bucket, key, minio.GetObjectTaggingOptions{})
+			return err
+		})
+	})
+	return objectTags, bucket, err
+}
+
+// failover calls read against each replica of key in ring order until one
+// succeeds. If every replica fails, a backend error is preferred over
+// NoSuchKey since the object may exist on an unreachable replica.
+func (s *TempoS3ShardServer) failover(ctx context.Context, op, key string, read func(bucket string) error) (string, error) {
+	replicas := s.clients().GetReplicaBucketsForKey(key)
+
+	var missing []string
+	var lastErr, backendErr error
+	for i, bucket := range replicas {
+		err := read(bucket)
+		if err == nil {
+			if i > 0 {
+				metrics.ReplicaReadFailoversTotal.WithLabelValues(op, bucket).Inc()
+				if len(missing) > 0 && s.cfg().Replication.ReadRepair {
+					go s.repairReplicas(key, bucket, missing)
+				}
+			}
+			return bucket, nil
+		}
+		if ctx.Err() != nil {
+			return bucket, err
+		}
+
+		lastErr = err
+		if isNotFound(err) {
+			missing = append(missing, bucket)
+		} else if backendErr == nil {
+			backendErr = err
+		}
+		if i < len(replicas)-1 {
+			s.logger.Debug("Replica read failed, trying next replica", "operation", op, "object_key", key, "bucket", bucket, "error", err)
+		}
+	}
+
+	if backendErr != nil {
+		return replicas[0], backendErr
+	}
+	return replicas[0], lastErr
+}
+
+// repairReplicas copies key from source to the replicas that are missing
+// it. Concurrent repairs of the same key are collapsed into one. The copy
+// is pinned to the version of the source stat'ed here, and only stored on
+// a replica still missing the object, so that a PUT racing the repair is
+// not overwritten with older data.
+func (s *TempoS3ShardServer) repairReplicas(key, source string, missing []string) {
+	if _, running := s.repairs.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	defer s.repairs.Delete(key)
+
+	timeout := s.cfg().Timeouts.Put.Std()
+	if timeout <= 0 {
+		timeout = defaultRepairTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var info minio.ObjectInfo
+	var objectTags map[string]string
+	err := s.retryBackend(ctx, "head", source, func() error {
+		var err error
+		info, err = s.clients().GetIdempotentClient().StatObject(ctx, source, key, minio.StatObjectOptions{})
+		if err != nil || info.UserTagCount == 0 {
+			return err
+		}
+		t, err := s.clients().GetIdempotentClient().GetObjectTagging(ctx, source, key, minio.GetObjectTaggingOptions{})
+		if err == nil {
+			objectTags = t.ToMap()
+		}
+		return err
+	})
+	if err != nil {
+		for _, bucket := range missing {
+			metrics.ReadRepairsTotal.WithLabelValues(bucket, "error").Inc()
+		}
+		s.logger.Warn("Read repair failed to stat source", "object_key", key, "source", source, "error", err)
+		return
+	}
+
+	for _, bucket := range missing {
+		err := s.retryBackend(ctx, "repair", bucket, func() error {
+			return s.copyReplica(ctx, key, source, bucket, info, objectTags)
+		})
+		switch {
+		case isConditionFailed(err) || isNotFound(err):
+			metrics.ReadRepairsTotal.WithLabelValues(bucket, "conflict").Inc()
+			s.logger.Info("Read repair skipped, object changed during the copy", "object_key", key, "source", source, "bucket", bucket)
+		case err != nil:
+			metrics.ReadRepairsTotal.WithLabelValues(bucket, "error").Inc()
+			s.logger.Warn("Read repair failed", "object_key", key, "source", source, "bucket", bucket, "error", err)
+		default:
+			metrics.ReadRepairsTotal.WithLabelValues(bucket, "success").Inc()
+			s.logger.Info("Read repair restored replica", "object_key", key, "source", source, "bucket", bucket)
+		}
+	}
+}
+
+// copyReplica streams the version of key described by info from source to
+// bucket. The object is streamed through the proxy rather than copied
+// server-side because CopyObject is limited to 5 GiB. The read fails with
+// PreconditionFailed if the source has changed since info was taken, and
+// so does the write if bucket has the object by then. For objects large
+// enough to be uploaded in parts, backends check the write condition when
+// the upload starts.
+func (s *TempoS3ShardServer) copyReplica(ctx context.Context, key, source, bucket string, info minio.ObjectInfo, objectTags map[string]string) error {
+	getOpts := minio.GetObjectOptions{}
+	if err := getOpts.SetMatchETag(info.ETag); err != nil {
+		return err
+	}
+	object, err := s.clients().GetIdempotentClient().GetObject(ctx, source, key, getOpts)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+	// GetObject is lazy; Stat performs the request, so that a changed
+	// source fails here with the backend's error
+	if _, err := object.Stat(); err != nil {
+		return err
+	}
+
+	putOpts := minio.PutObjectOptions{
+		UserMetadata:       info.UserMetadata,
+		UserTags:           objectTags,
+		ContentType:        info.ContentType,
+		ContentEncoding:    info.Metadata.Get("Content-Encoding"),
+		ContentDisposition: info.Metadata.Get("Content-Disposition"),
+		ContentLanguage:    info.Metadata.Get("Content-Language"),
+		CacheControl:       info.Metadata.Get("Cache-Control"),
+		Expires:            info.Expires,
+	}
+	putOpts.SetMatchETagExcept("*")
+	_, err = s.putObject(ctx, bucket, key, object, info.Size, putOpts)
+	return err
+}
+
+// writeReplicated applies a write such as DELETE or PUT tagging to every
+// replica of key concurrently and checks the write quorum.
+func (s *TempoS3ShardServer) writeReplicated(ctx context.Context, op, key string, write func(bucket string) error) error {
+	replicas := s.clients().GetReplicaBucketsForKey(key)
+	if len(replicas) == 1 {
+		return write(replicas[0])
+	}
+
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i, bucket := range replicas {
+		wg.Add(1)
+		go func(i int, bucket string) {
+			defer wg.Done()
+			errs[i] = write(bucket)
+		}(i, bucket)
+	}
+	wg.Wait()
+
+	acked := 0
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			metrics.ReplicaWriteFailuresTotal.WithLabelValues(op, replicas[i]).Inc()
+			s.logger.Warn("Replica write failed", "operation", op, "object_key", key, "bucket", replicas[i], "error", err)
+			continue
+		}
+		acked++
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if acked < s.writeQuorum(len(replicas)) {
+		return fmt.Errorf("%w: %d of %d replicas acknowledged %s: %v", errQuorumNotReached, acked, len(replicas), op, firstErr)
+	}
+	return nil
+}
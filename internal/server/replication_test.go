@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/client"
+	"tempo-s3-shard/internal/config"
+)
+
+// newReplicatedServer returns a test server storing three replicas of each
+// object over three shards, with the given write quorum. Its backend
+// refuses every connection.
+func newReplicatedServer(t *testing.T, quorum int) *TempoS3ShardServer {
+	t.Helper()
+	s := newTestServer()
+	cfg := s.cfg()
+	cfg.Endpoint = "http://127.0.0.1:1"
+	cfg.Region = "us-east-1"
+	cfg.Credentials.Provider = config.CredentialsStatic
+	cfg.Buckets = []string{"shard1", "shard2", "shard3"}
+	cfg.Replication = config.ReplicationConfig{Factor: 3, WriteQuorum: quorum}
+	clients, err := client.NewS3ClientManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.runtime().clients = clients
+	return s
+}
+
+var (
+	errBackend  = minio.ErrorResponse{Code: "InternalError", StatusCode: 500}
+	errNotFound = minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}
+)
+
+func TestPutReplicatedQuorum(t *testing.T) {
+	body := strings.Repeat("block data ", 10_000)
+	for _, tc := range []struct {
+		name    string
+		quorum  int
+		failing int
+		wantErr bool
+	}{
+		{"all stored", 2, 0, false},
+		{"one replica down", 2, 1, false},
+		{"quorum lost", 2, 2, true},
+		{"full quorum", 3, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newReplicatedServer(t, tc.quorum)
+			replicas := s.clients().GetReplicaBucketsForKey("tenant/block")
+			failing := make(map[string]bool)
+			for _, bucket := range replicas[:tc.failing] {
+				failing[bucket] = true
+			}
+
+			var mu sync.Mutex
+			stored := make(map[string]string)
+			info, err := s.putReplicas(context.Background(), "tenant/block", strings.NewReader(body), func(bucket string, body io.Reader) (minio.UploadInfo, error) {
+				// A failed replica stops reading, which must not stall the
+				// others
+				if failing[bucket] {
+					return minio.UploadInfo{}, errBackend
+				}
+				data, err := io.ReadAll(body)
+				if err != nil {
+					return minio.UploadInfo{}, err
+				}
+				mu.Lock()
+				stored[bucket] = string(data)
+				mu.Unlock()
+				return minio.UploadInfo{Bucket: bucket, Size: int64(len(data))}, nil
+			})
+
+			if tc.wantErr {
+				if !errors.Is(err, errQuorumNotReached) {
+					t.Fatalf("got %v, want errQuorumNotReached", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The first replica in ring order that stored the object answers
+			if want := replicas[tc.failing]; info.Bucket != want {
+				t.Fatalf("upload info from %s, want %s", info.Bucket, want)
+			}
+			for _, bucket := range replicas[tc.failing:] {
+				if stored[bucket] != body {
+					t.Fatalf("%s stored %d bytes, want the %d byte body", bucket, len(stored[bucket]), len(body))
+				}
+			}
+		})
+	}
+}
+
+func TestPutReplicatedBodyError(t *testing.T) {
+	s := newReplicatedServer(t, 1)
+	errRead := errors.New("client went away")
+	body := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errRead))
+	_, err := s.putReplicas(context.Background(), "tenant/block", body, func(bucket string, body io.Reader) (minio.UploadInfo, error) {
+		_, err := io.ReadAll(body)
+		return minio.UploadInfo{}, err
+	})
+	if err != errRead {
+		t.Fatalf("got %v, want the body's read error", err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		errs       []error
+		wantBucket int
+		wantErr    error
+	}{
+		{"primary serves", []error{nil, nil, nil}, 0, nil},
+		{"primary missing", []error{errNotFound, nil, nil}, 1, nil},
+		{"primary down", []error{errBackend, errNotFound, nil}, 2, nil},
+		{"missing everywhere", []error{errNotFound, errNotFound, errNotFound}, 0, errNotFound},
+		// The object may exist on the replica that could not be reached
+		{"backend error preferred", []error{errNotFound, errBackend, errNotFound}, 0, errBackend},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newReplicatedServer(t, 2)
+			replicas := s.clients().GetReplicaBucketsForKey("tenant/block")
+			var tried []string
+			bucket, err := s.failover(context.Background(), "get", "tenant/block", func(bucket string) error {
+				tried = append(tried, bucket)
+				for i, replica := range replicas {
+					if replica == bucket {
+						return tc.errs[i]
+					}
+				}
+				t.Fatalf("read from %s, which holds no replica", bucket)
+				return nil
+			})
+			if err != tc.wantErr {
+				t.Fatalf("got %v, want %v", err, tc.wantErr)
+			}
+			if want := replicas[tc.wantBucket]; bucket != want {
+				t.Fatalf("reported bucket %s, want %s", bucket, want)
+			}
+			if tc.wantErr == nil && len(tried) != tc.wantBucket+1 {
+				t.Fatalf("tried %v, want replicas in ring order up to the first success", tried)
+			}
+		})
+	}
+}
+
+func TestFailoverStopsWhenCancelled(t *testing.T) {
+	s := newReplicatedServer(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	reads := 0
+	_, err := s.failover(ctx, "get", "tenant/block", func(bucket string) error {
+		reads++
+		cancel()
+		return context.Canceled
+	})
+	if err != context.Canceled || reads != 1 {
+		t.Fatalf("got %v after %d reads, want context.Canceled after 1", err, reads)
+	}
+}
+
+func TestWriteReplicated(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		quorum  int
+		failing int
+		wantErr bool
+	}{
+		{"all acknowledged", 2, 0, false},
+		{"one replica down", 2, 1, false},
+		{"quorum lost", 2, 2, true},
+		{"full quorum", 3, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newReplicatedServer(t, tc.quorum)
+			replicas := s.clients().GetReplicaBucketsForKey("tenant/block")
+			failing := make(map[string]bool)
+			for _, bucket := range replicas[:tc.failing] {
+				failing[bucket] = true
+			}
+
+			var mu sync.Mutex
+			written := make(map[string]bool)
+			err := s.writeReplicated(context.Background(), "delete", "tenant/block", func(bucket string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				written[bucket] = true
+				if failing[bucket] {
+					return errBackend
+				}
+				return nil
+			})
+			if len(written) != len(replicas) {
+				t.Fatalf("wrote to %d replicas, want all %d", len(written), len(replicas))
+			}
+			if tc.wantErr != errors.Is(err, errQuorumNotReached) {
+				t.Fatalf("got %v, want quorum failure %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWriteReplicatedCancelled(t *testing.T) {
+	s := newReplicatedServer(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.writeReplicated(ctx, "delete", "tenant/block", func(bucket string) error {
+		return ctx.Err()
+	})
+	// An aborted request is not reported as a quorum failure
+	if err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestFanOutDropsFailedWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100_000)
+	readers := make([]*io.PipeReader, 2)
+	writers := make([]*io.PipeWriter, 2)
+	for i := range readers {
+		readers[i], writers[i] = io.Pipe()
+	}
+	readers[0].CloseWithError(errBackend)
+
+	got := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(readers[1])
+		got <- data
+	}()
+	if err := fanOut(bytes.NewReader(data), writers); err != nil {
+		t.Fatal(err)
+	}
+	writers[1].Close()
+	if received := <-got; !bytes.Equal(received, data) {
+		t.Fatalf("live writer received %d bytes, want %d", len(received), len(data))
+	}
+}
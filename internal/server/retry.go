@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// retryBackend runs fn through the shard's circuit breaker, retrying
+// transient failures according to the configured retry policy. fn must be
+// idempotent and should use the idempotent client.
+func (s *TempoS3ShardServer) retryBackend(ctx context.Context, op, bucket string, fn func() error) error {
+	return s.retry(ctx, op, bucket, func() error {
+		return s.callBackend(ctx, op, bucket, fn)
+	})
+}
+
+// retry calls fn until it succeeds, fails with a non-retryable error, the
+// attempts are exhausted or ctx ends, sleeping a jittered exponential
+// backoff between attempts.
+func (s *TempoS3ShardServer) retry(ctx context.Context, op, bucket string, fn func() error) error {
+	policy := s.cfg().Retry
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := backoff(policy, attempt)
+		metrics.BackendRetriesTotal.WithLabelValues(op, bucket).Inc()
+		s.logger.Debug("Retrying backend operation",
+			"operation", op,
+			"bucket", bucket,
+			"attempt", attempt,
+			"backoff_ms", float64(delay.Microseconds())/1000,
+			"error", err,
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// backoff returns a "full jitter" delay: uniformly random between zero and
+// the exponentially growing ceiling for this attempt.
+func backoff(policy config.RetryConfig, attempt int) time.Duration {
+	ceiling := policy.MaxBackoff.Std()
+	if shift := attempt - 1; shift < 32 {
+		if d := policy.InitialBackoff.Std() << shift; d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(ceiling) + 1))
+}
+
+// isRetryable reports whether err is a transient backend failure worth
+// retrying. Open breakers and expired contexts are never retried.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, errShardUnavailable) || errors.Is(err, errOverloaded) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	resp := minio.ToErrorResponse(err)
+	switch resp.Code {
+	case "SlowDown", "InternalError", "ServiceUnavailable", "RequestTimeout", "Throttling":
+		return true
+	}
+	switch resp.StatusCode {
+	case 500, 502, 503, 504:
+		return true
+	}
+	// Transport errors carry neither an S3 code nor a status code
+	return resp.StatusCode == 0 && resp.Code == ""
+}
+
+// backendObject is an opened backend object. Closing it also releases the
+// context of the attempt that opened it.
+type backendObject struct {
+	*minio.Object
+	cancel context.CancelFunc
+}
+
+func (o *backendObject) Close() error {
+	err := o.Object.Close()
+	o.cancel()
+	return err
+}
+
+// openObject opens an object for reading and waits for the backend's
+// response headers, retrying transient failures and hedging the request
+// for keys matching the hedge patterns.
+func (s *TempoS3ShardServer) openObject(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (*backendObject, minio.ObjectInfo, error) {
+	var object *backendObject
+	var info minio.ObjectInfo
+	err := s.retry(ctx, "get", bucket, func() error {
+		var err error
+		if s.shouldHedge(key) {
+			object, info, err = s.openHedged(ctx, bucket, key, opts, s.openAttempt)
+		} else {
+			object, info, err = s.openAttempt(ctx, bucket, key, opts)
+		}
+		return err
+	})
+	return object, info, err
+}
+
+// openFunc makes a single attempt to open an object.
+type openFunc func(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (*backendObject, minio.ObjectInfo, error)
+
+// openAttempt makes a single breaker-guarded attempt to open an object.
+// The admission slot is held until the object is closed, since its
+// backend connection is in use until then.
+func (s *TempoS3ShardServer) openAttempt(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (*backendObject, minio.ObjectInfo, error) {
+	slot, err := s.admit(ctx, "get", bucket)
+	if err != nil {
+		return nil, minio.ObjectInfo{}, err
+	}
+	attemptCtx, cancel := context.WithCancel(ctx)
+
+	var object *minio.Object
+	var info minio.ObjectInfo
+	err = s.guardBackend("get", bucket, func() error {
+		var err error
+		object, err = s.clients().GetIdempotentClient().GetObject(attemptCtx, bucket, key, opts)
+		if err != nil {
+			return err
+		}
+		// GetObject is lazy; Stat performs the request to the backend
+		info, err = object.Stat()
+		return err
+	})
+	slot.observe(err)
+	if err != nil {
+		if object != nil {
+			object.Close()
+		}
+		cancel()
+		slot.release()
+		return nil, minio.ObjectInfo{}, err
+	}
+	return &backendObject{Object: object, cancel: func() {
+		cancel()
+		slot.release()
+	}}, info, nil
+}
+
+// openHedged opens an object and, if the backend has not answered within
+// the hedge delay, races a second attempt against the first. The losing
+// attempt is cancelled. Attempts are made with attempt.
+func (s *TempoS3ShardServer) openHedged(ctx context.Context, bucket, key string, opts minio.GetObjectOptions, attempt openFunc) (*backendObject, minio.ObjectInfo, error) {
+	start := time.Now()
+	delay, ok := s.hedgeLatency.percentile(s.cfg().Hedge.Percentile)
+	if !ok {
+		// Not enough samples yet to pick a meaningful delay
+		object, info, err := attempt(ctx, bucket, key, opts)
+		if err == nil {
+			s.hedgeLatency.observe(time.Since(start))
+		}
+		return object, info, err
+	}
+	if minDelay := s.cfg().Hedge.MinDelay.Std(); delay < minDelay {
+		delay = minDelay
+	}
+
+	type result struct {
+		object *backendObject
+		info   minio.ObjectInfo
+		err    error
+		index  int
+	}
+	results := make(chan result, 2)
+	var cancels []context.CancelFunc
+	launch := func() {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			object, info, err := attempt(attemptCtx, bucket, key, opts)
+			results <- result{object: object, info: info, err: err, index: index}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending := 1
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			launch()
+			pending++
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				if firstErr == nil {
+					firstErr = res.err
+				}
+				if pending > 0 {
+					continue
+				}
+				for _, cancel := range cancels {
+					cancel()
+				}
+				return nil, minio.ObjectInfo{}, firstErr
+			}
+
+			s.hedgeLatency.observe(time.Since(start))
+			if len(cancels) > 1 {
+				winner := "primary"
+				if res.index > 0 {
+					winner = "hedge"
+				}
+				metrics.HedgedRequestsTotal.WithLabelValues(bucket, winner).Inc()
+			}
+
+			// Cancel the losing attempt and release whatever it opened
+			for i, cancel := range cancels {
+				if i != res.index {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go func() {
+					if lost := <-results; lost.object != nil {
+						lost.object.Close()
+					}
+				}()
+			}
+
+			attemptCancel, openCancel := cancels[res.index], res.object.cancel
+			res.object.cancel = func() {
+				openCancel()
+				attemptCancel()
+			}
+			return res.object, res.info, nil
+		}
+	}
+}
+
+// shouldHedge reports whether GETs of key are hedged.
+func (s *TempoS3ShardServer) shouldHedge(key string) bool {
+	if !s.cfg().Hedge.Enabled {
+		return false
+	}
+	for _, pattern := range s.runtime().hedgePatterns {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+const (
+	latencySampleSize = 512
+	minLatencySamples = 20
+)
+
+// latencyTracker keeps a sliding window of recent latencies.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (t *latencyTracker) observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.samples) < latencySampleSize {
+		t.samples = append(t.samples, d)
+		return
+	}
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % latencySampleSize
+}
+
+// percentile returns the p-th (0-1) percentile of the window, or false if
+// too few samples have been observed.
+func (t *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	if len(t.samples) < minLatencySamples {
+		t.mu.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), t.samples...)
+	t.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(p * float64(len(sorted)-1))
+	return sorted[idx], true
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/config"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := config.RetryConfig{
+		InitialBackoff: config.Duration(100 * time.Millisecond),
+		MaxBackoff:     config.Duration(time.Second),
+	}
+	for _, tc := range []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		// Shifts that would overflow stay at the maximum
+		{100, time.Second},
+	} {
+		var longest time.Duration
+		for range 1000 {
+			d := backoff(policy, tc.attempt)
+			if d < 0 || d > tc.ceiling {
+				t.Fatalf("attempt %d backed off %v, want within [0, %v]", tc.attempt, d, tc.ceiling)
+			}
+			longest = max(longest, d)
+		}
+		// The jitter spans the whole range
+		if longest < tc.ceiling/2 {
+			t.Fatalf("attempt %d backed off at most %v over 1000 tries, want up to %v", tc.attempt, longest, tc.ceiling)
+		}
+	}
+
+	if d := backoff(config.RetryConfig{}, 3); d != 0 {
+		t.Fatalf("zero policy backed off %v, want 0", d)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"success", nil, false},
+		{"breaker open", fmt.Errorf("list: %w", errShardUnavailable), false},
+		{"overloaded", errOverloaded, false},
+		{"cancelled", fmt.Errorf("get: %w", context.Canceled), false},
+		{"timed out", context.DeadlineExceeded, false},
+		{"slow down", minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}, true},
+		{"throttled", minio.ErrorResponse{Code: "Throttling", StatusCode: 400}, true},
+		{"bad gateway", minio.ErrorResponse{StatusCode: 502}, true},
+		{"missing key", minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}, false},
+		{"access denied", minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}, false},
+		{"transport", errors.New("connection reset by peer"), true},
+	} {
+		if got := isRetryable(tc.err); got != tc.want {
+			t.Errorf("%s: isRetryable(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	var tracker latencyTracker
+	for i := 1; i < minLatencySamples; i++ {
+		tracker.observe(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := tracker.percentile(0.5); ok {
+		t.Fatal("percentile reported with too few samples")
+	}
+
+	for i := minLatencySamples; i <= 100; i++ {
+		tracker.observe(time.Duration(i) * time.Millisecond)
+	}
+	for p, want := range map[float64]time.Duration{
+		0:    time.Millisecond,
+		0.5:  50 * time.Millisecond,
+		0.99: 99 * time.Millisecond,
+		1:    100 * time.Millisecond,
+	} {
+		if got, _ := tracker.percentile(p); got != want {
+			t.Errorf("percentile %v is %v, want %v", p, got, want)
+		}
+	}
+
+	// Old samples slide out of the window
+	for range latencySampleSize {
+		tracker.observe(time.Second)
+	}
+	if got, _ := tracker.percentile(0); got != time.Second {
+		t.Fatalf("minimum is %v after the window filled with 1s, want 1s", got)
+	}
+}
+
+// newHedgeServer returns a test server whose hedge delay is 10ms.
+func newHedgeServer() *TempoS3ShardServer {
+	s := newTestServer()
+	s.cfg().Hedge.Percentile = 0.5
+	for range minLatencySamples {
+		s.hedgeLatency.observe(10 * time.Millisecond)
+	}
+	return s
+}
+
+// fakeOpen returns an object opened by attempt, recording its close on
+// closed.
+func fakeOpen(attempt int, closed chan<- int) (*backendObject, minio.ObjectInfo, error) {
+	return &backendObject{cancel: func() { closed <- attempt }}, minio.ObjectInfo{ETag: fmt.Sprint(attempt)}, nil
+}
+
+func TestOpenHedgedHedgeWins(t *testing.T) {
+	s := newHedgeServer()
+	closed := make(chan int, 2)
+	var attempts atomic.Int32
+	primaryCancelled := make(chan struct{})
+	attempt := func(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (*backendObject, minio.ObjectInfo, error) {
+		n := int(attempts.Add(1))
+		if n == 1 {
+			<-ctx.Done()
+			close(primaryCancelled)
+			return nil, minio.ObjectInfo{}, ctx.Err()
+		}
+		return fakeOpen(n, closed)
+	}
+
+	object, info, err := s.openHedged(context.Background(), "shard1", "key", minio.GetObjectOptions{}, attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ETag != "2" {
+		t.Fatalf("opened attempt %s, want the hedge", info.ETag)
+	}
+	select {
+	case <-primaryCancelled:
+	case <-time.After(time.Second):
+		t.Fatal("losing primary not cancelled")
+	}
+	object.Close()
+	if n := <-closed; n != 2 {
+		t.Fatalf("closing the result released attempt %d, want 2", n)
+	}
+}
+
+// TestOpenHedgedLoserClosed checks that an attempt that opens its object
+// after losing the race has it closed.
+func TestOpenHedgedLoserClosed(t *testing.T) {
+	s := newHedgeServer()
+	closed := make(chan int, 2)
+	var attempts atomic.Int32
+	hedgeWon := make(chan struct{})
+	attempt := func(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (*backendObject, minio.ObjectInfo, error) {
+		n := int(attempts.Add(1))
+		if n == 1 {
+			// A slow primary that ignores cancellation
+			<-hedgeWon
+		}
+		return fakeOpen(n, closed)
+	}
+
+	object, info, err := s.openHedged(context.Background(), "shard1", "key", minio.GetObjectOptions{}, attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ETag != "2" {
+		t.Fatalf("opened attempt %s, want the hedge", info.ETag)
+	}
+	close(hedgeWon)
+	select {
+	case n := <-closed:
+		if n != 1 {
+			t.Fatalf("attempt %d released before the result was closed, want the loser", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("losing attempt's object never closed")
+	}
+	object.Close()
+}
+
+func TestOpenHedgedBothFail(t *testing.T) {
+	s := newHedgeServer()
+	errPrimary := errors.New("primary failed")
+	errHedge := errors.New("hedge failed")
+	var attempts atomic.Int32
+	hedgeStarted := make(chan struct{})
+	primaryFailed := make(chan struct{})
+	attempt := func(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (*backendObject, minio.ObjectInfo, error) {
+		if attempts.Add(1) == 1 {
+			<-hedgeStarted
+			defer close(primaryFailed)
+			return nil, minio.ObjectInfo{}, errPrimary
+		}
+		close(hedgeStarted)
+		<-primaryFailed
+		return nil, minio.ObjectInfo{}, errHedge
+	}
+
+	_, _, err := s.openHedged(context.Background(), "shard1", "key", minio.GetObjectOptions{}, attempt)
+	if err != errPrimary {
+		t.Fatalf("got %v, want the first failure %v", err, errPrimary)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("made %d attempts, want 2", n)
+	}
+}
+
+func TestOpenHedgedWithoutSamples(t *testing.T) {
+	s := newTestServer()
+	var attempts atomic.Int32
+	attempt := func(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (*backendObject, minio.ObjectInfo, error) {
+		attempts.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return &backendObject{cancel: func() {}}, minio.ObjectInfo{}, nil
+	}
+
+	object, _, err := s.openHedged(context.Background(), "shard1", "key", minio.GetObjectOptions{}, attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object.Close()
+	if n := attempts.Load(); n != 1 {
+		t.Fatalf("made %d attempts with no latency samples, want 1", n)
+	}
+}
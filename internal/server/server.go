@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
@@ -9,30 +11,78 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/tags"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"tempo-s3-shard/internal/breaker"
+	"tempo-s3-shard/internal/cache"
 	"tempo-s3-shard/internal/client"
 	"tempo-s3-shard/internal/config"
 	"tempo-s3-shard/internal/metrics"
+	"tempo-s3-shard/internal/ratelimit"
+	"tempo-s3-shard/internal/usage"
 )
 
 type TempoS3ShardServer struct {
-	mux           *http.ServeMux
-	clientManager *client.S3ClientManager
-	config        *config.Config
-	logger        *slog.Logger
+	mux *http.ServeMux
+	// state holds the settings that can be reloaded; see cfg and runtime.
+	state        atomic.Pointer[runtimeState]
+	logger       *slog.Logger
+	logLevel     *slog.LevelVar
+	breakers     *breaker.Set
+	hedgeLatency latencyTracker
+	cache        *cache.Cache
+	statCache    *statCache
+	listCache    *listCache
+	repairs      sync.Map
+	// reloadMu serializes reloads.
+	reloadMu sync.Mutex
+	// Flight groups coalescing identical in-flight reads; nil when
+	// single_flight is disabled.
+	statFlights *flightGroup[statResult]
+	getFlights  *flightGroup[*cache.Entry]
+	listFlights *flightGroup[[]listEntry]
+	// Shutdown state; see ListenAndServe. done is closed when shutdown
+	// starts, stopping the background loops.
+	done     chan struct{}
+	stopping atomic.Bool
+	requests sync.WaitGroup
+	inFlight atomic.Int64
+	uploads  uploadTracker
+	// rateLimiters holds the rate limiter state per tenant and operation.
+	rateLimiters *ratelimit.Set
+	// admission bounds the backend calls in flight; nil when disabled.
+	admission *admissionControl
+	// usage accounts storage per tenant and shard; nil when disabled.
+	usage *usage.Tracker
+	// expired holds the keys and block directories that the lifecycle
+	// worker is deleting.
+	expired sync.Map
 }
 
 func NewTempoS3ShardServer(cfg *config.Config) (*TempoS3ShardServer, error) {
 	// Initialize structured logger with logfmt format
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.GetLogLevel())
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: cfg.GetLogLevel(),
+		Level: logLevel,
 	}))
 	
-	clientManager, err := client.NewS3ClientManager(cfg)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	state, err := newRuntimeState(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if state.clients, err = client.NewS3ClientManager(cfg); err != nil {
+		return nil, err
+	}
+	objectCache, err := newObjectCache(cfg.Cache)
 	if err != nil {
 		return nil, err
 	}
@@ -40,15 +90,38 @@ func NewTempoS3ShardServer(cfg *config.Config) (*TempoS3ShardServer, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	
-	if err := clientManager.EnsureBucketsExist(ctx); err != nil {
+	if err := state.clients.EnsureBucketsExist(ctx); err != nil {
 		logger.Warn("Failed to ensure buckets exist", "error", err)
 	}
 
 	s := &TempoS3ShardServer{
-		mux:           http.NewServeMux(),
-		clientManager: clientManager,
-		config:        cfg,
-		logger:        logger,
+		mux:          http.NewServeMux(),
+		logger:       logger,
+		logLevel:     logLevel,
+		breakers:     newBreakerSet(cfg.CircuitBreaker, cfg.Buckets, logger),
+		cache:        objectCache,
+		statCache:    newStatCache(cfg.StatCache),
+		listCache:    newListCache(cfg.ListCache),
+		done:         make(chan struct{}),
+		rateLimiters: ratelimit.NewSet(rateLimiterIdleTimeout),
+		admission:    newAdmission(cfg.Admission),
+		usage:        newUsageTracker(cfg.Usage),
+	}
+	s.state.Store(state)
+	metrics.ConfigInfo.WithLabelValues(cfg.Hash()).Set(1)
+	if cfg.SingleFlight.Enabled {
+		s.statFlights = newFlightGroup[statResult]()
+		s.getFlights = newFlightGroup[*cache.Entry]()
+		s.listFlights = newFlightGroup[[]listEntry]()
+	}
+	if s.listCache != nil {
+		go s.runListRefresh()
+	}
+	if s.usage != nil {
+		go s.runUsageScan()
+	}
+	if cfg.Lifecycle.Enabled {
+		go s.runLifecycle()
 	}
 	s.setupRoutes()
 	return s, nil
@@ -56,6 +129,12 @@ func NewTempoS3ShardServer(cfg *config.Config) (*TempoS3ShardServer, error) {
 
 func (s *TempoS3ShardServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
+	s.requests.Add(1)
+	metrics.InFlightRequests.Set(float64(s.inFlight.Add(1)))
+	defer func() {
+		metrics.InFlightRequests.Set(float64(s.inFlight.Add(-1)))
+		s.requests.Done()
+	}()
 	
 	// Wrap response writer to capture status code
 	wrapped := &responseWriter{ResponseWriter: w, statusCode: 200}
@@ -68,7 +147,7 @@ func (s *TempoS3ShardServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	metrics.HttpRequestDuration.WithLabelValues(r.Method, path).Observe(duration)
 	
 	// Structured access log
-	s.logger.Info("HTTP request",
+	fields := []any{
 		"method", r.Method,
 		"path", r.URL.Path,
 		"status", wrapped.statusCode,
@@ -76,7 +155,11 @@ func (s *TempoS3ShardServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"remote_addr", r.RemoteAddr,
 		"user_agent", r.Header.Get("User-Agent"),
 		"content_length", r.ContentLength,
-	)
+	}
+	if client := clientIdentity(r); client != "" {
+		fields = append(fields, "client", client)
+	}
+	s.logger.Info("HTTP request", fields...)
 }
 
 type responseWriter struct {
@@ -90,8 +173,8 @@ func (rw *responseWriter) WriteHeader(code int) {
 }
 
 func (s *TempoS3ShardServer) normalizePath(path string) string {
-	if path == "/metrics" {
-		return "/metrics"
+	if path == "/metrics" || path == "/ready" || path == usagePath {
+		return path
 	}
 	if path == "/" || path == "" {
 		return "/"
@@ -106,6 +189,7 @@ func (s *TempoS3ShardServer) normalizePath(path string) string {
 func (s *TempoS3ShardServer) setupRoutes() {
 	s.mux.HandleFunc("/", s.handleRequest)
 	s.mux.Handle("/metrics", promhttp.Handler())
+	s.mux.HandleFunc("/ready", s.handleReady)
 }
 
 func (s *TempoS3ShardServer) handleRequest(w http.ResponseWriter, r *http.Request) {
@@ -116,6 +200,28 @@ func (s *TempoS3ShardServer) handleRequest(w http.ResponseWriter, r *http.Reques
 	if path == "" {
 		pathParts = []string{}
 	}
+	// The proxy's internal objects, such as erasure pieces, are only ever
+	// reached through the objects they belong to
+	if len(pathParts) >= 2 && isReservedKey(strings.Join(pathParts[1:], "/")) {
+		writeS3Error(w, r, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+	if !s.authorize(w, r, pathParts) {
+		return
+	}
+	if r.URL.Path == usagePath {
+		s.handleUsage(w, r)
+		return
+	}
+	if isUnsupported(r, pathParts) {
+		writeNotImplemented(w, r)
+		return
+	}
+	w, done, ok := s.limitRequest(w, r, pathParts)
+	if !ok {
+		return
+	}
+	defer done()
 	
 	switch r.Method {
 	case "GET":
@@ -124,14 +230,17 @@ func (s *TempoS3ShardServer) handleRequest(w http.ResponseWriter, r *http.Reques
 		} else if len(pathParts) == 1 {
 			// Check if this is a bucket existence check (with location query param)
 			_, hasLocation := r.URL.Query()["location"]
+			subresource, isConfig := bucketSubresource(r.URL.Query())
 			if hasLocation {
 				s.handleGetBucketLocation(w, r, pathParts[0])
+			} else if isConfig {
+				s.handleGetBucketConfig(w, r, pathParts[0], subresource)
 			} else {
 				s.handleListObjects(w, r, pathParts[0])
 			}
 		} else if len(pathParts) >= 2 {
 			objectKey := strings.Join(pathParts[1:], "/")
-			if r.URL.Query().Get("tagging") != "" {
+			if r.URL.Query().Has("tagging") {
 				s.handleGetObjectTagging(w, r, pathParts[0], objectKey)
 			} else {
 				s.handleGetObject(w, r, pathParts[0], objectKey)
@@ -140,7 +249,7 @@ func (s *TempoS3ShardServer) handleRequest(w http.ResponseWriter, r *http.Reques
 	case "PUT":
 		if len(pathParts) >= 2 {
 			objectKey := strings.Join(pathParts[1:], "/")
-			if r.URL.Query().Get("tagging") != "" {
+			if r.URL.Query().Has("tagging") {
 				s.handlePutObjectTagging(w, r, pathParts[0], objectKey)
 			} else {
 				s.handlePutObject(w, r, pathParts[0], objectKey)
@@ -152,12 +261,14 @@ func (s *TempoS3ShardServer) handleRequest(w http.ResponseWriter, r *http.Reques
 			s.handleDeleteObject(w, r, pathParts[0], objectKey)
 		}
 	case "HEAD":
-		if len(pathParts) >= 2 {
+		if len(pathParts) == 1 {
+			s.handleHeadBucket(w, r, pathParts[0])
+		} else if len(pathParts) >= 2 {
 			objectKey := strings.Join(pathParts[1:], "/")
 			s.handleHeadObject(w, r, pathParts[0], objectKey)
 		}
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
 	}
 }
 
@@ -184,7 +295,7 @@ func (s *TempoS3ShardServer) handleListBuckets(w http.ResponseWriter, r *http.Re
 
 func (s *TempoS3ShardServer) handleGetBucketLocation(w http.ResponseWriter, r *http.Request, bucketName string) {
 	// Only accept the virtual bucket name
-	if bucketName != "proxy-bucket" {
+	if bucketName != virtualBucket {
 		http.Error(w, "Bucket not found", http.StatusNotFound)
 		return
 	}
@@ -192,109 +303,19 @@ func (s *TempoS3ShardServer) handleGetBucketLocation(w http.ResponseWriter, r *h
 	w.Header().Set("Content-Type", "application/xml")
 	w.WriteHeader(http.StatusOK)
 	
-	xml := `<?xml version="1.0" encoding="UTF-8"?>
-<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`
-	
-	w.Write([]byte(xml))
-}
-
-func (s *TempoS3ShardServer) handleListObjects(w http.ResponseWriter, r *http.Request, bucketName string) {
-	start := time.Now()
-	ctx := context.Background()
-	prefix := r.URL.Query().Get("prefix")
-	delimiter := r.URL.Query().Get("delimiter")
-	maxKeysStr := r.URL.Query().Get("max-keys")
-	marker := r.URL.Query().Get("marker")
-	
-	maxKeys := 1000
-	if maxKeysStr != "" {
-		if mk, err := strconv.Atoi(maxKeysStr); err == nil && mk > 0 {
-			maxKeys = mk
-		}
-	}
-
-	allObjects := []minio.ObjectInfo{}
-	allPrefixes := []string{}
-	
-	// Record list operation
-	metrics.ListOperationsTotal.WithLabelValues(prefix).Inc()
-	
-	for _, realBucket := range s.clientManager.GetAllBuckets() {
-		bucketStart := time.Now()
-		objCh := s.clientManager.GetClient().ListObjects(ctx, realBucket, minio.ListObjectsOptions{
-			Prefix:    prefix,
-			Recursive: delimiter == "",
-		})
-		
-		bucketObjects := 0
-		for object := range objCh {
-			if object.Err != nil {
-				s.logger.Error("Error listing objects", "bucket", realBucket, "error", object.Err)
-				metrics.S3OperationsTotal.WithLabelValues("list", realBucket, "error").Inc()
-				continue
-			}
-			allObjects = append(allObjects, object)
-			bucketObjects++
-		}
-		
-		// Record bucket-specific metrics
-		metrics.S3OperationDuration.WithLabelValues("list", realBucket).Observe(time.Since(bucketStart).Seconds())
-		metrics.S3OperationsTotal.WithLabelValues("list", realBucket, "success").Inc()
-		metrics.ListObjectsCount.WithLabelValues(realBucket).Observe(float64(bucketObjects))
-		metrics.BucketOperationsTotal.WithLabelValues(realBucket, "list").Inc()
-	}
-
-	w.Header().Set("Content-Type", "application/xml")
-	w.WriteHeader(http.StatusOK)
-	
-	xml := `<?xml version="1.0" encoding="UTF-8"?>
-<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
-  <Name>` + bucketName + `</Name>
-  <Prefix>` + prefix + `</Prefix>
-  <Marker>` + marker + `</Marker>
-  <MaxKeys>` + strconv.Itoa(maxKeys) + `</MaxKeys>
-  <IsTruncated>false</IsTruncated>`
-	
-	for _, obj := range allObjects {
-		xml += `
-  <Contents>
-    <Key>` + obj.Key + `</Key>
-    <LastModified>` + obj.LastModified.Format(time.RFC3339) + `</LastModified>
-    <ETag>"` + obj.ETag + `"</ETag>
-    <Size>` + strconv.FormatInt(obj.Size, 10) + `</Size>
-    <StorageClass>STANDARD</StorageClass>
-  </Contents>`
-	}
-	
-	for _, prefix := range allPrefixes {
-		xml += `
-  <CommonPrefixes>
-    <Prefix>` + prefix + `</Prefix>
-  </CommonPrefixes>`
-	}
-	
-	xml += `
-</ListBucketResult>`
-	
-	// Record overall list operation metrics
-	duration := time.Since(start).Seconds()
-	s.logger.Debug("List objects operation completed",
-		"bucket", bucketName,
-		"prefix", prefix,
-		"object_count", len(allObjects),
-		"duration_ms", duration*1000,
-	)
-	
-	w.Write([]byte(xml))
+	w.Write(locationBody(s.region()))
 }
 
 func (s *TempoS3ShardServer) handlePutObject(w http.ResponseWriter, r *http.Request, bucketName, objectKey string) {
 	start := time.Now()
-	ctx := context.Background()
-	targetBucket := s.clientManager.GetBucketForKey(objectKey)
+	ctx, cancel := s.operationContext(r, "put")
+	defer cancel()
+	targetBucket := s.clients().GetBucketForKey(objectKey)
 	
 	// Record hash distribution
-	metrics.HashDistribution.WithLabelValues(targetBucket).Inc()
+	for _, replica := range s.clients().GetReplicaBucketsForKey(objectKey) {
+		metrics.HashDistribution.WithLabelValues(replica).Inc()
+	}
 	
 	contentLength := r.ContentLength
 	if contentLength < 0 {
@@ -302,15 +323,44 @@ func (s *TempoS3ShardServer) handlePutObject(w http.ResponseWriter, r *http.Requ
 		http.Error(w, "Content-Length required", http.StatusBadRequest)
 		return
 	}
-	
 	contentType := r.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
+	sse, err := s.sseFromRequest(r)
+	if err != nil {
+		metrics.S3OperationsTotal.WithLabelValues("put", targetBucket, "error").Inc()
+		writeSSEError(w, r, err)
+		return
+	}
+	release, ok := s.reserveQuota(w, r, objectKey, contentLength, sse != nil)
+	if !ok {
+		metrics.S3OperationsTotal.WithLabelValues("put", targetBucket, "error").Inc()
+		return
+	}
+	defer release()
+	
+	// Pieces of an erasure-coded object being replaced are removed once the
+	// new version is stored
+	var previous *erasureManifest
+	if s.cfg().Erasure.Enabled {
+		if previous, err = s.loadManifest(ctx, objectKey); err != nil {
+			s.logger.Warn("Failed to check for an erasure-coded object being replaced", "object_key", objectKey, "error", err)
+		}
+	}
 	
-	info, err := s.clientManager.GetClient().PutObject(ctx, targetBucket, objectKey, r.Body, contentLength, minio.PutObjectOptions{
-		ContentType: contentType,
-	})
+	info, err := s.storeObject(ctx, objectKey, r.Body, contentLength, contentType, sse)
+	// Invalidate even if the write failed, since some replicas may have
+	// stored the new object
+	s.invalidate(objectKey)
+	if isUnavailable(err) {
+		metrics.S3OperationsTotal.WithLabelValues("put", targetBucket, "unavailable").Inc()
+		writeShardUnavailable(w, r, err)
+		return
+	}
+	if s.handleAborted(w, r, ctx, "put", targetBucket, err) {
+		return
+	}
 	if err != nil {
 		s.logger.Error("Error putting object", "object_key", objectKey, "bucket", targetBucket, "error", err)
 		metrics.S3OperationsTotal.WithLabelValues("put", targetBucket, "error").Inc()
@@ -324,25 +374,87 @@ func (s *TempoS3ShardServer) handlePutObject(w http.ResponseWriter, r *http.Requ
 	metrics.ObjectSizeBytes.WithLabelValues("put").Observe(float64(contentLength))
 	metrics.BucketOperationsTotal.WithLabelValues(targetBucket, "put").Inc()
 	
+	if previous != nil {
+		go s.removeErasurePieces(previous)
+	}
+	s.recordListWrite(objectKey, info, contentLength)
+	
 	w.Header().Set("ETag", `"`+info.ETag+`"`)
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *TempoS3ShardServer) handleGetObject(w http.ResponseWriter, r *http.Request, bucketName, objectKey string) {
 	start := time.Now()
-	ctx := context.Background()
-	targetBucket := s.clientManager.GetBucketForKey(objectKey)
+	ctx, cancel, started := s.getContext(r)
+	defer cancel()
 	
-	object, err := s.clientManager.GetClient().GetObject(ctx, targetBucket, objectKey, minio.GetObjectOptions{})
-	if err != nil {
-		s.logger.Error("Error getting object", "object_key", objectKey, "bucket", targetBucket, "error", err)
-		metrics.S3OperationsTotal.WithLabelValues("get", targetBucket, "error").Inc()
+	if s.knownMissing(objectKey) || s.expiring(objectKey) {
+		metrics.S3OperationsTotal.WithLabelValues("get", s.clients().GetBucketForKey(objectKey), "error").Inc()
 		http.Error(w, "Object not found", http.StatusNotFound)
 		return
 	}
-	defer object.Close()
 	
-	info, err := object.Stat()
+	sse, err := s.sseFromRequest(r)
+	if err != nil {
+		metrics.S3OperationsTotal.WithLabelValues("get", s.clients().GetBucketForKey(objectKey), "error").Inc()
+		writeSSEError(w, r, err)
+		return
+	}
+	
+	// Objects read with a customer key are never cached or shared, since
+	// other requests may not hold the key
+	cacheable := sse == nil && s.cacheAdmits(objectKey)
+	var cacheGen uint64
+	if cacheable {
+		if entry, ok := s.cachedObject(ctx, objectKey); ok {
+			s.writeCached(w, r, s.clients().GetBucketForKey(objectKey), entry, start)
+			return
+		}
+		cacheGen = s.cache.Generation()
+	}
+	
+	// Concurrent GETs of the same key wait for the first one, which reads
+	// small objects whole so that each waiter can apply its own Range.
+	var flight *flightCall[*cache.Entry]
+	if s.getFlights != nil && sse == nil {
+		call, leader := s.getFlights.join(objectKey)
+		if leader {
+			flight = call
+			defer s.getFlights.abandon(objectKey, call)
+		} else if entry, shared, err := call.wait(ctx); shared {
+			metrics.CoalescedRequestsTotal.WithLabelValues("get").Inc()
+			bucket := s.clients().GetBucketForKey(objectKey)
+			if err != nil {
+				metrics.S3OperationsTotal.WithLabelValues("get", bucket, "error").Inc()
+				http.Error(w, "Object not found", http.StatusNotFound)
+				return
+			}
+			s.writeCached(w, r, bucket, entry, start)
+			return
+		} else if s.handleAborted(w, r, ctx, "get", s.clients().GetBucketForKey(objectKey), err) {
+			return
+		}
+	}
+	
+	statGen := s.statGeneration()
+	object, info, targetBucket, err := s.openObjectFailover(ctx, objectKey, minio.GetObjectOptions{ServerSideEncryption: sse})
+	if object != nil {
+		defer object.Close()
+	}
+	if sse == nil {
+		s.rememberStat(objectKey, info, err, statGen)
+	}
+	if flight != nil && err != nil {
+		s.getFlights.finish(objectKey, flight, nil, err)
+	}
+	if isUnavailable(err) {
+		metrics.S3OperationsTotal.WithLabelValues("get", targetBucket, "unavailable").Inc()
+		writeShardUnavailable(w, r, err)
+		return
+	}
+	if s.handleAborted(w, r, ctx, "get", targetBucket, err) {
+		return
+	}
 	if err != nil {
 		s.logger.Error("Error getting object stat", "object_key", objectKey, "bucket", targetBucket, "error", err)
 		metrics.S3OperationsTotal.WithLabelValues("get", targetBucket, "error").Inc()
@@ -350,13 +462,68 @@ func (s *TempoS3ShardServer) handleGetObject(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	
+	started()
+	info = logicalInfo(info)
+	share := flight != nil && info.Size <= s.cfg().SingleFlight.MaxObjectSize
+	if flight != nil && !share {
+		// Too large to buffer; let waiters stream it themselves
+		s.getFlights.abandon(objectKey, flight)
+	}
+	fill := cacheable && info.Size <= s.cfg().Cache.MaxObjectSize
+	if share || fill {
+		entry, err := s.readWholeObject(ctx, object, info, targetBucket)
+		if err != nil {
+			s.handleBodyError(w, r, ctx, objectKey, targetBucket, err)
+			return
+		}
+		if share {
+			s.getFlights.finish(objectKey, flight, entry, nil)
+		}
+		if fill {
+			s.cache.Put(objectKey, entry, cacheGen)
+		}
+		s.writeCached(w, r, targetBucket, entry, start)
+		return
+	}
+	
+	offset, length, ranged, err := parseRange(r.Header.Get("Range"), info.Size)
+	if err != nil {
+		metrics.S3OperationsTotal.WithLabelValues("get", targetBucket, "error").Inc()
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		writeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+		return
+	}
+	
+	body, err := s.objectBody(ctx, object, info, targetBucket, offset, length)
+	if err != nil {
+		s.handleBodyError(w, r, ctx, objectKey, targetBucket, err)
+		return
+	}
+	defer body.Close()
+	
 	w.Header().Set("Content-Type", info.ContentType)
-	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
 	w.Header().Set("ETag", `"`+info.ETag+`"`)
 	w.Header().Set("Last-Modified", info.LastModified.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
 	
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, object)
+	if ranged {
+		w.Header().Set("Content-Range", contentRange(offset, length, info.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		// Headers are already sent, so only record why the transfer stopped
+		if reason := abortReason(r, ctx); reason != "" {
+			metrics.RequestAbortsTotal.WithLabelValues("get", targetBucket, reason).Inc()
+			metrics.S3OperationsTotal.WithLabelValues("get", targetBucket, reason).Inc()
+		} else {
+			metrics.S3OperationsTotal.WithLabelValues("get", targetBucket, "error").Inc()
+		}
+		s.logger.Warn("Error streaming object", "object_key", objectKey, "bucket", targetBucket, "error", err)
+		return
+	}
 	
 	// Record success metrics
 	metrics.S3OperationsTotal.WithLabelValues("get", targetBucket, "success").Inc()
@@ -365,12 +532,38 @@ func (s *TempoS3ShardServer) handleGetObject(w http.ResponseWriter, r *http.Requ
 	metrics.BucketOperationsTotal.WithLabelValues(targetBucket, "get").Inc()
 }
 
+// handleBodyError responds to a GET whose object was found but whose body
+// could not be read before the response started.
+func (s *TempoS3ShardServer) handleBodyError(w http.ResponseWriter, r *http.Request, ctx context.Context, objectKey, targetBucket string, err error) {
+	if errors.Is(err, errTooFewPieces) {
+		s.logger.Warn("Erasure-coded object unavailable", "object_key", objectKey, "bucket", targetBucket, "error", err)
+		metrics.S3OperationsTotal.WithLabelValues("get", targetBucket, "unavailable").Inc()
+		writeShardUnavailable(w, r, err)
+		return
+	}
+	if s.handleAborted(w, r, ctx, "get", targetBucket, err) {
+		return
+	}
+	s.logger.Error("Error reading object body", "object_key", objectKey, "bucket", targetBucket, "error", err)
+	metrics.S3OperationsTotal.WithLabelValues("get", targetBucket, "error").Inc()
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
 func (s *TempoS3ShardServer) handleDeleteObject(w http.ResponseWriter, r *http.Request, bucketName, objectKey string) {
 	start := time.Now()
-	ctx := context.Background()
-	targetBucket := s.clientManager.GetBucketForKey(objectKey)
+	ctx, cancel := s.operationContext(r, "delete")
+	defer cancel()
+	targetBucket := s.clients().GetBucketForKey(objectKey)
 	
-	err := s.clientManager.GetClient().RemoveObject(ctx, targetBucket, objectKey, minio.RemoveObjectOptions{})
+	err := s.deleteObject(ctx, objectKey)
+	if isUnavailable(err) {
+		metrics.S3OperationsTotal.WithLabelValues("delete", targetBucket, "unavailable").Inc()
+		writeShardUnavailable(w, r, err)
+		return
+	}
+	if s.handleAborted(w, r, ctx, "delete", targetBucket, err) {
+		return
+	}
 	if err != nil {
 		s.logger.Error("Error deleting object", "object_key", objectKey, "bucket", targetBucket, "error", err)
 		metrics.S3OperationsTotal.WithLabelValues("delete", targetBucket, "error").Inc()
@@ -387,16 +580,38 @@ func (s *TempoS3ShardServer) handleDeleteObject(w http.ResponseWriter, r *http.R
 }
 
 func (s *TempoS3ShardServer) handleHeadObject(w http.ResponseWriter, r *http.Request, bucketName, objectKey string) {
-	ctx := context.Background()
-	targetBucket := s.clientManager.GetBucketForKey(objectKey)
-	
-	info, err := s.clientManager.GetClient().StatObject(ctx, targetBucket, objectKey, minio.StatObjectOptions{})
+	ctx, cancel := s.operationContext(r, "head")
+	defer cancel()
+	if s.expiring(objectKey) {
+		http.Error(w, "Object not found", http.StatusNotFound)
+		return
+	}
+	sse, err := s.sseFromRequest(r)
+	if err != nil {
+		writeSSEError(w, r, err)
+		return
+	}
+	var info minio.ObjectInfo
+	var targetBucket string
+	if sse != nil {
+		info, targetBucket, err = s.statObjectFailover(ctx, objectKey, minio.StatObjectOptions{ServerSideEncryption: sse})
+	} else {
+		info, targetBucket, err = s.statObject(ctx, objectKey)
+	}
+	if isUnavailable(err) {
+		writeShardUnavailable(w, r, err)
+		return
+	}
+	if s.handleAborted(w, r, ctx, "head", targetBucket, err) {
+		return
+	}
 	if err != nil {
 		s.logger.Error("Error getting object stat for HEAD", "object_key", objectKey, "bucket", targetBucket, "error", err)
 		http.Error(w, "Object not found", http.StatusNotFound)
 		return
 	}
 	
+	info = logicalInfo(info)
 	w.Header().Set("Content-Type", info.ContentType)
 	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
 	w.Header().Set("ETag", `"`+info.ETag+`"`)
@@ -406,10 +621,16 @@ func (s *TempoS3ShardServer) handleHeadObject(w http.ResponseWriter, r *http.Req
 }
 
 func (s *TempoS3ShardServer) handleGetObjectTagging(w http.ResponseWriter, r *http.Request, bucketName, objectKey string) {
-	ctx := context.Background()
-	targetBucket := s.clientManager.GetBucketForKey(objectKey)
-	
-	tags, err := s.clientManager.GetClient().GetObjectTagging(ctx, targetBucket, objectKey, minio.GetObjectTaggingOptions{})
+	ctx, cancel := s.operationContext(r, "get_tagging")
+	defer cancel()
+	objectTags, targetBucket, err := s.getObjectTaggingFailover(ctx, objectKey)
+	if isUnavailable(err) {
+		writeShardUnavailable(w, r, err)
+		return
+	}
+	if s.handleAborted(w, r, ctx, "get_tagging", targetBucket, err) {
+		return
+	}
 	if err != nil {
 		s.logger.Error("Error getting object tags", "object_key", objectKey, "bucket", targetBucket, "error", err)
 		http.Error(w, "Object not found", http.StatusNotFound)
@@ -423,7 +644,7 @@ func (s *TempoS3ShardServer) handleGetObjectTagging(w http.ResponseWriter, r *ht
 <Tagging xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
   <TagSet>`
 	
-	for key, value := range tags.ToMap() {
+	for key, value := range objectTags.ToMap() {
 		xml += `
     <Tag>
       <Key>` + key + `</Key>
@@ -439,8 +660,9 @@ func (s *TempoS3ShardServer) handleGetObjectTagging(w http.ResponseWriter, r *ht
 }
 
 func (s *TempoS3ShardServer) handlePutObjectTagging(w http.ResponseWriter, r *http.Request, bucketName, objectKey string) {
-	ctx := context.Background()
-	targetBucket := s.clientManager.GetBucketForKey(objectKey)
+	ctx, cancel := s.operationContext(r, "put_tagging")
+	defer cancel()
+	targetBucket := s.clients().GetBucketForKey(objectKey)
 	
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -467,7 +689,18 @@ func (s *TempoS3ShardServer) handlePutObjectTagging(w http.ResponseWriter, r *ht
 		return
 	}
 	
-	err = s.clientManager.GetClient().PutObjectTagging(ctx, targetBucket, objectKey, objectTags, minio.PutObjectTaggingOptions{})
+	err = s.writeReplicated(ctx, "put_tagging", objectKey, func(bucket string) error {
+		return s.callBackend(ctx, "put_tagging", bucket, func() error {
+			return s.clients().GetClient().PutObjectTagging(ctx, bucket, objectKey, objectTags, minio.PutObjectTaggingOptions{})
+		})
+	})
+	if isUnavailable(err) {
+		writeShardUnavailable(w, r, err)
+		return
+	}
+	if s.handleAborted(w, r, ctx, "put_tagging", targetBucket, err) {
+		return
+	}
 	if err != nil {
 		s.logger.Error("Error putting object tags", "object_key", objectKey, "bucket", targetBucket, "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/metrics"
+)
+
+const (
+	// cancelGrace bounds the wait for cancelled requests to return once the
+	// shutdown timeout has passed.
+	cancelGrace = 10 * time.Second
+	// abortTimeout bounds aborting the multipart uploads left behind by
+	// cancelled requests.
+	abortTimeout = 30 * time.Second
+	// uploadClockSkew is allowed between this host and the backend when
+	// matching multipart uploads to the PUTs that started them.
+	uploadClockSkew = time.Minute
+	// streamPartSize is the part size of uploads whose size is not known
+	// in advance. The client buffers one part per upload, so it is kept
+	// at the smallest size S3 allows.
+	streamPartSize = 5 << 20
+)
+
+// ListenAndServe serves requests on the configured listen address until a
+// signal is received from stop, then shuts down gracefully:
+//
+//  1. /ready starts failing and the background loops stop; requests are
+//     still accepted for server.shutdown_delay.
+//  2. The listener is closed and in-flight requests are drained for up to
+//     server.shutdown_timeout.
+//  3. Requests still running are cancelled, and the multipart uploads
+//     their PUTs had started on the backend are aborted.
+//
+// It returns nil after a shutdown, or the error that stopped the server.
+func (s *TempoS3ShardServer) ListenAndServe(stop <-chan os.Signal) error {
+	cfg := s.cfg().Server
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv := &http.Server{
+		Addr:              s.cfg().ListenAddr,
+		Handler:           s,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout.Std(),
+		ReadTimeout:       cfg.ReadTimeout.Std(),
+		WriteTimeout:      cfg.WriteTimeout.Std(),
+		IdleTimeout:       cfg.IdleTimeout.Std(),
+		BaseContext:       func(net.Listener) context.Context { return requestCtx },
+		ErrorLog:          slog.NewLogLogger(s.logger.Handler(), slog.LevelWarn),
+		ConnState:         trackConnState,
+	}
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	if s.runtime().tls != nil {
+		listener = tls.NewListener(listener, &tls.Config{GetConfigForClient: s.tlsConfigForClient})
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(listener) }()
+	select {
+	case err := <-served:
+		return err
+	case sig := <-stop:
+		s.logger.Info("Received signal, shutting down", "signal", sig.String())
+	}
+	s.shutdown(srv, cancelRequests)
+	return nil
+}
+
+func (s *TempoS3ShardServer) shutdown(srv *http.Server, cancelRequests context.CancelFunc) {
+	start := time.Now()
+	phaseStart := start
+	phase := func(name string, args ...any) {
+		now := time.Now()
+		args = append([]any{"phase", name, "duration_ms", now.Sub(phaseStart).Seconds() * 1000}, args...)
+		s.logger.Info("Shutdown phase complete", args...)
+		phaseStart = now
+	}
+	cfg := s.cfg().Server
+
+	s.stopping.Store(true)
+	close(s.done)
+	if delay := cfg.ShutdownDelay.Std(); delay > 0 {
+		time.Sleep(delay)
+	}
+	phase("unready")
+
+	ctx := context.Background()
+	if timeout := cfg.ShutdownTimeout.Std(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := srv.Shutdown(ctx)
+	phase("drain", "in_flight", s.inFlight.Load())
+	if err == nil {
+		s.logger.Info("Shutdown complete", "duration_ms", time.Since(start).Seconds()*1000)
+		return
+	}
+
+	// Uploads are collected before cancelling, while the PUTs that own
+	// them are still registered
+	uploads := s.uploads.snapshot()
+	cancelRequests()
+	srv.Close()
+	waited := make(chan struct{})
+	go func() {
+		s.requests.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(cancelGrace):
+		s.logger.Warn("Cancelled requests did not finish", "in_flight", s.inFlight.Load())
+	}
+	phase("cancel")
+
+	aborted := s.abortUploads(uploads)
+	phase("abort_uploads", "uploads", len(uploads), "aborted", aborted)
+	s.logger.Info("Shutdown complete", "duration_ms", time.Since(start).Seconds()*1000)
+}
+
+// trackConnState keeps the active connections gauge up to date. Hijacked
+// connections are no longer managed by the server and count as closed.
+func trackConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		metrics.ActiveConnections.Inc()
+	case http.StateClosed, http.StateHijacked:
+		metrics.ActiveConnections.Dec()
+	}
+}
+
+// handleReady reports whether the server accepts new requests, for
+// readiness probes.
+func (s *TempoS3ShardServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if s.stopping.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
+
+// putObject is PutObject on the backend, registered for the duration of
+// the call so that a shutdown can abort the multipart upload it leaves
+// behind if cancelled. A size of -1 streams body as a multipart upload.
+func (s *TempoS3ShardServer) putObject(ctx context.Context, bucket, key string, body io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	if size < 0 && opts.PartSize == 0 {
+		opts.PartSize = streamPartSize
+	}
+	// Erasure pieces are written under fresh keys, so only whole objects
+	// can replace one
+	prev := int64(-1)
+	if !strings.HasPrefix(key, erasurePrefix) {
+		var err error
+		if prev, err = s.storedSize(ctx, bucket, key); err != nil {
+			s.logger.Debug("Failed to stat object being replaced, usage may overcount until the next scan", "bucket", bucket, "object_key", key, "error", err)
+		}
+	}
+	u := &upload{bucket: bucket, key: key, started: time.Now()}
+	s.uploads.add(u)
+	defer s.uploads.remove(u)
+	info, err := s.clients().GetClient().PutObject(ctx, bucket, key, body, size, opts)
+	if err == nil {
+		s.recordPut(bucket, key, prev, info.Size)
+	}
+	return info, err
+}
+
+// abortUploads aborts the incomplete multipart uploads of the given PUTs
+// and returns how many were aborted. The client aborts the uploads of a
+// failed PUT itself, but not when the PUT's context was cancelled.
+func (s *TempoS3ShardServer) abortUploads(uploads []*upload) int {
+	if len(uploads) == 0 {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	core := minio.Core{Client: s.clients().GetClient()}
+	aborted := 0
+	for _, u := range uploads {
+		for info := range core.ListIncompleteUploads(ctx, u.bucket, u.key, false) {
+			if info.Err != nil {
+				s.logger.Warn("Failed to list multipart uploads", "bucket", u.bucket, "object_key", u.key, "error", info.Err)
+				break
+			}
+			// Uploads of the same key by other replicas of the proxy are
+			// left alone
+			if info.Key != u.key || info.Initiated.Before(u.started.Add(-uploadClockSkew)) {
+				continue
+			}
+			if err := core.AbortMultipartUpload(ctx, u.bucket, u.key, info.UploadID); err != nil {
+				s.logger.Warn("Failed to abort multipart upload", "bucket", u.bucket, "object_key", u.key, "upload_id", info.UploadID, "error", err)
+				continue
+			}
+			s.logger.Info("Aborted multipart upload", "bucket", u.bucket, "object_key", u.key, "upload_id", info.UploadID)
+			aborted++
+		}
+	}
+	return aborted
+}
+
+// upload is a backend PUT in progress.
+type upload struct {
+	bucket  string
+	key     string
+	started time.Time
+}
+
+// uploadTracker is the set of backend PUTs in progress.
+type uploadTracker struct {
+	mu      sync.Mutex
+	uploads map[*upload]struct{}
+}
+
+func (t *uploadTracker) add(u *upload) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.uploads == nil {
+		t.uploads = make(map[*upload]struct{})
+	}
+	t.uploads[u] = struct{}{}
+}
+
+func (t *uploadTracker) remove(u *upload) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.uploads, u)
+}
+
+func (t *uploadTracker) snapshot() []*upload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	uploads := make([]*upload, 0, len(t.uploads))
+	for u := range t.uploads {
+		uploads = append(uploads, u)
+	}
+	return uploads
+}
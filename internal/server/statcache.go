@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/cache"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+// errNoSuchKey is returned for keys the stat cache knows to be missing. It
+// is indistinguishable from the backend's own NoSuchKey error.
+var errNoSuchKey = minio.ErrorResponse{
+	Code:       "NoSuchKey",
+	Message:    "The specified key does not exist.",
+	StatusCode: http.StatusNotFound,
+}
+
+// statCache caches object metadata by key and ETag. current maps each key
+// to the ETag it was last seen with, or records that it is missing, and is
+// what writes through the proxy invalidate. versions holds the metadata of
+// each version seen, which never changes for a given ETag.
+type statCache struct {
+	current  *cache.TTL[string]
+	versions *cache.TTL[minio.ObjectInfo]
+}
+
+func newStatCache(cfg config.StatCacheConfig) *statCache {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &statCache{
+		current:  cache.NewTTL[string](cfg.MaxEntries, cfg.TTL.Std(), cfg.NegativeTTL.Std()),
+		versions: cache.NewTTL[minio.ObjectInfo](cfg.MaxEntries, cfg.TTL.Std(), 0),
+	}
+}
+
+func versionKey(key, etag string) string {
+	return key + "\x00" + etag
+}
+
+// get returns the metadata of the current version of key. If ok is true
+// and missing is true, the key is known not to exist.
+func (c *statCache) get(key string) (info minio.ObjectInfo, missing, ok bool) {
+	etag, missing, ok := c.current.Get(key)
+	if !ok || missing {
+		return info, missing, ok
+	}
+	info, _, ok = c.versions.Get(versionKey(key, etag))
+	return info, false, ok
+}
+
+// generation returns the generation to pass to put and putMissing.
+func (c *statCache) generation() uint64 {
+	return c.current.Generation()
+}
+
+// put records info as the current version of key, unless key was
+// invalidated since gen.
+func (c *statCache) put(key string, info minio.ObjectInfo, gen uint64) {
+	c.versions.Put(versionKey(key, info.ETag), info, c.versions.Generation())
+	c.current.Put(key, info.ETag, gen)
+}
+
+func (c *statCache) putMissing(key string, gen uint64) {
+	c.current.PutMissing(key, gen)
+}
+
+func (c *statCache) remove(key string) {
+	c.current.Remove(key)
+}
+
+// statObject returns key's metadata from the stat cache, or from the first
+// replica that has it. The bucket is the ring owner for cached results.
+// Concurrent lookups of the same key share one backend request.
+func (s *TempoS3ShardServer) statObject(ctx context.Context, key string) (minio.ObjectInfo, string, error) {
+	var gen uint64
+	if s.statCache != nil {
+		if info, missing, ok := s.statCache.get(key); ok {
+			bucket := s.clients().GetBucketForKey(key)
+			if missing {
+				metrics.StatCacheRequestsTotal.WithLabelValues("negative_hit").Inc()
+				return minio.ObjectInfo{}, bucket, errNoSuchKey
+			}
+			metrics.StatCacheRequestsTotal.WithLabelValues("hit").Inc()
+			return info, bucket, nil
+		}
+		metrics.StatCacheRequestsTotal.WithLabelValues("miss").Inc()
+		gen = s.statCache.generation()
+	}
+
+	res, err := coalesce(ctx, s.statFlights, "head", key, func() (statResult, error) {
+		info, bucket, err := s.statObjectFailover(ctx, key, minio.StatObjectOptions{})
+		s.rememberStat(key, info, err, gen)
+		return statResult{info: info, bucket: bucket}, err
+	})
+	return res.info, res.bucket, err
+}
+
+// statResult is the outcome of a stat shared between coalesced requests.
+type statResult struct {
+	info   minio.ObjectInfo
+	bucket string
+}
+
+// knownMissing reports whether the stat cache recently saw key missing.
+func (s *TempoS3ShardServer) knownMissing(key string) bool {
+	if s.statCache == nil {
+		return false
+	}
+	_, missing, ok := s.statCache.get(key)
+	if ok && missing {
+		metrics.StatCacheRequestsTotal.WithLabelValues("negative_hit").Inc()
+		return true
+	}
+	return false
+}
+
+// statGeneration returns the stat cache generation to pass to rememberStat.
+func (s *TempoS3ShardServer) statGeneration() uint64 {
+	if s.statCache == nil {
+		return 0
+	}
+	return s.statCache.generation()
+}
+
+// rememberStat records the outcome of a backend lookup of key. Errors other
+// than NoSuchKey are not cached.
+func (s *TempoS3ShardServer) rememberStat(key string, info minio.ObjectInfo, err error, gen uint64) {
+	if s.statCache == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		s.statCache.put(key, info, gen)
+	case isNotFound(err):
+		s.statCache.putMissing(key, gen)
+	}
+}
+
+// invalidate drops key from every cache after a write or delete through
+// the proxy, and stops later requests joining reads already in flight.
+func (s *TempoS3ShardServer) invalidate(key string) {
+	if s.cache != nil {
+		s.cache.Remove(key)
+	}
+	if s.statCache != nil {
+		s.statCache.remove(key)
+	}
+	if s.statFlights != nil {
+		s.statFlights.forget(key)
+		s.getFlights.forget(key)
+		s.listFlights.forgetAll()
+	}
+}
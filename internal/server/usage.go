@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/envelope"
+	"tempo-s3-shard/internal/metrics"
+	"tempo-s3-shard/internal/usage"
+)
+
+// usageRetryInterval is how long to wait before scanning a bucket again
+// after its scan failed.
+const usageRetryInterval = time.Minute
+
+// usagePath serves the usage report.
+const usagePath = "/admin/usage"
+
+// newUsageTracker returns a tracker that exports the usage of the tenants
+// with quotas in cfg by name, and sums up all other tenants as "other".
+// The tenants labelled by name are those of the config at startup, so
+// that each tenant's usage stays in one series.
+func newUsageTracker(cfg config.UsageConfig) *usage.Tracker {
+	if !cfg.Enabled {
+		return nil
+	}
+	labelled := maps.Clone(cfg.Quotas)
+	return usage.New(usageTenant, func(tenant, bucket string, from, to usage.Usage) {
+		label := tenantLabel(labelled, tenant)
+		if label == tenant && to.Objects == 0 {
+			metrics.UsageBytes.DeleteLabelValues(label, bucket)
+			metrics.UsageObjects.DeleteLabelValues(label, bucket)
+			return
+		}
+		metrics.UsageBytes.WithLabelValues(label, bucket).Add(float64(to.Bytes - from.Bytes))
+		metrics.UsageObjects.WithLabelValues(label, bucket).Add(float64(to.Objects - from.Objects))
+	})
+}
+
+// usageTenant returns the tenant that a backend object is accounted to.
+// Erasure pieces belong to the tenant of the object they are part of.
+func usageTenant(key string) string {
+	return tenantOf(strings.TrimPrefix(key, erasurePrefix))
+}
+
+// storedSize returns the size of key in bucket, or -1 if it does not
+// exist, for the usage to account an overwrite or delete of it. It returns
+// -1 without calling the backend when usage accounting is disabled. The
+// caller should hold a backend slot for bucket.
+func (s *TempoS3ShardServer) storedSize(ctx context.Context, bucket, key string) (int64, error) {
+	if s.usage == nil {
+		return -1, nil
+	}
+	info, err := s.clients().GetIdempotentClient().StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if isNotFound(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return info.Size, nil
+}
+
+// recordPut and recordDelete keep the usage up to date after successful
+// backend writes. prev is the size of the object replaced, or -1.
+func (s *TempoS3ShardServer) recordPut(bucket, key string, prev, size int64) {
+	if s.usage != nil {
+		s.usage.Put(bucket, key, prev, size)
+	}
+}
+
+func (s *TempoS3ShardServer) recordDelete(bucket, key string, size int64) {
+	if s.usage != nil && size >= 0 {
+		s.usage.Delete(bucket, key, size)
+	}
+}
+
+// runUsageScan seeds the usage by scanning every shard bucket, then scans
+// them again every usage.rescan_interval. A bucket whose scan failed is
+// retried sooner.
+func (s *TempoS3ShardServer) runUsageScan() {
+	for {
+		buckets := s.cfg().Buckets
+		s.usage.Retain(buckets)
+		failed := false
+		for _, bucket := range buckets {
+			if !s.scanUsage(bucket) {
+				failed = true
+			}
+		}
+
+		wait := s.cfg().Usage.RescanInterval.Std()
+		if failed {
+			wait = min(wait, usageRetryInterval)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// scanUsage lists a bucket a page at a time, through admission control and
+// the shard's circuit breaker, and replaces its usage with the result. It
+// reports whether the scan completed.
+func (s *TempoS3ShardServer) scanUsage(bucket string) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	start := time.Now()
+	scan := s.usage.BeginScan(bucket)
+	objects := 0
+	startAfter := ""
+	for {
+		var page []minio.ObjectInfo
+		err := s.retryBackend(ctx, "list", bucket, func() error {
+			var err error
+			page, err = s.usagePage(ctx, bucket, startAfter)
+			return err
+		})
+		if err != nil {
+			scan.Abort()
+			s.logger.Warn("Usage scan failed", "bucket", bucket, "objects", objects, "error", err)
+			return false
+		}
+		for _, object := range page {
+			scan.Add(object.Key, object.Size)
+		}
+		objects += len(page)
+		if len(page) < listPageSize {
+			break
+		}
+		startAfter = page[len(page)-1].Key
+	}
+	scan.Commit()
+	metrics.UsageLastScan.WithLabelValues(bucket).SetToCurrentTime()
+	s.logger.Info("Usage scan complete", "bucket", bucket, "objects", objects, "duration_ms", time.Since(start).Seconds()*1000)
+	return true
+}
+
+// usagePage lists up to listPageSize objects of bucket following the key
+// startAfter, including the proxy's internal keys.
+func (s *TempoS3ShardServer) usagePage(ctx context.Context, bucket, startAfter string) ([]minio.ObjectInfo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opts := minio.ListObjectsOptions{Recursive: true, StartAfter: startAfter, MaxKeys: listPageSize}
+	page := make([]minio.ObjectInfo, 0, listPageSize)
+	for object := range s.clients().GetIdempotentClient().ListObjectsIter(ctx, bucket, opts) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		page = append(page, object)
+		if len(page) == listPageSize {
+			break
+		}
+	}
+	return page, nil
+}
+
+// storedEstimate returns how many bytes a PUT of size bytes under key
+// adds to the backend, counted as usage counts them: every replica or
+// erasure piece, with the encryption overhead. Compression is assumed to
+// save nothing, so the estimate is an upper bound. passthrough is set for
+// objects encrypted by the backend, which are never erasure coded.
+func (s *TempoS3ShardServer) storedEstimate(key string, size int64, passthrough bool) int64 {
+	rt := s.runtime()
+	stored := size
+	if rt.keyring != nil {
+		stored = envelope.EncryptedSize(stored, rt.config.Encryption.ChunkSize)
+	}
+	if !passthrough && s.useErasure(stored) {
+		cfg := rt.config.Erasure
+		m := erasureManifest{
+			Size:         stored,
+			DataShards:   cfg.DataShards,
+			ParityShards: cfg.ParityShards,
+			BlockSize:    min(cfg.BlockSize, (stored+int64(cfg.DataShards)-1)/int64(cfg.DataShards)),
+		}
+		return m.stripes() * m.BlockSize * int64(cfg.DataShards+cfg.ParityShards)
+	}
+	return stored * int64(len(s.clients().GetReplicaBucketsForKey(key)))
+}
+
+// reserveQuota holds the bytes a PUT of size bytes under key will store
+// against the quota of its tenant until release is called, which must be
+// once the write has been recorded or has failed. If the tenant's usage
+// and its other writes in progress leave no room for them, it writes
+// QuotaExceeded and returns false. Quotas are not enforced until every
+// bucket has been scanned, as the usage is not known before.
+func (s *TempoS3ShardServer) reserveQuota(w http.ResponseWriter, r *http.Request, key string, size int64, passthrough bool) (release func(), ok bool) {
+	release = func() {}
+	if s.usage == nil {
+		return release, true
+	}
+	cfg := s.cfg()
+	tenant := tenantOf(key)
+	quota := cfg.Usage.Quota(tenant)
+	if quota.MaxBytes <= 0 {
+		return release, true
+	}
+	if _, scanned := s.usage.Scanned(cfg.Buckets); !scanned {
+		return release, true
+	}
+	stored := s.storedEstimate(key, size, passthrough)
+	used, release, ok := s.usage.Reserve(tenant, stored, quota.MaxBytes)
+	if ok {
+		return release, true
+	}
+
+	metrics.QuotaExceededTotal.WithLabelValues(tenantLabel(cfg.Usage.Quotas, tenant)).Inc()
+	s.logger.Warn("Quota exceeded", "tenant", tenant, "object_key", key, "size", size, "stored_bytes", stored, "used_bytes", used.Bytes, "max_bytes", quota.MaxBytes)
+	writeS3Error(w, r, http.StatusForbidden, "QuotaExceeded", "The tenant's storage quota has been exceeded.")
+	return nil, false
+}
+
+// usageReport is the body of /admin/usage.
+type usageReport struct {
+	// Complete is false until every bucket has been scanned; usage is
+	// undercounted before.
+	Complete bool                 `json:"complete"`
+	Scanned  map[string]time.Time `json:"scanned"`
+	Tenants  []tenantUsage        `json:"tenants"`
+}
+
+type tenantUsage struct {
+	Tenant   string                 `json:"tenant"`
+	Bytes    int64                  `json:"bytes"`
+	Objects  int64                  `json:"objects"`
+	MaxBytes int64                  `json:"max_bytes,omitempty"`
+	Shards   map[string]usage.Usage `json:"shards"`
+}
+
+// handleUsage serves the usage of every tenant, or of the tenant given by
+// the tenant query parameter, as JSON.
+func (s *TempoS3ShardServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+		return
+	}
+	if s.usage == nil {
+		http.Error(w, "usage accounting is disabled", http.StatusNotFound)
+		return
+	}
+	cfg := s.cfg()
+	report := usageReport{Tenants: []tenantUsage{}}
+	report.Scanned, report.Complete = s.usage.Scanned(cfg.Buckets)
+
+	query := r.URL.Query()
+	for tenant, shards := range s.usage.Snapshot() {
+		if query.Has("tenant") && tenant != query.Get("tenant") {
+			continue
+		}
+		t := tenantUsage{Tenant: tenant, MaxBytes: cfg.Usage.Quota(tenant).MaxBytes, Shards: shards}
+		for _, u := range shards {
+			t.Bytes += u.Bytes
+			t.Objects += u.Objects
+		}
+		report.Tenants = append(report.Tenants, t)
+	}
+	slices.SortFunc(report.Tenants, func(a, b tenantUsage) int { return strings.Compare(a.Tenant, b.Tenant) })
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
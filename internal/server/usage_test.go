@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tempo-s3-shard/internal/config"
+	"tempo-s3-shard/internal/metrics"
+)
+
+func TestUsageMetricTenants(t *testing.T) {
+	tr := newUsageTracker(config.UsageConfig{
+		Enabled: true,
+		Quotas:  map[string]config.Quota{"heavy": {MaxBytes: 1000}},
+	})
+	tr.Put("usage-test", "heavy/1", -1, 100)
+	for _, key := range []string{"a/1", "b/1", "c/1"} {
+		tr.Put("usage-test", key, -1, 10)
+	}
+	tr.Put("usage-test", "a/1", 10, 30)
+	tr.Delete("usage-test", "b/1", 10)
+
+	if got := testutil.ToFloat64(metrics.UsageBytes.WithLabelValues("heavy", "usage-test")); got != 100 {
+		t.Fatalf("heavy has %v bytes, want 100", got)
+	}
+	if got := testutil.ToFloat64(metrics.UsageBytes.WithLabelValues("other", "usage-test")); got != 40 {
+		t.Fatalf("other tenants have %v bytes, want 40", got)
+	}
+	if got := testutil.ToFloat64(metrics.UsageObjects.WithLabelValues("other", "usage-test")); got != 2 {
+		t.Fatalf("other tenants have %v objects, want 2", got)
+	}
+	for _, tenant := range []string{"a", "b", "c"} {
+		if metrics.UsageBytes.DeleteLabelValues(tenant, "usage-test") {
+			t.Fatalf("tenant %s without a quota has its own series", tenant)
+		}
+	}
+
+	tr.Delete("usage-test", "heavy/1", 100)
+	if metrics.UsageBytes.DeleteLabelValues("heavy", "usage-test") {
+		t.Fatal("series of a tenant with no objects left kept")
+	}
+}
@@ -0,0 +1,277 @@
+package usage
+
+import (
+	"sync"
+	"time"
+)
+
+// Usage is the storage used by a tenant on a shard, or in total.
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+func (u *Usage) add(size, objects int64) {
+	u.Bytes += size
+	u.Objects += objects
+}
+
+// ChangeFunc is called with the previous and the new usage of a tenant on
+// a shard whenever it may have changed.
+type ChangeFunc func(tenant, bucket string, from, to Usage)
+
+// Tracker accounts the objects stored in each shard bucket to tenants. It
+// keeps only the totals of each tenant on each shard: a shard's totals are
+// seeded by a Scan of the bucket and then adjusted by Put and Delete, which
+// are given the size of the object they replace or remove.
+type Tracker struct {
+	tenantOf func(key string) string
+	onChange ChangeFunc
+
+	mu     sync.Mutex
+	shards map[string]*shard
+	// reserved is the bytes held for writes in progress, by tenant.
+	reserved map[string]int64
+}
+
+type shard struct {
+	tenants map[string]Usage
+	// scanned is when the last scan of the shard completed.
+	scanned time.Time
+	// scan is the scan running over the shard, nil if none.
+	scan *Scan
+}
+
+func newShard() *shard {
+	return &shard{tenants: make(map[string]Usage)}
+}
+
+// New returns a Tracker that attributes keys to tenants with tenantOf.
+// onChange may be nil.
+func New(tenantOf func(key string) string, onChange ChangeFunc) *Tracker {
+	return &Tracker{
+		tenantOf: tenantOf,
+		onChange: onChange,
+		shards:   make(map[string]*shard),
+		reserved: make(map[string]int64),
+	}
+}
+
+// shard returns the state of bucket, creating it if needed. t.mu must be
+// held.
+func (t *Tracker) shard(bucket string) *shard {
+	sh, ok := t.shards[bucket]
+	if !ok {
+		sh = newShard()
+		t.shards[bucket] = sh
+	}
+	return sh
+}
+
+// Put records that key was stored in bucket with the given size. prev is
+// the size of the object it replaced, or -1 if there was none.
+func (t *Tracker) Put(bucket, key string, prev, size int64) {
+	if prev < 0 {
+		t.apply(bucket, key, size, 1)
+	} else {
+		t.apply(bucket, key, size-prev, 0)
+	}
+}
+
+// Delete records that key, of the given size, was removed from bucket.
+func (t *Tracker) Delete(bucket, key string, size int64) {
+	t.apply(bucket, key, -size, -1)
+}
+
+// apply adds a change to the tenant of key on bucket and reports its new
+// usage. A scan of the bucket that has already listed key would not see
+// the change, so it is applied to the scan's result as well.
+func (t *Tracker) apply(bucket, key string, size, objects int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sh := t.shard(bucket)
+	tenant := t.tenantOf(key)
+	from := sh.tenants[tenant]
+	u := from
+	u.add(size, objects)
+	if u.Objects == 0 {
+		delete(sh.tenants, tenant)
+	} else {
+		sh.tenants[tenant] = u
+	}
+	if sh.scan != nil && key <= sh.scan.last {
+		sh.scan.add(tenant, size, objects)
+	}
+	if t.onChange != nil {
+		t.onChange(tenant, bucket, from, u)
+	}
+}
+
+// Scan rebuilds the totals of one bucket from a listing of its objects,
+// which must be in key order.
+type Scan struct {
+	t       *Tracker
+	bucket  string
+	tenants map[string]Usage
+	// last is the last key listed. t.mu guards both fields.
+	last string
+}
+
+func (s *Scan) add(tenant string, size, objects int64) {
+	u := s.tenants[tenant]
+	u.add(size, objects)
+	s.tenants[tenant] = u
+}
+
+// BeginScan starts a scan of bucket. The listing is passed to Add and the
+// scan then ended with Commit, or with Abort if the listing failed.
+// Changes recorded while the scan runs to keys it has already listed are
+// applied to its result. A change made between a key being listed and
+// being passed to Add is missed until the next scan.
+func (t *Tracker) BeginScan(bucket string) *Scan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &Scan{t: t, bucket: bucket, tenants: make(map[string]Usage)}
+	t.shard(bucket).scan = s
+	return s
+}
+
+// Add records an object found by the scan.
+func (s *Scan) Add(key string, size int64) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.add(s.t.tenantOf(key), size, 1)
+	s.last = key
+}
+
+// Abort ends the scan, keeping the shard's previous totals.
+func (s *Scan) Abort() {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	if sh := s.t.shards[s.bucket]; sh != nil && sh.scan == s {
+		sh.scan = nil
+	}
+}
+
+// Commit replaces the shard's totals with the scan's result.
+func (s *Scan) Commit() {
+	t := s.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.shard(s.bucket)
+
+	sh := newShard()
+	for tenant, u := range s.tenants {
+		if u.Objects != 0 {
+			sh.tenants[tenant] = u
+		}
+	}
+	sh.scanned = time.Now()
+	t.shards[s.bucket] = sh
+
+	if t.onChange != nil {
+		for tenant, u := range old.tenants {
+			if _, ok := sh.tenants[tenant]; !ok {
+				t.onChange(tenant, s.bucket, u, Usage{})
+			}
+		}
+		for tenant, u := range sh.tenants {
+			t.onChange(tenant, s.bucket, old.tenants[tenant], u)
+		}
+	}
+}
+
+// Retain drops the state of buckets not in buckets, such as shards removed
+// from the ring.
+func (t *Tracker) Retain(buckets []string) {
+	keep := make(map[string]bool, len(buckets))
+	for _, bucket := range buckets {
+		keep[bucket] = true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for bucket, sh := range t.shards {
+		if keep[bucket] {
+			continue
+		}
+		delete(t.shards, bucket)
+		if t.onChange != nil {
+			for tenant, u := range sh.tenants {
+				t.onChange(tenant, bucket, u, Usage{})
+			}
+		}
+	}
+}
+
+// Scanned returns when each of buckets was last scanned. It reports false
+// if some bucket has never been scanned.
+func (t *Tracker) Scanned(buckets []string) (map[string]time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	scanned := make(map[string]time.Time, len(buckets))
+	all := true
+	for _, bucket := range buckets {
+		sh, ok := t.shards[bucket]
+		if !ok || sh.scanned.IsZero() {
+			all = false
+			continue
+		}
+		scanned[bucket] = sh.scanned
+	}
+	return scanned, all
+}
+
+// tenant returns the usage of tenant summed over all shards. t.mu must be
+// held.
+func (t *Tracker) tenant(tenant string) Usage {
+	var total Usage
+	for _, sh := range t.shards {
+		u := sh.tenants[tenant]
+		total.add(u.Bytes, u.Objects)
+	}
+	return total
+}
+
+// Reserve holds size bytes for a write by tenant if its usage, together
+// with the bytes held for its other writes in progress, leaves room for
+// them under maxBytes. It returns the tenant's usage including those
+// reservations, and on success a function that gives the bytes back once
+// the write has been recorded or has failed.
+func (t *Tracker) Reserve(tenant string, size, maxBytes int64) (Usage, func(), bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	used := t.tenant(tenant)
+	used.Bytes += t.reserved[tenant]
+	if used.Bytes+size > maxBytes {
+		return used, nil, false
+	}
+	t.reserved[tenant] += size
+
+	var once sync.Once
+	return used, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.reserved[tenant] -= size; t.reserved[tenant] == 0 {
+				delete(t.reserved, tenant)
+			}
+		})
+	}, true
+}
+
+// Snapshot returns the usage of every tenant on every shard, by tenant and
+// then bucket.
+func (t *Tracker) Snapshot() map[string]map[string]Usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snapshot := make(map[string]map[string]Usage)
+	for bucket, sh := range t.shards {
+		for tenant, u := range sh.tenants {
+			if snapshot[tenant] == nil {
+				snapshot[tenant] = make(map[string]Usage)
+			}
+			snapshot[tenant][bucket] = u
+		}
+	}
+	return snapshot
+}
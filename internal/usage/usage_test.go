@@ -0,0 +1,125 @@
+package usage
+
+import (
+	"strings"
+	"testing"
+)
+
+func firstSegment(key string) string {
+	tenant, _, _ := strings.Cut(key, "/")
+	return tenant
+}
+
+func TestDeltas(t *testing.T) {
+	tr := New(firstSegment, nil)
+	tr.Put("shard1", "a/1", -1, 100)
+	tr.Put("shard2", "a/1", -1, 100)
+	tr.Put("shard1", "a/1", 100, 40)
+	tr.Put("shard1", "b/1", -1, 7)
+	if u := tr.Snapshot()["a"]["shard1"]; u != (Usage{Bytes: 40, Objects: 1}) {
+		t.Fatalf("after an overwrite a has %+v on shard1, want 40 bytes in 1 object", u)
+	}
+
+	tr.Delete("shard1", "a/1", 40)
+	snapshot := tr.Snapshot()
+	if _, ok := snapshot["a"]["shard1"]; ok {
+		t.Fatalf("a still has %+v on shard1 after its only object was deleted", snapshot["a"]["shard1"])
+	}
+	if u := snapshot["a"]["shard2"]; u != (Usage{Bytes: 100, Objects: 1}) {
+		t.Fatalf("a has %+v on shard2, want the replica's 100 bytes", u)
+	}
+}
+
+// TestScanChanges checks that a change made during a scan counts once,
+// whether the scan listed the key before or after it.
+func TestScanChanges(t *testing.T) {
+	tr := New(firstSegment, nil)
+	scan := tr.BeginScan("shard1")
+	scan.Add("a/1", 10)
+	// Already listed: the scan saw the old size
+	tr.Put("shard1", "a/1", 10, 30)
+	// Not yet listed: the scan will see the new object
+	tr.Put("shard1", "a/3", -1, 5)
+	scan.Add("a/2", 20)
+	scan.Add("a/3", 5)
+	// Already listed, and removed
+	tr.Delete("shard1", "a/2", 20)
+	scan.Commit()
+
+	if u := tr.Snapshot()["a"]["shard1"]; u != (Usage{Bytes: 35, Objects: 2}) {
+		t.Fatalf("a has %+v after the scan, want 35 bytes in 2 objects", u)
+	}
+	if _, scanned := tr.Scanned([]string{"shard1"}); !scanned {
+		t.Fatal("shard1 not reported as scanned")
+	}
+}
+
+func TestScanAbort(t *testing.T) {
+	tr := New(firstSegment, nil)
+	tr.Put("shard1", "a/1", -1, 10)
+	scan := tr.BeginScan("shard1")
+	scan.Add("a/1", 10)
+	scan.Add("a/2", 99)
+	scan.Abort()
+	tr.Put("shard1", "a/1", 10, 15)
+
+	if u := tr.Snapshot()["a"]["shard1"]; u != (Usage{Bytes: 15, Objects: 1}) {
+		t.Fatalf("a has %+v after an aborted scan, want 15 bytes in 1 object", u)
+	}
+	if _, scanned := tr.Scanned([]string{"shard1"}); scanned {
+		t.Fatal("shard1 reported as scanned after an aborted scan")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	tr := New(firstSegment, nil)
+	tr.Put("shard1", "a/1", -1, 50)
+
+	_, release, ok := tr.Reserve("a", 30, 100)
+	if !ok {
+		t.Fatal("reservation within the quota refused")
+	}
+	// The first reservation is still held
+	if used, _, ok := tr.Reserve("a", 30, 100); ok || used.Bytes != 80 {
+		t.Fatalf("second reservation got %v with %d bytes used, want refused with 80", ok, used.Bytes)
+	}
+	if _, _, ok := tr.Reserve("b", 30, 100); !ok {
+		t.Fatal("reservation of another tenant refused")
+	}
+
+	release()
+	release()
+	if _, _, ok := tr.Reserve("a", 50, 100); !ok {
+		t.Fatal("reservation refused after the first was released")
+	}
+}
+
+// TestChanges checks that the changes reported add up to the usage, so
+// that they can be summed over tenants.
+func TestChanges(t *testing.T) {
+	totals := make(map[string]Usage)
+	tr := New(firstSegment, func(tenant, bucket string, from, to Usage) {
+		u := totals[bucket]
+		u.add(to.Bytes-from.Bytes, to.Objects-from.Objects)
+		totals[bucket] = u
+	})
+	tr.Put("shard1", "a/1", -1, 100)
+	tr.Put("shard1", "b/1", -1, 10)
+	tr.Put("shard1", "a/1", 100, 40)
+	tr.Put("shard2", "b/1", -1, 10)
+	scan := tr.BeginScan("shard1")
+	scan.Add("a/1", 40)
+	scan.Add("c/1", 5)
+	scan.Commit()
+	if want := (Usage{Bytes: 45, Objects: 2}); totals["shard1"] != want {
+		t.Fatalf("changes on shard1 add up to %+v, want %+v", totals["shard1"], want)
+	}
+
+	tr.Delete("shard2", "b/1", 10)
+	tr.Retain(nil)
+	for bucket, u := range totals {
+		if u != (Usage{}) {
+			t.Fatalf("changes on %s add up to %+v after every object was removed", bucket, u)
+		}
+	}
+}
@@ -4,8 +4,9 @@ import (
 	"flag"
 	"log"
 	"log/slog"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"tempo-s3-shard/internal/config"
 	"tempo-s3-shard/internal/server"
@@ -17,11 +18,25 @@ func main() {
 		Level: slog.LevelInfo,
 	}))
 	
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
+
 	configFile := flag.String("config", "config.json", "Path to configuration file")
+	useDefaults := flag.Bool("use-defaults", false, "Start with the built-in defaults if the configuration file cannot be loaded")
+	var overrides []string
+	flag.Func("set", "Override a setting, as path=value (for example timeouts.get=10s); may be repeated", func(v string) error {
+		overrides = append(overrides, v)
+		return nil
+	})
 	flag.Parse()
 
-	cfg, err := config.LoadConfig(*configFile)
+	cfg, err := config.LoadConfig(*configFile, overrides...)
 	if err != nil {
+		if !*useDefaults {
+			logger.Error("Failed to load config file", "error", err)
+			os.Exit(1)
+		}
 		logger.Warn("Failed to load config file, using defaults", "error", err)
 		cfg = config.DefaultConfig()
 	}
@@ -38,7 +53,13 @@ func main() {
 		log.Fatal("Failed to create server")
 	}
 	
-	if err := http.ListenAndServe(cfg.ListenAddr, s3Server); err != nil {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go s3Server.WatchConfig(*configFile, overrides, hup)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	if err := s3Server.ListenAndServe(stop); err != nil {
 		logger.Error("Server failed to start", "error", err)
 		log.Fatal("Server startup failed")
 	}